@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -21,7 +22,10 @@ type AlbyOAuthService struct {
 	cfg       *Config
 	oauthConf *oauth2.Config
 	db        *gorm.DB
+	secrets   *SecretBox
 	Logger    *logrus.Logger
+	// records logins in the audit log of the service
+	auditRequest func(c echo.Context, userId uint, appId uint, action string, details map[string]interface{})
 }
 
 func NewAlbyOauthService(svc *Service, e *echo.Echo) (result *AlbyOAuthService, err error) {
@@ -42,7 +46,10 @@ func NewAlbyOauthService(svc *Service, e *echo.Echo) (result *AlbyOAuthService,
 		cfg:       svc.cfg,
 		oauthConf: conf,
 		db:        svc.db,
+		secrets:   svc.secrets,
 		Logger:    svc.Logger,
+
+		auditRequest: svc.auditRequest,
 	}
 
 	e.GET("/alby/auth", albySvc.AuthHandler)
@@ -53,9 +60,19 @@ func NewAlbyOauthService(svc *Service, e *echo.Echo) (result *AlbyOAuthService,
 
 func (svc *AlbyOAuthService) FetchUserToken(ctx context.Context, app App) (token *oauth2.Token, err error) {
 	user := app.User
+	accessToken, err := svc.secrets.Decrypt(user.AccessToken)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to decrypt access token")
+		return nil, err
+	}
+	refreshToken, err := svc.secrets.Decrypt(user.RefreshToken)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to decrypt refresh token")
+		return nil, err
+	}
 	tok, err := svc.oauthConf.TokenSource(ctx, &oauth2.Token{
-		AccessToken:  user.AccessToken,
-		RefreshToken: user.RefreshToken,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
 		Expiry:       user.Expiry,
 	}).Token()
 	if err != nil {
@@ -68,9 +85,11 @@ func (svc *AlbyOAuthService) FetchUserToken(ctx context.Context, app App) (token
 	}
 	// we always update the user's token for future use
 	// the oauth library handles the token refreshing
-	user.AccessToken = tok.AccessToken
-	user.RefreshToken = tok.RefreshToken
-	user.Expiry = tok.Expiry // TODO; probably needs some calculation
+	err = svc.setUserToken(&user, tok)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to encrypt token")
+		return nil, err
+	}
 	err = svc.db.Save(&user).Error
 	if err != nil {
 		svc.Logger.WithError(err).Error("Error saving user")
@@ -79,6 +98,24 @@ func (svc *AlbyOAuthService) FetchUserToken(ctx context.Context, app App) (token
 	return tok, nil
 }
 
+// setUserToken stores the token encrypted if a master key is configured
+func (svc *AlbyOAuthService) setUserToken(user *User, tok *oauth2.Token) (err error) {
+	user.AccessToken, err = svc.secrets.Encrypt(tok.AccessToken)
+	if err != nil {
+		return err
+	}
+	user.RefreshToken, err = svc.secrets.Encrypt(tok.RefreshToken)
+	if err != nil {
+		return err
+	}
+	user.Expiry = tok.Expiry // TODO; probably needs some calculation
+	// only sent by the token endpoint, tokens that were not refreshed have no scope
+	if scope, ok := tok.Extra("scope").(string); ok && scope != "" {
+		user.AlbyScopes = scope
+	}
+	return nil
+}
+
 func (svc *AlbyOAuthService) MakeInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
 	// TODO: move to a shared function
 	app := App{}
@@ -467,7 +504,7 @@ func (svc *AlbyOAuthService) ListTransactions(ctx context.Context, senderPubkey
 	return nil, errors.New(errorPayload.Message)
 }
 
-func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
+func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string, amount int64) (preimage string, err error) {
 	app := App{}
 	err = svc.db.Preload("User").First(&app, &App{
 		NostrPubkey: senderPubkey,
@@ -494,6 +531,8 @@ func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey,
 	body := bytes.NewBuffer([]byte{})
 	payload := &PayRequest{
 		Invoice: payReq,
+		// Alby API only supports sats
+		Amount: amount / 1000,
 	}
 	err = json.NewEncoder(body).Encode(payload)
 
@@ -542,9 +581,83 @@ func (svc *AlbyOAuthService) SendPaymentSync(ctx context.Context, senderPubkey,
 		"userId":        app.User.ID,
 		"APIHttpStatus": resp.StatusCode,
 	}).Errorf("Payment failed %s", string(errorPayload.Message))
+	// the API refused the payment, server errors leave it unknown whether it is in flight
+	if resp.StatusCode < 500 {
+		return "", fmt.Errorf("%w: %s", ErrPaymentFailed, errorPayload.Message)
+	}
 	return "", errors.New(errorPayload.Message)
 }
 
+func (svc *AlbyOAuthService) LookupPayment(ctx context.Context, senderPubkey string, paymentHash string) (state string, preimage string, err error) {
+	app := App{}
+	err = svc.db.Preload("User").First(&app, &App{
+		NostrPubkey: senderPubkey,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"paymentHash":  paymentHash,
+		}).Errorf("App not found: %v", err)
+		return "", "", err
+	}
+	tok, err := svc.FetchUserToken(ctx, app)
+	if err != nil {
+		return "", "", err
+	}
+	client := svc.oauthConf.Client(ctx, tok)
+
+	// outgoing payments are stored as invoices of the account too
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/invoices/%s", svc.cfg.AlbyAPIURL, paymentHash), nil)
+	if err != nil {
+		svc.Logger.WithError(err).Errorf("Error creating request /invoices/%s", paymentHash)
+		return "", "", err
+	}
+
+	req.Header.Set("User-Agent", "NWC")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey": senderPubkey,
+			"paymentHash":  paymentHash,
+			"appId":        app.ID,
+			"userId":       app.User.ID,
+		}).Errorf("Failed to lookup payment: %v", err)
+		return "", "", err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		// the API might not list the payment yet, only a definitive failure allows paying the invoice again
+		return PAYMENT_STATE_PENDING, "", nil
+	}
+	if resp.StatusCode >= 300 {
+		errorPayload := &ErrorResponse{}
+		err = json.NewDecoder(resp.Body).Decode(errorPayload)
+		svc.Logger.WithFields(logrus.Fields{
+			"senderPubkey":  senderPubkey,
+			"paymentHash":   paymentHash,
+			"appId":         app.ID,
+			"userId":        app.User.ID,
+			"APIHttpStatus": resp.StatusCode,
+		}).Errorf("Lookup payment failed %s", string(errorPayload.Message))
+		return "", "", errors.New(errorPayload.Message)
+	}
+
+	responsePayload := &AlbyInvoice{}
+	err = json.NewDecoder(resp.Body).Decode(responsePayload)
+	if err != nil {
+		return "", "", err
+	}
+	if responsePayload.Settled {
+		return PAYMENT_STATE_SETTLED, responsePayload.Preimage, nil
+	}
+	if responsePayload.State == "error" {
+		return PAYMENT_STATE_FAILED, "", nil
+	}
+	return PAYMENT_STATE_PENDING, "", nil
+}
+
 func (svc *AlbyOAuthService) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, custom_records []TLVRecord) (preImage string, err error) {
 	app := App{}
 	err = svc.db.Preload("User").First(&app, &App{
@@ -632,6 +745,75 @@ func (svc *AlbyOAuthService) SendKeysend(ctx context.Context, senderPubkey strin
 	return "", errors.New(errorPayload.Message)
 }
 
+func (svc *AlbyOAuthService) MakeHoldInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, paymentHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	return nil, ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) SettleHoldInvoice(ctx context.Context, senderPubkey string, preimage string) (err error) {
+	return ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) CancelHoldInvoice(ctx context.Context, senderPubkey string, paymentHash string) (err error) {
+	return ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) GetHoldInvoiceState(ctx context.Context, senderPubkey string, paymentHash string) (state string, err error) {
+	return "", ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) FetchOfferInvoice(ctx context.Context, senderPubkey string, offer string, amount int64, payerNote string) (invoice string, paymentHash string, invoiceAmount int64, err error) {
+	return "", "", 0, ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) PayOfferInvoice(ctx context.Context, senderPubkey string, invoice string) (preimage string, err error) {
+	return "", ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) MakeOffer(ctx context.Context, senderPubkey string, amount int64, description string) (offer string, err error) {
+	return "", ErrNotImplemented
+}
+
+// the Alby wallet API has no hold invoices, offers, on-chain or channel endpoints
+var albySupportedMethods = []string{
+	NIP_47_PAY_INVOICE_METHOD,
+	NIP_47_PAY_KEYSEND_METHOD,
+	NIP_47_PAY_LNURL_METHOD,
+	NIP_47_GET_BALANCE_METHOD,
+	NIP_47_GET_INFO_METHOD,
+	NIP_47_GET_BUDGET_METHOD,
+	NIP_47_MAKE_INVOICE_METHOD,
+	NIP_47_LOOKUP_INVOICE_METHOD,
+	NIP_47_LIST_TRANSACTIONS_METHOD,
+}
+
+// the OAuth scope each method needs, the others are served without calling the Alby API
+var albyMethodScopes = map[string]string{
+	NIP_47_PAY_INVOICE_METHOD:       "payments:send",
+	NIP_47_PAY_KEYSEND_METHOD:       "payments:send",
+	NIP_47_PAY_LNURL_METHOD:         "payments:send",
+	NIP_47_GET_BALANCE_METHOD:       "balance:read",
+	NIP_47_MAKE_INVOICE_METHOD:      "invoices:create",
+	NIP_47_LOOKUP_INVOICE_METHOD:    "invoices:read",
+	NIP_47_LIST_TRANSACTIONS_METHOD: "transactions:read",
+}
+
+// GetSupportedMethods returns the methods the Alby account of the user granted the scopes for,
+// without a user all methods the Alby backend can serve
+func (svc *AlbyOAuthService) GetSupportedMethods(ctx context.Context, user *User) (methods []string, err error) {
+	// or logged in before the scopes were recorded
+	if user == nil || user.AlbyScopes == "" {
+		return albySupportedMethods, nil
+	}
+	scopes := strings.Fields(user.AlbyScopes)
+	for _, method := range albySupportedMethods {
+		scope, ok := albyMethodScopes[method]
+		if !ok || containsMethod(scopes, scope) {
+			methods = append(methods, method)
+		}
+	}
+	return methods, nil
+}
+
 func (svc *AlbyOAuthService) AuthHandler(c echo.Context) error {
 	appName := c.QueryParam("c") // c - for client
 	// clear current session
@@ -639,10 +821,6 @@ func (svc *AlbyOAuthService) AuthHandler(c echo.Context) error {
 	if sess.Values["user_id"] != nil {
 		delete(sess.Values, "user_id")
 		sess.Options.MaxAge = 0
-		sess.Options.SameSite = http.SameSiteLaxMode
-		if svc.cfg.CookieDomain != "" {
-			sess.Options.Domain = svc.cfg.CookieDomain
-		}
 		sess.Save(c.Request(), c.Response())
 	}
 
@@ -681,21 +859,17 @@ func (svc *AlbyOAuthService) CallbackHandler(c echo.Context) error {
 
 	user := User{}
 	svc.db.FirstOrInit(&user, User{AlbyIdentifier: me.Identifier})
-	user.AccessToken = tok.AccessToken
-	user.RefreshToken = tok.RefreshToken
-	user.Expiry = tok.Expiry // TODO; probably needs some calculation
+	err = svc.setUserToken(&user, tok)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to encrypt token")
+		return err
+	}
 	user.Email = me.Email
 	user.LightningAddress = me.LightningAddress
 	svc.db.Save(&user)
 
-	sess, _ := session.Get(CookieName, c)
-	sess.Options.MaxAge = 0
-	sess.Options.SameSite = http.SameSiteLaxMode
-	if svc.cfg.CookieDomain != "" {
-		sess.Options.Domain = svc.cfg.CookieDomain
-	}
-	sess.Values["user_id"] = user.ID
-	sess.Save(c.Request(), c.Response())
+	setSessionUser(c, svc.cfg, user.ID)
+	svc.auditRequest(c, user.ID, 0, AUDIT_LOGIN, map[string]interface{}{"method": "alby"})
 	return c.Redirect(302, "/")
 }
 
@@ -736,3 +910,31 @@ func albyInvoiceToTransaction(invoice *AlbyInvoice) *Nip47Transaction {
 		Metadata:        invoice.Metadata,
 	}
 }
+
+func (svc *AlbyOAuthService) SignMessage(ctx context.Context, senderPubkey string, message string) (signature string, err error) {
+	return "", ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) VerifyMessage(ctx context.Context, senderPubkey string, message string, signature string) (valid bool, pubkey string, err error) {
+	return false, "", ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) GetOnchainBalance(ctx context.Context, senderPubkey string) (balance *OnchainBalance, err error) {
+	return nil, ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) MakeOnchainAddress(ctx context.Context, senderPubkey string) (address string, err error) {
+	return "", ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) SendOnchain(ctx context.Context, senderPubkey string, address string, amount int64, satPerVbyte uint64) (txId string, err error) {
+	return "", ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) ListChannels(ctx context.Context, senderPubkey string) (channels []Channel, err error) {
+	return nil, ErrNotImplemented
+}
+
+func (svc *AlbyOAuthService) ListPendingChannels(ctx context.Context, senderPubkey string) (channels []PendingChannel, err error) {
+	return nil, ErrNotImplemented
+}
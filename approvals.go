@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// requiresApproval checks the approval threshold of the app's pay_invoice permission
+func (svc *Service) requiresApproval(app *App, amount int64) bool {
+	appPermission := AppPermission{}
+	svc.db.Where("app_id = ? AND request_method = ?", app.ID, NIP_47_PAY_INVOICE_METHOD).Limit(1).Find(&appPermission)
+	threshold := appPermission.ApprovalThreshold
+	return threshold > 0 && amount/MSAT_PER_SAT > int64(threshold)
+}
+
+// AwaitPaymentApproval persists a pending approval and blocks until the user approved or rejected it,
+// or the approval timed out.
+func (svc *Service) AwaitPaymentApproval(ctx context.Context, app *App, nostrEvent *NostrEvent, requestMethod string, amount int64, paymentRequest string, destination string) (approved bool, code string, message string) {
+	timeout := time.Duration(svc.cfg.PaymentApprovalTimeout) * time.Second
+	approval := PaymentApproval{
+		App:            *app,
+		NostrEvent:     *nostrEvent,
+		RequestMethod:  requestMethod,
+		Amount:         uint(amount / MSAT_PER_SAT),
+		PaymentRequest: paymentRequest,
+		Destination:    destination,
+		State:          PAYMENT_APPROVAL_STATE_PENDING,
+		ExpiresAt:      time.Now().Add(timeout),
+	}
+	err := svc.db.Create(&approval).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId": nostrEvent.NostrId,
+			"appId":   app.ID,
+		}).Errorf("Failed to save payment approval: %v", err)
+		return false, NIP_47_ERROR_INTERNAL, "Failed to request approval for payment"
+	}
+
+	decision := make(chan bool, 1)
+	svc.approvalsMu.Lock()
+	if svc.approvalChannels == nil {
+		svc.approvalChannels = map[uint]chan bool{}
+	}
+	svc.approvalChannels[approval.ID] = decision
+	svc.approvalsMu.Unlock()
+	defer func() {
+		svc.approvalsMu.Lock()
+		delete(svc.approvalChannels, approval.ID)
+		svc.approvalsMu.Unlock()
+	}()
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":    nostrEvent.NostrId,
+		"appId":      app.ID,
+		"approvalId": approval.ID,
+		"amount":     approval.Amount,
+	}).Info("Waiting for payment approval")
+
+	select {
+	case approved := <-decision:
+		return svc.paymentApprovalResult(approved)
+	case <-time.After(timeout):
+	case <-ctx.Done():
+	}
+
+	result := svc.db.Model(&PaymentApproval{}).
+		Where("id = ? AND state = ?", approval.ID, PAYMENT_APPROVAL_STATE_PENDING).
+		Update("state", PAYMENT_APPROVAL_STATE_EXPIRED)
+	if result.Error == nil && result.RowsAffected == 0 {
+		// the user decided just before the timeout, the decision might not be sent on the channel yet
+		decided := PaymentApproval{}
+		err = svc.db.First(&decided, approval.ID).Error
+		if err == nil && decided.State != PAYMENT_APPROVAL_STATE_EXPIRED {
+			return svc.paymentApprovalResult(decided.State == PAYMENT_APPROVAL_STATE_APPROVED)
+		}
+	}
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":    nostrEvent.NostrId,
+		"appId":      app.ID,
+		"approvalId": approval.ID,
+	}).Info("Payment approval timed out")
+	svc.auditPaymentDenied(app, requestMethod, amount, NIP_47_OTHER, "The payment was not approved in time")
+	return false, NIP_47_OTHER, "The payment was not approved in time"
+}
+
+func (svc *Service) paymentApprovalResult(approved bool) (bool, string, string) {
+	if !approved {
+		return false, NIP_47_ERROR_RESTRICTED, "The payment was rejected by the user"
+	}
+	return true, "", ""
+}
+
+// DecidePaymentApproval approves or rejects a pending payment of one of the user's apps
+func (svc *Service) DecidePaymentApproval(user *User, approvalId uint, approve bool) error {
+	approval := PaymentApproval{}
+	err := svc.db.Joins("App").Where("payment_approvals.id = ? AND App.user_id = ?", approvalId, user.ID).First(&approval).Error
+	if err != nil {
+		return err
+	}
+
+	state := PAYMENT_APPROVAL_STATE_REJECTED
+	if approve {
+		state = PAYMENT_APPROVAL_STATE_APPROVED
+	}
+	result := svc.db.Model(&PaymentApproval{}).
+		Where("id = ? AND state = ?", approval.ID, PAYMENT_APPROVAL_STATE_PENDING).
+		Update("state", state)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("Payment approval is no longer pending")
+	}
+
+	svc.approvalsMu.Lock()
+	decision, ok := svc.approvalChannels[approval.ID]
+	svc.approvalsMu.Unlock()
+	if ok {
+		decision <- approve
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"approvalId": approval.ID,
+		"appId":      approval.AppId,
+		"state":      state,
+	}).Info("Payment approval decided")
+	return nil
+}
+
+// ExpirePendingPaymentApprovals expires approvals that nobody is waiting for anymore, e.g. after a restart
+func (svc *Service) ExpirePendingPaymentApprovals() error {
+	return svc.db.Model(&PaymentApproval{}).
+		Where("state = ?", PAYMENT_APPROVAL_STATE_PENDING).
+		Update("state", PAYMENT_APPROVAL_STATE_EXPIRED).Error
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// maximum number of audit events shown on the audit page, the JSON export has no limit
+const AUDIT_PAGE_LIMIT = 200
+
+// recordAuditEvent appends an event to the audit log. Failures are logged but don't fail the action itself.
+func (svc *Service) recordAuditEvent(userId uint, appId uint, action string, ip string, details map[string]interface{}) {
+	event := AuditEvent{Action: action, IP: ip}
+	if userId != 0 {
+		event.UserId = &userId
+	}
+	if appId != 0 {
+		event.AppId = &appId
+	}
+	if details != nil {
+		detailsBytes, err := json.Marshal(details)
+		if err != nil {
+			svc.Logger.WithField("action", action).WithError(err).Error("Failed to encode audit event details")
+		}
+		event.Details = string(detailsBytes)
+	}
+	err := svc.db.Create(&event).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"userId": userId,
+			"appId":  appId,
+			"action": action,
+		}).WithError(err).Error("Failed to record audit event")
+	}
+}
+
+// auditRequest records an action of the user of a web UI request
+func (svc *Service) auditRequest(c echo.Context, userId uint, appId uint, action string, details map[string]interface{}) {
+	svc.recordAuditEvent(userId, appId, action, c.RealIP(), details)
+}
+
+// auditPaymentDenied records a payment of an app that was refused, e.g. because its budget is used up
+func (svc *Service) auditPaymentDenied(app *App, requestMethod string, amount int64, code string, message string) {
+	svc.recordAuditEvent(app.UserId, app.ID, AUDIT_PAYMENT_DENIED, "", map[string]interface{}{
+		"app":     app.Name,
+		"method":  requestMethod,
+		"amount":  amount / MSAT_PER_SAT,
+		"code":    code,
+		"message": message,
+	})
+}
+
+// auditEventsQuery returns the audit events of the user matching the filters of the request, newest first
+func (svc *Service) auditEventsQuery(c echo.Context, user *User) (events []AuditEvent, err error) {
+	query := svc.db.Where("user_id = ?", user.ID)
+	if action := c.QueryParam("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if appId, err := strconv.Atoi(c.QueryParam("app")); err == nil {
+		query = query.Where("app_id = ?", appId)
+	}
+	if from, err := time.ParseInLocation("2006-01-02", c.QueryParam("from"), time.Local); err == nil {
+		query = query.Where("created_at >= ?", from)
+	}
+	if to, err := time.ParseInLocation("2006-01-02", c.QueryParam("to"), time.Local); err == nil {
+		// including the whole day
+		query = query.Where("created_at < ?", to.AddDate(0, 0, 1))
+	}
+	err = query.Order("id desc").Find(&events).Error
+	return events, err
+}
+
+func (svc *Service) AuditListHandler(c echo.Context) error {
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return c.Redirect(302, "/")
+	}
+	events, err := svc.auditEventsQuery(c, user)
+	if err != nil {
+		return err
+	}
+	truncated := len(events) > AUDIT_PAGE_LIMIT
+	if truncated {
+		events = events[:AUDIT_PAGE_LIMIT]
+	}
+
+	// deleted apps are only known by the name in the details
+	appNames := map[uint]string{}
+	for _, app := range user.Apps {
+		appNames[app.ID] = app.Name
+	}
+	type AuditEventHelper struct {
+		AuditEvent
+		AppName string
+		Details map[string]interface{}
+	}
+	helpers := []AuditEventHelper{}
+	for _, event := range events {
+		helper := AuditEventHelper{AuditEvent: event}
+		if event.Details != "" {
+			json.Unmarshal([]byte(event.Details), &helper.Details)
+		}
+		if event.AppId != nil {
+			helper.AppName = appNames[*event.AppId]
+			if name, ok := helper.Details["app"].(string); ok && helper.AppName == "" {
+				helper.AppName = name
+			}
+		}
+		delete(helper.Details, "app")
+		helpers = append(helpers, helper)
+	}
+
+	return c.Render(http.StatusOK, "audit/index.html", map[string]interface{}{
+		"User":      user,
+		"Events":    helpers,
+		"Truncated": truncated,
+		"Limit":     AUDIT_PAGE_LIMIT,
+		"Actions":   AUDIT_ACTIONS,
+		"Apps":      user.Apps,
+		"Action":    c.QueryParam("action"),
+		"AppId":     c.QueryParam("app"),
+		"From":      c.QueryParam("from"),
+		"To":        c.QueryParam("to"),
+		"Query":     c.QueryString(),
+	})
+}
+
+func (svc *Service) AuditExportHandler(c echo.Context) error {
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return c.Redirect(302, "/")
+	}
+	events, err := svc.auditEventsQuery(c, user)
+	if err != nil {
+		return err
+	}
+
+	type AuditEventExport struct {
+		ID        uint            `json:"id"`
+		Action    string          `json:"action"`
+		AppId     *uint           `json:"app_id"`
+		Details   json.RawMessage `json:"details,omitempty"`
+		IP        string          `json:"ip,omitempty"`
+		CreatedAt time.Time       `json:"created_at"`
+	}
+	export := []AuditEventExport{}
+	for _, event := range events {
+		export = append(export, AuditEventExport{
+			ID:        event.ID,
+			Action:    event.Action,
+			AppId:     event.AppId,
+			Details:   json.RawMessage(event.Details),
+			IP:        event.IP,
+			CreatedAt: event.CreatedAt,
+		})
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=audit.json")
+	return c.JSON(http.StatusOK, export)
+}
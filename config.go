@@ -7,26 +7,48 @@ const (
 )
 
 type Config struct {
-	NostrSecretKey          string `envconfig:"NOSTR_PRIVKEY"`
-	CookieSecret            string `envconfig:"COOKIE_SECRET" required:"true"`
-	CookieDomain            string `envconfig:"COOKIE_DOMAIN"`
-	ClientPubkey            string `envconfig:"CLIENT_NOSTR_PUBKEY"`
-	Relay                   string `envconfig:"RELAY" default:"wss://relay.getalby.com/v1"`
-	PublicRelay             string `envconfig:"PUBLIC_RELAY"`
-	LNBackendType           string `envconfig:"LN_BACKEND_TYPE" default:"ALBY"`
-	LNDAddress              string `envconfig:"LND_ADDRESS"`
-	LNDCertFile             string `envconfig:"LND_CERT_FILE"`
-	LNDMacaroonFile         string `envconfig:"LND_MACAROON_FILE"`
-	AlbyAPIURL              string `envconfig:"ALBY_API_URL" default:"https://api.getalby.com"`
-	AlbyClientId            string `envconfig:"ALBY_CLIENT_ID"`
-	AlbyClientSecret        string `envconfig:"ALBY_CLIENT_SECRET"`
-	OAuthRedirectUrl        string `envconfig:"OAUTH_REDIRECT_URL"`
-	OAuthAuthUrl            string `envconfig:"OAUTH_AUTH_URL" default:"https://getalby.com/oauth"`
-	OAuthTokenUrl           string `envconfig:"OAUTH_TOKEN_URL" default:"https://api.getalby.com/oauth/token"`
-	Port                    string `envconfig:"PORT" default:"8080"`
-	DatabaseUri             string `envconfig:"DATABASE_URI" default:"nostr-wallet-connect.db"`
-	DatabaseMaxConns        int    `envconfig:"DATABASE_MAX_CONNS" default:"10"`
-	DatabaseMaxIdleConns    int    `envconfig:"DATABASE_MAX_IDLE_CONNS" default:"5"`
-	DatabaseConnMaxLifetime int    `envconfig:"DATABASE_CONN_MAX_LIFETIME" default:"1800"` // 30 minutes
-	IdentityPubkey          string
+	NostrSecretKey             string `envconfig:"NOSTR_PRIVKEY"`
+	CookieSecret               string `envconfig:"COOKIE_SECRET" required:"true"`
+	CookieSecretPrevious       string `envconfig:"COOKIE_SECRET_PREVIOUS"` // still accepted for existing sessions after rotating COOKIE_SECRET
+	CookieDomain               string `envconfig:"COOKIE_DOMAIN"`
+	SessionTimeout             int    `envconfig:"SESSION_TIMEOUT" default:"86400"` // seconds
+	TrustedProxies             string `envconfig:"TRUSTED_PROXIES"`                 // reverse proxies whose X-Forwarded-For header is trusted
+	NostrSignerUri             string `envconfig:"NOSTR_SIGNER_URI"`                // bunker:// URI of a NIP-46 remote signer holding the service key
+	NostrSignerClientKey       string `envconfig:"NOSTR_SIGNER_CLIENT_PRIVKEY"`     // key authorized at the remote signer
+	ClientPubkey               string `envconfig:"CLIENT_NOSTR_PUBKEY"`
+	PerAppServiceKeys          bool   `envconfig:"PER_APP_SERVICE_KEYS"`                       // pair new apps with a service key derived from the identity key
+	KeyRotationGracePeriod     int    `envconfig:"KEY_ROTATION_GRACE_PERIOD" default:"604800"` // seconds the previous key is still answered after a rotation
+	Relay                      string `envconfig:"RELAY" default:"wss://relay.getalby.com/v1"`
+	PublicRelay                string `envconfig:"PUBLIC_RELAY"`
+	LNBackendType              string `envconfig:"LN_BACKEND_TYPE" default:"ALBY"`
+	LNDAddress                 string `envconfig:"LND_ADDRESS"`
+	LNDCertFile                string `envconfig:"LND_CERT_FILE"`
+	LNDMacaroonFile            string `envconfig:"LND_MACAROON_FILE"`
+	LNDCertHex                 string `envconfig:"LND_CERT_HEX"` // hex of tls.cert, for deployments that can't mount files
+	LNDMacaroonHex             string `envconfig:"LND_MACAROON_HEX"`
+	LNDConnectUri              string `envconfig:"LND_CONNECT_URI"` // lndconnect:// URI with address, cert and macaroon
+	AlbyAPIURL                 string `envconfig:"ALBY_API_URL" default:"https://api.getalby.com"`
+	AlbyClientId               string `envconfig:"ALBY_CLIENT_ID"`
+	AlbyClientSecret           string `envconfig:"ALBY_CLIENT_SECRET"`
+	OAuthRedirectUrl           string `envconfig:"OAUTH_REDIRECT_URL"`
+	OAuthAuthUrl               string `envconfig:"OAUTH_AUTH_URL" default:"https://getalby.com/oauth"`
+	OAuthTokenUrl              string `envconfig:"OAUTH_TOKEN_URL" default:"https://api.getalby.com/oauth/token"`
+	Port                       string `envconfig:"PORT" default:"8080"`
+	DatabaseUri                string `envconfig:"DATABASE_URI" default:"nostr-wallet-connect.db"`
+	DatabaseMaxConns           int    `envconfig:"DATABASE_MAX_CONNS" default:"10"`
+	DatabaseMaxIdleConns       int    `envconfig:"DATABASE_MAX_IDLE_CONNS" default:"5"`
+	DatabaseConnMaxLifetime    int    `envconfig:"DATABASE_CONN_MAX_LIFETIME" default:"1800"` // 30 minutes
+	RateLimitAppRequests       int    `envconfig:"RATE_LIMIT_APP_REQUESTS" default:"60"`      // per minute, 0 disables
+	RateLimitAppBurst          int    `envconfig:"RATE_LIMIT_APP_BURST" default:"20"`
+	RateLimitMethodRequests    string `envconfig:"RATE_LIMIT_METHOD_REQUESTS"`               // e.g. get_balance:10,pay_invoice:5
+	RateLimitUnknownRequests   int    `envconfig:"RATE_LIMIT_UNKNOWN_REQUESTS" default:"60"` // per minute, 0 disables
+	PaymentApprovalTimeout     int    `envconfig:"PAYMENT_APPROVAL_TIMEOUT" default:"300"`   // seconds
+	LNURLBaseUrl               string `envconfig:"LNURL_BASE_URL"`                           // e.g. https://nwc.example.com
+	LNURLUsername              string `envconfig:"LNURL_USERNAME"`
+	FiatRatesUrl               string `envconfig:"FIAT_RATES_URL" default:"https://getalby.com/api/rates/%s.json"`
+	FiatRatesFile              string `envconfig:"FIAT_RATES_FILE"` // JSON file with static rates, e.g. for offline testing
+	EncryptionKey              string `envconfig:"ENCRYPTION_KEY"`  // hex encoded 32 byte master key for secrets at rest
+	EncryptionKeyFile          string `envconfig:"ENCRYPTION_KEY_FILE"`
+	EncryptionPassphrasePrompt bool   `envconfig:"ENCRYPTION_PASSPHRASE_PROMPT"` // derive the master key from a passphrase entered at startup
+	IdentityPubkey             string
 }
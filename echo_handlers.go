@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/hex"
 	"errors"
@@ -15,11 +16,11 @@ import (
 	"time"
 
 	echologrus "github.com/davrux/echo-logrus/v4"
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
 	"github.com/sirupsen/logrus"
 	ddEcho "gopkg.in/DataDog/dd-trace-go.v1/contrib/labstack/echo.v4"
 	"gorm.io/gorm"
@@ -42,6 +43,10 @@ func (t *TemplateRegistry) Render(w io.Writer, name string, data interface{}, c
 		err := errors.New("Template not found -> " + name)
 		return err
 	}
+	// inline scripts and styles are only allowed with the nonce of the content security policy
+	if values, ok := data.(map[string]interface{}); ok {
+		values["CspNonce"] = c.Get(CSP_NONCE_KEY)
+	}
 	return tmpl.ExecuteTemplate(w, "layout.html", data)
 }
 
@@ -52,10 +57,15 @@ func (svc *Service) RegisterSharedRoutes(e *echo.Echo) {
 	templates["apps/new.html"] = template.Must(template.ParseFS(embeddedViews, "views/apps/new.html", "views/layout.html"))
 	templates["apps/show.html"] = template.Must(template.ParseFS(embeddedViews, "views/apps/show.html", "views/layout.html"))
 	templates["apps/create.html"] = template.Must(template.ParseFS(embeddedViews, "views/apps/create.html", "views/layout.html"))
+	templates["approvals/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/approvals/index.html", "views/layout.html"))
+	templates["audit/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/audit/index.html", "views/layout.html"))
 	templates["alby/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/alby/index.html", "views/layout.html"))
 	templates["about.html"] = template.Must(template.ParseFS(embeddedViews, "views/about.html", "views/layout.html"))
 	templates["404.html"] = template.Must(template.ParseFS(embeddedViews, "views/404.html", "views/layout.html"))
 	templates["lnd/index.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/lnd/index.html", "views/layout.html"))
+	templates["lnd/login.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/lnd/login.html", "views/layout.html"))
+	templates["lnd/setup.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/lnd/setup.html", "views/layout.html"))
+	templates["lnd/totp.html"] = template.Must(template.ParseFS(embeddedViews, "views/backends/lnd/totp.html", "views/layout.html"))
 	e.Renderer = &TemplateRegistry{
 		templates: templates,
 	}
@@ -64,20 +74,39 @@ func (svc *Service) RegisterSharedRoutes(e *echo.Echo) {
 
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestID())
+	e.Use(middleware.SecureWithConfig(middleware.SecureConfig{
+		ContentTypeNosniff:    "nosniff",
+		XFrameOptions:         "DENY",
+		HSTSMaxAge:            HSTS_MAX_AGE,
+		HSTSExcludeSubdomains: true,
+		ReferrerPolicy:        "same-origin",
+	}))
+	e.Use(contentSecurityPolicy)
+	e.Use(secureCookies)
 	e.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
-		TokenLookup: "form:_csrf",
+		TokenLookup:    "form:_csrf",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteLaxMode,
 	}))
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte(svc.cfg.CookieSecret))))
+	e.Use(session.Middleware(newSessionStore(svc.cfg)))
 	e.Use(ddEcho.Middleware(ddEcho.WithServiceName("nostr-wallet-connect")))
 
 	assetSubdir, _ := fs.Sub(embeddedAssets, "public")
 	assetHandler := http.FileServer(http.FS(assetSubdir))
 	e.GET("/public/*", echo.WrapHandler(http.StripPrefix("/public/", assetHandler)))
-	e.GET("/apps", svc.AppsListHandler)
-	e.GET("/apps/new", svc.AppsNewHandler)
-	e.GET("/apps/:pubkey", svc.AppsShowHandler)
-	e.POST("/apps", svc.AppsCreateHandler)
-	e.POST("/apps/delete/:pubkey", svc.AppsDeleteHandler)
+	e.GET("/apps", svc.AppsListHandler, svc.requireUser)
+	e.GET("/apps/new", svc.AppsNewHandler, svc.requireUser)
+	e.GET("/apps/:pubkey", svc.AppsShowHandler, svc.requireUser)
+	e.POST("/apps", svc.AppsCreateHandler, svc.requireUser, noStore)
+	e.POST("/apps/delete/:pubkey", svc.AppsDeleteHandler, svc.requireUser)
+	e.POST("/apps/rotate/:pubkey", svc.AppsRotateSecretHandler, svc.requireUser, noStore)
+	e.POST("/budget", svc.BudgetUpdateHandler, svc.requireUser)
+	e.POST("/identity/rotate", svc.IdentityRotateHandler, svc.requireUser)
+	e.GET("/approvals", svc.ApprovalsListHandler, svc.requireUser)
+	e.GET("/audit", svc.AuditListHandler, svc.requireUser)
+	e.GET("/audit.json", svc.AuditExportHandler, svc.requireUser)
+	e.POST("/approvals/:id/approve", svc.ApprovalsApproveHandler, svc.requireUser)
+	e.POST("/approvals/:id/reject", svc.ApprovalsRejectHandler, svc.requireUser)
 	e.GET("/logout", svc.LogoutHandler)
 	e.GET("/about", svc.AboutHandler)
 	e.GET("/", svc.IndexHandler)
@@ -93,10 +122,6 @@ func (svc *Service) IndexHandler(c echo.Context) error {
 	if user != nil && returnTo != nil {
 		delete(sess.Values, "return_to")
 		sess.Options.MaxAge = 0
-		sess.Options.SameSite = http.SameSiteLaxMode
-		if svc.cfg.CookieDomain != "" {
-			sess.Options.Domain = svc.cfg.CookieDomain
-		}
 		sess.Save(c.Request(), c.Response())
 		return c.Redirect(302, fmt.Sprintf("%s", returnTo))
 	}
@@ -117,6 +142,7 @@ func (svc *Service) AboutHandler(c echo.Context) error {
 }
 
 func (svc *Service) AppsListHandler(c echo.Context) error {
+	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
 	user, err := svc.GetUser(c)
 	if err != nil {
 		return err
@@ -138,12 +164,89 @@ func (svc *Service) AppsListHandler(c echo.Context) error {
 		eventsCounts[app.ID] = eventsCount
 	}
 
+	renewsIn := ""
+	budgetUsage := int64(0)
+	if user.MaxAmount > 0 {
+		budgetUsage = svc.GetUserBudgetUsage(user)
+		renewsIn = getEndOfBudgetString(GetEndOfBudget(user.BudgetRenewal, user.CreatedAt))
+	}
+
+	rotations := []Identity{}
+	if svc.identityStored {
+		svc.db.Where("retired_at IS NOT NULL").Order("retired_at desc").Limit(10).Find(&rotations)
+	}
+
 	return c.Render(http.StatusOK, "apps/index.html", map[string]interface{}{
-		"Apps":         apps,
-		"User":         user,
-		"LastEvents":   lastEvents,
-		"EventsCounts": eventsCounts,
+		"Apps":           apps,
+		"User":           user,
+		"LastEvents":     lastEvents,
+		"EventsCounts":   eventsCounts,
+		"BudgetUsage":    budgetUsage,
+		"RenewsIn":       renewsIn,
+		"BudgetRenewals": []string{"daily", "weekly", "monthly", "yearly", "never"},
+		"Csrf":           csrf,
+		"ServicePubkey":  svc.activeIdentity().pubkey,
+		"CanRotate":      svc.identityStored,
+		"Rotations":      rotations,
+	})
+}
+
+func (svc *Service) IdentityRotateHandler(c echo.Context) error {
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return c.Redirect(302, "/")
+	}
+	previousPubkey := svc.activeIdentity().pubkey
+	_, err = svc.RotateIdentity(c.Request().Context())
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to rotate the service key")
+		return err
+	}
+	svc.auditRequest(c, user.ID, 0, AUDIT_SERVICE_KEY_ROTATED, map[string]interface{}{
+		"previous_pubkey": previousPubkey,
+		"pubkey":          svc.activeIdentity().pubkey,
 	})
+	return c.Redirect(302, "/apps")
+}
+
+func (svc *Service) BudgetUpdateHandler(c echo.Context) error {
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return c.Redirect(302, "/")
+	}
+
+	maxAmount, err := strconv.Atoi(c.FormValue("MaxAmount"))
+	if err != nil || maxAmount < 0 {
+		maxAmount = 0
+	}
+	budgetRenewal := c.FormValue("BudgetRenewal")
+	switch budgetRenewal {
+	case "daily", "weekly", "monthly", "yearly", "never":
+	default:
+		budgetRenewal = "monthly"
+	}
+
+	err = svc.db.Model(user).Updates(map[string]interface{}{
+		"max_amount":     maxAmount,
+		"budget_renewal": budgetRenewal,
+	}).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"userId": user.ID,
+		}).Errorf("Failed to update account budget: %v", err)
+		return c.Redirect(302, "/apps")
+	}
+	svc.auditRequest(c, user.ID, 0, AUDIT_BUDGET_UPDATED, map[string]interface{}{
+		"max_amount":     maxAmount,
+		"budget_renewal": budgetRenewal,
+	})
+	return c.Redirect(302, "/apps")
 }
 
 func (svc *Service) AppsShowHandler(c echo.Context) error {
@@ -171,6 +274,7 @@ func (svc *Service) AppsShowHandler(c echo.Context) error {
 	svc.db.Model(&NostrEvent{}).Where("app_id = ?", app.ID).Count(&eventsCount)
 
 	paySpecificPermission := AppPermission{}
+	onchainPermission := AppPermission{}
 	appPermissions := []AppPermission{}
 	expiresAt := time.Time{}
 	svc.db.Where("app_id = ?", app.ID).Find(&appPermissions)
@@ -184,6 +288,9 @@ func (svc *Service) AppsShowHandler(c echo.Context) error {
 			//find the pay_invoice-specific permissions
 			paySpecificPermission = appPerm
 		}
+		if appPerm.RequestMethod == NIP_47_PAY_ONCHAIN_METHOD {
+			onchainPermission = appPerm
+		}
 		requestMethods = append(requestMethods, nip47MethodDescriptions[appPerm.RequestMethod])
 	}
 
@@ -191,15 +298,38 @@ func (svc *Service) AppsShowHandler(c echo.Context) error {
 
 	renewsIn := ""
 	budgetUsage := int64(0)
+	fiatBudgetUsage := ""
 	maxAmount := paySpecificPermission.MaxAmount
 	if maxAmount > 0 {
 		budgetUsage = svc.GetBudgetUsage(&paySpecificPermission)
+		if paySpecificPermission.BudgetCurrency != "" {
+			fiatBudgetUsage = fmt.Sprintf("%.2f", float64(svc.GetFiatBudgetUsage(&paySpecificPermission))/100)
+		}
 		endOfBudget := GetEndOfBudget(paySpecificPermission.BudgetRenewal, app.CreatedAt)
 		renewsIn = getEndOfBudgetString(endOfBudget)
 	}
+	onchainBudgetUsage := int64(0)
+	if onchainPermission.MaxAmount > 0 {
+		onchainPermission.App = app
+		onchainBudgetUsage = svc.GetOnchainBudgetUsage(&onchainPermission)
+	}
+
+	_, walletPubkey, err := svc.appServiceKey(&app)
+	if err != nil {
+		return err
+	}
+	rotatedAt := time.Time{}
+	lastRotation := Identity{}
+	svc.db.Where("retired_at IS NOT NULL").Order("retired_at desc").Limit(1).Find(&lastRotation)
+	if lastRotation.RetiredAt != nil && lastRotation.RetiredAt.After(app.CreatedAt) {
+		rotatedAt = *lastRotation.RetiredAt
+	}
 
 	return c.Render(http.StatusOK, "apps/show.html", map[string]interface{}{
 		"App":                   app,
+		"WalletPubkey":          walletPubkey,
+		"ConnectionUri":         fmt.Sprintf("nostr+walletconnect://%s?relay=%s", walletPubkey, svc.publicRelayUrl()),
+		"RotatedAt":             rotatedAt,
 		"PaySpecificPermission": paySpecificPermission,
 		"RequestMethods":        requestMethods,
 		"ExpiresAt":             expiresAt,
@@ -208,7 +338,10 @@ func (svc *Service) AppsShowHandler(c echo.Context) error {
 		"LastEvent":             lastEvent,
 		"EventsCount":           eventsCount,
 		"BudgetUsage":           budgetUsage,
+		"FiatBudgetUsage":       fiatBudgetUsage,
 		"RenewsIn":              renewsIn,
+		"OnchainPermission":     onchainPermission,
+		"OnchainBudgetUsage":    onchainBudgetUsage,
 		"Csrf":                  csrf,
 	})
 }
@@ -249,6 +382,12 @@ func (svc *Service) AppsNewHandler(c echo.Context) error {
 	returnTo := c.QueryParam("return_to")
 	maxAmount := c.QueryParam("max_amount")
 	budgetRenewal := strings.ToLower(c.QueryParam("budget_renewal"))
+	// fiat budgets can only be requested together with the amount in whole units of the currency
+	budgetCurrency := strings.ToUpper(c.QueryParam("budget_currency"))
+	if maxAmount == "" || !isValidCurrency(budgetCurrency) {
+		budgetCurrency = ""
+	}
+	approvalThreshold := c.QueryParam("approval_threshold")
 	expiresAt := c.QueryParam("expires_at") // YYYY-MM-DD or MM/DD/YYYY or timestamp in seconds
 	if expiresAtTimestamp, err := strconv.Atoi(expiresAt); err == nil {
 		expiresAt = time.Unix(int64(expiresAtTimestamp), 0).Format(time.RFC3339)
@@ -259,10 +398,12 @@ func (svc *Service) AppsNewHandler(c echo.Context) error {
 	requestMethods := c.QueryParam("request_methods")
 	customRequestMethods := requestMethods
 	if requestMethods == "" {
-		// if no request methods are given, enable them all by default
+		// if no request methods are given, enable them all by default except the opt-in on-chain payments
 		keys := []string{}
 		for key := range nip47MethodDescriptions {
-			keys = append(keys, key)
+			if key != NIP_47_PAY_ONCHAIN_METHOD {
+				keys = append(keys, key)
+			}
 		}
 
 		requestMethods = strings.Join(keys, " ")
@@ -273,17 +414,6 @@ func (svc *Service) AppsNewHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	if user == nil {
-		sess, _ := session.Get(CookieName, c)
-		sess.Values["return_to"] = c.Path() + "?" + c.QueryString()
-		sess.Options.MaxAge = 0
-		sess.Options.SameSite = http.SameSiteLaxMode
-		if svc.cfg.CookieDomain != "" {
-			sess.Options.Domain = svc.cfg.CookieDomain
-		}
-		sess.Save(c.Request(), c.Response())
-		return c.Redirect(302, fmt.Sprintf("/%s/auth?c=%s", strings.ToLower(svc.cfg.LNBackendType), appName))
-	}
 
 	//construction to return a map with all possible permissions
 	//and indicate which ones are checked by default in the front-end
@@ -293,19 +423,27 @@ func (svc *Service) AppsNewHandler(c echo.Context) error {
 		Checked     bool
 	}
 
+	// methods the wallet backend can't serve for the user are not offered
+	capabilities := svc.userCapabilities(c.Request().Context(), user.ID)
 	requestMethodHelper := map[string]*RequestMethodHelper{}
 	for k, v := range nip47MethodDescriptions {
+		if !containsMethod(capabilities, k) {
+			continue
+		}
 		requestMethodHelper[k] = &RequestMethodHelper{
 			Description: v,
 			Icon:        nip47MethodIcons[k],
 		}
 	}
 
+	supportedRequestMethods := []string{}
 	for _, m := range strings.Split(requestMethods, " ") {
-		if _, ok := nip47MethodDescriptions[m]; ok {
-			requestMethodHelper[m].Checked = true
+		if helper, ok := requestMethodHelper[m]; ok {
+			helper.Checked = true
+			supportedRequestMethods = append(supportedRequestMethods, m)
 		}
 	}
+	requestMethods = strings.Join(supportedRequestMethods, " ")
 
 	return c.Render(http.StatusOK, "apps/new.html", map[string]interface{}{
 		"User":                 user,
@@ -314,6 +452,8 @@ func (svc *Service) AppsNewHandler(c echo.Context) error {
 		"ReturnTo":             returnTo,
 		"MaxAmount":            maxAmount,
 		"BudgetRenewal":        budgetRenewal,
+		"BudgetCurrency":       budgetCurrency,
+		"ApprovalThreshold":    approvalThreshold,
 		"ExpiresAt":            expiresAt,
 		"ExpiresAtFormatted":   expiresAtFormatted,
 		"RequestMethods":       requestMethods,
@@ -348,8 +488,26 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 		}
 	}
 	app := App{Name: name, NostrPubkey: pairingPublicKey}
+	if svc.cfg.PerAppServiceKeys {
+		_, app.WalletPubkey, err = deriveAppServiceKey(svc.activeIdentity().secretKey, pairingPublicKey)
+		if err != nil {
+			return err
+		}
+	}
 	maxAmount, _ := strconv.Atoi(c.FormValue("MaxAmount"))
 	budgetRenewal := c.FormValue("BudgetRenewal")
+	budgetCurrency := strings.ToUpper(c.FormValue("BudgetCurrency"))
+	if budgetCurrency != "" {
+		if !isValidCurrency(budgetCurrency) {
+			return fmt.Errorf("Invalid BudgetCurrency: %s", budgetCurrency)
+		}
+		_, err = svc.getFiatRate(c.Request().Context(), budgetCurrency)
+		if err != nil {
+			return fmt.Errorf("Fiat budgets in %s are not supported: %v", budgetCurrency, err)
+		}
+	}
+	approvalThreshold, _ := strconv.Atoi(c.FormValue("ApprovalThreshold"))
+	onchainMaxAmount, _ := strconv.Atoi(c.FormValue("OnchainMaxAmount"))
 
 	expiresAt := time.Time{}
 	if c.FormValue("ExpiresAt") != "" {
@@ -385,8 +543,17 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 				RequestMethod: m,
 				ExpiresAt:     expiresAt,
 				//these fields are only relevant for pay_invoice
-				MaxAmount:     maxAmount,
-				BudgetRenewal: budgetRenewal,
+				MaxAmount:         maxAmount,
+				BudgetRenewal:     budgetRenewal,
+				ApprovalThreshold: approvalThreshold,
+			}
+			if m == NIP_47_PAY_INVOICE_METHOD {
+				appPermission.BudgetCurrency = budgetCurrency
+			}
+			if m == NIP_47_PAY_ONCHAIN_METHOD {
+				// on-chain payments have their own budget
+				appPermission.MaxAmount = onchainMaxAmount
+				appPermission.ApprovalThreshold = 0
 			}
 			err = tx.Create(&appPermission).Error
 			if err != nil {
@@ -404,18 +571,41 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 		}).Errorf("Failed to save app: %v", err)
 		return c.Redirect(302, "/apps")
 	}
+	svc.auditRequest(c, user.ID, app.ID, AUDIT_APP_CREATED, map[string]interface{}{
+		"app":                app.Name,
+		"request_methods":    c.FormValue("RequestMethods"),
+		"max_amount":         maxAmount,
+		"budget_renewal":     budgetRenewal,
+		"budget_currency":    budgetCurrency,
+		"approval_threshold": approvalThreshold,
+		"expires_at":         c.FormValue("ExpiresAt"),
+	})
 
-	publicRelayUrl := svc.cfg.PublicRelay
-	if publicRelayUrl == "" {
-		publicRelayUrl = svc.cfg.Relay
+	_, walletPubkey, err := svc.appServiceKey(&app)
+	if err != nil {
+		return err
+	}
+	if app.WalletPubkey != "" {
+		// listen to and announce the new key
+		svc.UpdateSubscription(c.Request().Context())
+		if relay := svc.relay.Load(); relay != nil {
+			go func() {
+				err := svc.PublishAppNip47Info(context.Background(), relay, &app)
+				if err != nil {
+					svc.Logger.WithField("appId", app.ID).WithError(err).Error("Could not publish NIP47 info")
+				}
+			}()
+		}
 	}
 
+	publicRelayUrl := svc.publicRelayUrl()
+
 	if c.FormValue("returnTo") != "" {
 		returnToUrl, err := url.Parse(c.FormValue("returnTo"))
 		if err == nil {
 			query := returnToUrl.Query()
 			query.Add("relay", publicRelayUrl)
-			query.Add("pubkey", svc.cfg.IdentityPubkey)
+			query.Add("pubkey", walletPubkey)
 			if user.LightningAddress != "" {
 				query.Add("lud16", user.LightningAddress)
 			}
@@ -428,7 +618,7 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 	if user.LightningAddress != "" {
 		lud16 = fmt.Sprintf("&lud16=%s", user.LightningAddress)
 	}
-	pairingUri := template.URL(fmt.Sprintf("nostr+walletconnect://%s?relay=%s&secret=%s%s", svc.cfg.IdentityPubkey, publicRelayUrl, pairingSecretKey, lud16))
+	pairingUri := template.URL(fmt.Sprintf("nostr+walletconnect://%s?relay=%s&secret=%s%s", walletPubkey, publicRelayUrl, pairingSecretKey, lud16))
 	return c.Render(http.StatusOK, "apps/create.html", map[string]interface{}{
 		"User":          user,
 		"PairingUri":    pairingUri,
@@ -438,6 +628,14 @@ func (svc *Service) AppsCreateHandler(c echo.Context) error {
 	})
 }
 
+// publicRelayUrl is the relay included in connection strings
+func (svc *Service) publicRelayUrl() string {
+	if svc.cfg.PublicRelay != "" {
+		return svc.cfg.PublicRelay
+	}
+	return svc.cfg.Relay
+}
+
 func (svc *Service) AppsDeleteHandler(c echo.Context) error {
 	user, err := svc.GetUser(c)
 	if err != nil {
@@ -447,17 +645,231 @@ func (svc *Service) AppsDeleteHandler(c echo.Context) error {
 		return c.Redirect(302, "/")
 	}
 	app := App{}
-	svc.db.Where("user_id = ? AND nostr_pubkey = ?", user.ID, c.Param("pubkey")).First(&app)
+	err = svc.db.Where("user_id = ? AND nostr_pubkey = ?", user.ID, c.Param("pubkey")).First(&app).Error
+	if err != nil {
+		return c.Redirect(302, "/apps")
+	}
 	svc.db.Delete(&app)
+	svc.rateLimiter.Forget(app.ID)
+	svc.auditRequest(c, user.ID, app.ID, AUDIT_APP_DELETED, map[string]interface{}{"app": app.Name})
+	if app.WalletPubkey != "" {
+		svc.UpdateSubscription(c.Request().Context())
+	}
 	return c.Redirect(302, "/apps")
 }
 
+// AppsRotateSecretHandler replaces the pairing secret of an app, e.g. after it leaked.
+// Budgets, permissions and payments stay attached to the app, requests signed with the previous secret are rejected right away.
+func (svc *Service) AppsRotateSecretHandler(c echo.Context) error {
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return c.Redirect(302, "/")
+	}
+	app := App{}
+	err = svc.db.Where("user_id = ? AND nostr_pubkey = ?", user.ID, c.Param("pubkey")).First(&app).Error
+	if err != nil {
+		return c.Redirect(302, "/apps")
+	}
+
+	previousPubkey := app.NostrPubkey
+	pairingSecretKey := nostr.GeneratePrivateKey()
+	pairingPublicKey, err := nostr.GetPublicKey(pairingSecretKey)
+	if err != nil {
+		return err
+	}
+	updates := map[string]interface{}{"nostr_pubkey": pairingPublicKey}
+	if app.WalletPubkey != "" {
+		// the app's own service key is derived from its pubkey
+		_, app.WalletPubkey, err = deriveAppServiceKey(svc.activeIdentity().secretKey, pairingPublicKey)
+		if err != nil {
+			return err
+		}
+		updates["wallet_pubkey"] = app.WalletPubkey
+	}
+	// only the first of concurrent rotations wins
+	result := svc.db.Model(&App{}).Where("id = ? AND nostr_pubkey = ?", app.ID, previousPubkey).UpdateColumns(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return c.Redirect(302, "/apps")
+	}
+	app.NostrPubkey = pairingPublicKey
+	svc.Logger.WithFields(logrus.Fields{
+		"appId":          app.ID,
+		"previousPubkey": previousPubkey,
+		"pubkey":         pairingPublicKey,
+	}).Info("Rotated the pairing secret of an app")
+	svc.auditRequest(c, user.ID, app.ID, AUDIT_APP_SECRET_ROTATED, map[string]interface{}{
+		"app":             app.Name,
+		"previous_pubkey": previousPubkey,
+		"pubkey":          pairingPublicKey,
+	})
+
+	_, walletPubkey, err := svc.appServiceKey(&app)
+	if err != nil {
+		return err
+	}
+	if app.WalletPubkey != "" {
+		svc.UpdateSubscription(c.Request().Context())
+		if relay := svc.relay.Load(); relay != nil {
+			go func() {
+				err := svc.PublishAppNip47Info(context.Background(), relay, &app)
+				if err != nil {
+					svc.Logger.WithField("appId", app.ID).WithError(err).Error("Could not publish NIP47 info")
+				}
+			}()
+		}
+	}
+
+	var lud16 string
+	if user.LightningAddress != "" {
+		lud16 = fmt.Sprintf("&lud16=%s", user.LightningAddress)
+	}
+	pairingUri := template.URL(fmt.Sprintf("nostr+walletconnect://%s?relay=%s&secret=%s%s", walletPubkey, svc.publicRelayUrl(), pairingSecretKey, lud16))
+	return c.Render(http.StatusOK, "apps/create.html", map[string]interface{}{
+		"User":          user,
+		"PairingUri":    pairingUri,
+		"PairingSecret": pairingSecretKey,
+		"Pubkey":        pairingPublicKey,
+		"Name":          app.Name,
+		"Rotated":       true,
+	})
+}
+
+func (svc *Service) ApprovalsListHandler(c echo.Context) error {
+	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return c.Redirect(302, "/")
+	}
+
+	approvals := []PaymentApproval{}
+	svc.db.Joins("App").Where("App.user_id = ? AND payment_approvals.state = ?", user.ID, PAYMENT_APPROVAL_STATE_PENDING).Order("payment_approvals.id desc").Find(&approvals)
+
+	type PaymentApprovalHelper struct {
+		PaymentApproval
+		Description string
+		PaymentHash string
+		ExpiresIn   string
+	}
+
+	approvalHelpers := []PaymentApprovalHelper{}
+	for _, approval := range approvals {
+		helper := PaymentApprovalHelper{
+			PaymentApproval: approval,
+			ExpiresIn:       getEndOfBudgetString(approval.ExpiresAt),
+		}
+		if approval.PaymentRequest != "" {
+			paymentRequest, err := decodepay.Decodepay(approval.PaymentRequest)
+			if err == nil {
+				helper.Description = paymentRequest.Description
+				helper.PaymentHash = paymentRequest.PaymentHash
+				if paymentRequest.DescriptionHash != "" && helper.Description == "" {
+					helper.Description = fmt.Sprintf("Description hash: %s", paymentRequest.DescriptionHash)
+				}
+			}
+		}
+		approvalHelpers = append(approvalHelpers, helper)
+	}
+
+	return c.Render(http.StatusOK, "approvals/index.html", map[string]interface{}{
+		"User":      user,
+		"Approvals": approvalHelpers,
+		"Csrf":      csrf,
+	})
+}
+
+func (svc *Service) ApprovalsApproveHandler(c echo.Context) error {
+	return svc.decidePaymentApproval(c, true)
+}
+
+func (svc *Service) ApprovalsRejectHandler(c echo.Context) error {
+	return svc.decidePaymentApproval(c, false)
+}
+
+func (svc *Service) decidePaymentApproval(c echo.Context, approve bool) error {
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return c.Redirect(302, "/")
+	}
+	approvalId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.Redirect(302, "/approvals")
+	}
+	err = svc.DecidePaymentApproval(user, uint(approvalId), approve)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"approvalId": approvalId,
+			"approve":    approve,
+			"userId":     user.ID,
+		}).Errorf("Failed to decide payment approval: %v", err)
+		return c.Redirect(302, "/approvals")
+	}
+	approval := PaymentApproval{}
+	svc.db.Preload("App").First(&approval, approvalId)
+	action := AUDIT_PAYMENT_REJECTED
+	if approve {
+		action = AUDIT_PAYMENT_APPROVED
+	}
+	svc.auditRequest(c, user.ID, approval.AppId, action, map[string]interface{}{
+		"app":         approval.App.Name,
+		"approval_id": approval.ID,
+		"amount":      approval.Amount,
+	})
+	return c.Redirect(302, "/approvals")
+}
+
+// requireUser sends visitors without a valid session to the login and back to the requested page afterwards
+func (svc *Service) requireUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := svc.GetUser(c)
+		if err != nil {
+			return err
+		}
+		if user != nil {
+			return next(c)
+		}
+		if c.Request().Method != http.MethodGet {
+			return c.Redirect(302, "/")
+		}
+		appName := c.QueryParam("name")
+		if appName == "" {
+			appName = c.QueryParam("c")
+		}
+		sess, _ := session.Get(CookieName, c)
+		sess.Values["return_to"] = c.Request().URL.RequestURI()
+		sess.Options.MaxAge = 0
+		sess.Save(c.Request(), c.Response())
+		return c.Redirect(302, fmt.Sprintf("/%s/auth?c=%s", strings.ToLower(svc.cfg.LNBackendType), url.QueryEscape(appName)))
+	}
+}
+
+// setSessionUser logs the user in until the session timeout
+func setSessionUser(c echo.Context, cfg *Config, userID uint) {
+	sess, _ := session.Get(CookieName, c)
+	sess.Values["user_id"] = userID
+	sess.Values["expires_at"] = time.Now().Add(time.Duration(cfg.SessionTimeout) * time.Second).Unix()
+	sess.Options.MaxAge = cfg.SessionTimeout
+	sess.Save(c.Request(), c.Response())
+}
+
 func (svc *Service) LogoutHandler(c echo.Context) error {
+	user, err := svc.GetUser(c)
+	if err == nil && user != nil {
+		svc.auditRequest(c, user.ID, 0, AUDIT_LOGOUT, nil)
+	}
 	sess, _ := session.Get(CookieName, c)
 	sess.Options.MaxAge = -1
-	if svc.cfg.CookieDomain != "" {
-		sess.Options.Domain = svc.cfg.CookieDomain
-	}
 	sess.Save(c.Request(), c.Response())
 	return c.Redirect(302, "/")
 }
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/sirupsen/logrus"
@@ -12,7 +14,7 @@ const (
 	MSAT_PER_SAT = 1000
 )
 
-func (svc *Service) HandleGetBalanceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+func (svc *Service) HandleGetBalanceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
 
 	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
 	err = svc.db.Create(&nostrEvent).Error
@@ -39,7 +41,20 @@ func (svc *Service) HandleGetBalanceEvent(ctx context.Context, request *Nip47Req
 			Error: &Nip47Error{
 				Code:    code,
 				Message: message,
-			}}, ss)
+			}}, signer)
+	}
+
+	balanceParams := &Nip47BalanceParams{}
+	if len(request.Params) > 0 {
+		err = json.Unmarshal(request.Params, balanceParams)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":   event.ID,
+				"eventKind": event.Kind,
+				"appId":     app.ID,
+			}).Errorf("Failed to decode nostr event: %v", err)
+			return nil, err
+		}
 	}
 
 	svc.Logger.WithFields(logrus.Fields{
@@ -63,7 +78,7 @@ func (svc *Service) HandleGetBalanceEvent(ctx context.Context, request *Nip47Req
 				Code:    NIP_47_ERROR_INTERNAL,
 				Message: fmt.Sprintf("Something went wrong while fetching balance: %s", err.Error()),
 			},
-		}, ss)
+		}, signer)
 	}
 
 	responsePayload := &Nip47BalanceResponse{
@@ -74,16 +89,39 @@ func (svc *Service) HandleGetBalanceEvent(ctx context.Context, request *Nip47Req
 	svc.db.Where("app_id = ? AND request_method = ?", app.ID, NIP_47_PAY_INVOICE_METHOD).First(&appPermission)
 
 	maxAmount := appPermission.MaxAmount
-	if maxAmount > 0 {
+	if maxAmount > 0 && appPermission.BudgetCurrency == "" {
 		responsePayload.MaxAmount = maxAmount * MSAT_PER_SAT
 		responsePayload.BudgetRenewal = appPermission.BudgetRenewal
 	}
 
+	// the fiat balance is optional, the balance is returned without it if no rate is available
+	currency := strings.ToUpper(balanceParams.Currency)
+	if currency == "" {
+		currency = appPermission.BudgetCurrency
+	}
+	if isValidCurrency(currency) {
+		rate, err := svc.getFiatRate(ctx, currency)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":  event.ID,
+				"appId":    app.ID,
+				"currency": currency,
+			}).Infof("Failed to fetch rate for balance: %v", err)
+		} else {
+			responsePayload.FiatBalance = fiatCentsToUnits(msatToFiatCents(responsePayload.Balance, rate))
+			responsePayload.FiatCurrency = currency
+			if maxAmount > 0 && appPermission.BudgetCurrency == currency {
+				responsePayload.MaxAmount = int(fiatCentsToMsat(int64(maxAmount)*100, rate))
+				responsePayload.BudgetRenewal = appPermission.BudgetRenewal
+			}
+		}
+	}
+
 	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
 	svc.db.Save(&nostrEvent)
 	return svc.createResponse(event, Nip47Response{
 		ResultType: NIP_47_GET_BALANCE_METHOD,
 		Result:     responsePayload,
 	},
-		ss)
+		signer)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleCancelHoldInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	cancelParams := &Nip47CancelHoldInvoiceParams{}
+	err = json.Unmarshal(request.Params, cancelParams)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to decode nostr event: %v", err)
+		return nil, err
+	}
+
+	// apps can only cancel their own hold invoices
+	holdInvoice := HoldInvoice{}
+	findResult := svc.db.Where("app_id = ? AND payment_hash = ?", app.ID, cancelParams.PaymentHash).Limit(1).Find(&holdInvoice)
+	if findResult.RowsAffected == 0 {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error:      svc.holdInvoiceNotFoundError(ctx, event.PubKey, cancelParams.PaymentHash),
+		}, signer)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":     event.ID,
+		"eventKind":   event.Kind,
+		"appId":       app.ID,
+		"paymentHash": holdInvoice.PaymentHash,
+	}).Info("Canceling hold invoice")
+
+	err = svc.lnClient.CancelHoldInvoice(ctx, event.PubKey, holdInvoice.PaymentHash)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":     event.ID,
+			"eventKind":   event.Kind,
+			"appId":       app.ID,
+			"paymentHash": holdInvoice.PaymentHash,
+		}).Infof("Failed to cancel hold invoice: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    nip47ErrorCode(err),
+				Message: fmt.Sprintf("Something went wrong while canceling hold invoice: %s", err.Error()),
+			},
+		}, signer)
+	}
+
+	svc.db.Model(&holdInvoice).Update("state", HOLD_INVOICE_STATE_CANCELED)
+	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result:     struct{}{},
+	}, signer)
+}
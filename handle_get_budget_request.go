@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleGetBudgetEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	// the budget belongs to the pay_invoice permission, reading it needs its own permission
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+	}).Info("Fetching budget")
+
+	budget, err := svc.GetBudget(ctx, &app)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Infof("Failed to fetch budget: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_INTERNAL,
+				Message: fmt.Sprintf("Something went wrong while fetching budget: %s", err.Error()),
+			},
+		}, signer)
+	}
+	var responsePayload interface{} = struct{}{}
+	if budget != nil {
+		responsePayload = budget
+	}
+
+	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result:     responsePayload,
+	}, signer)
+}
+
+// GetBudget returns the pay_invoice budget of the app in msats, or nil if its payments are not limited.
+// Fiat budgets are converted at the current rate. The remaining amount is capped by the account-wide budget of the user.
+func (svc *Service) GetBudget(ctx context.Context, app *App) (*Nip47GetBudgetResponse, error) {
+	var budget *Nip47GetBudgetResponse
+
+	appPermission := AppPermission{}
+	svc.db.Preload("App").Where("app_id = ? AND request_method = ?", app.ID, NIP_47_PAY_INVOICE_METHOD).Limit(1).Find(&appPermission)
+	if appPermission.MaxAmount > 0 && appPermission.BudgetCurrency != "" {
+		rate, err := svc.getFiatRate(ctx, appPermission.BudgetCurrency)
+		if err != nil {
+			return nil, err
+		}
+		total := int64(appPermission.MaxAmount) * 100
+		used := svc.GetFiatBudgetUsage(&appPermission)
+		remaining := total - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		budget = newBudgetResponse(fiatCentsToMsat(total, rate), svc.GetBudgetUsage(&appPermission)*MSAT_PER_SAT, appPermission.BudgetRenewal, appPermission.App.CreatedAt)
+		budget.Remaining = fiatCentsToMsat(remaining, rate)
+		budget.FiatCurrency = appPermission.BudgetCurrency
+		budget.FiatTotalBudget = fiatCentsToUnits(total)
+		budget.FiatUsedBudget = fiatCentsToUnits(used)
+		budget.FiatRemaining = fiatCentsToUnits(remaining)
+	} else if appPermission.MaxAmount > 0 {
+		budget = newBudgetResponse(int64(appPermission.MaxAmount)*MSAT_PER_SAT, svc.GetBudgetUsage(&appPermission)*MSAT_PER_SAT, appPermission.BudgetRenewal, appPermission.App.CreatedAt)
+	}
+
+	user := User{}
+	svc.db.Limit(1).Find(&user, app.UserId)
+	if user.MaxAmount > 0 {
+		userBudget := newBudgetResponse(int64(user.MaxAmount)*MSAT_PER_SAT, svc.GetUserBudgetUsage(&user)*MSAT_PER_SAT, user.BudgetRenewal, user.CreatedAt)
+		if budget == nil {
+			return userBudget, nil
+		}
+		if userBudget.Remaining < budget.Remaining {
+			budget.Remaining = userBudget.Remaining
+		}
+	}
+	return budget, nil
+}
+
+// newBudgetResponse expects the amounts in msats
+func newBudgetResponse(total int64, used int64, budgetRenewal string, createdAt time.Time) *Nip47GetBudgetResponse {
+	if budgetRenewal == "" {
+		budgetRenewal = "never"
+	}
+	remaining := total - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	budget := &Nip47GetBudgetResponse{
+		TotalBudget:   total,
+		UsedBudget:    used,
+		Remaining:     remaining,
+		RenewalPeriod: budgetRenewal,
+	}
+	endOfBudget := GetEndOfBudget(budgetRenewal, createdAt)
+	if !endOfBudget.IsZero() {
+		renewsAt := endOfBudget.Unix()
+		budget.RenewsAt = &renewsAt
+	}
+	return budget
+}
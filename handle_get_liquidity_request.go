@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleGetLiquidityEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+	}).Info("Fetching liquidity")
+
+	channels, err := svc.lnClient.ListChannels(ctx, event.PubKey)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Infof("Failed to fetch liquidity: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    nip47ErrorCode(err),
+				Message: fmt.Sprintf("Something went wrong while fetching liquidity: %s", err.Error()),
+			},
+		}, signer)
+	}
+
+	// only active channels can be used, and the channel reserves can never be spent
+	responsePayload := &Nip47GetLiquidityResponse{}
+	for _, channel := range channels {
+		if !channel.Active {
+			continue
+		}
+		responsePayload.ActiveChannels++
+		outbound := (channel.LocalBalance - channel.LocalReserve) * MSAT_PER_SAT
+		if outbound < 0 {
+			outbound = 0
+		}
+		inbound := (channel.RemoteBalance - channel.RemoteReserve) * MSAT_PER_SAT
+		if inbound < 0 {
+			inbound = 0
+		}
+		responsePayload.Outbound += outbound
+		responsePayload.Inbound += inbound
+		if outbound > responsePayload.LargestOutbound {
+			responsePayload.LargestOutbound = outbound
+		}
+		if inbound > responsePayload.LargestInbound {
+			responsePayload.LargestInbound = inbound
+		}
+	}
+
+	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result:     responsePayload,
+	}, signer)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleGetOnchainBalanceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+	}).Info("Fetching on-chain balance")
+
+	balance, err := svc.lnClient.GetOnchainBalance(ctx, event.PubKey)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Infof("Failed to fetch on-chain balance: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    nip47ErrorCode(err),
+				Message: fmt.Sprintf("Something went wrong while fetching on-chain balance: %s", err.Error()),
+			},
+		}, signer)
+	}
+
+	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result: Nip47GetOnchainBalanceResponse{
+			Confirmed:   balance.Confirmed * MSAT_PER_SAT,
+			Unconfirmed: balance.Unconfirmed * MSAT_PER_SAT,
+			Reserved:    balance.Reserved * MSAT_PER_SAT,
+		},
+	}, signer)
+}
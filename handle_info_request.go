@@ -8,7 +8,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func (svc *Service) HandleGetInfoEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+func (svc *Service) HandleGetInfoEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
 
 	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
 	err = svc.db.Create(&nostrEvent).Error
@@ -35,7 +35,7 @@ func (svc *Service) HandleGetInfoEvent(ctx context.Context, request *Nip47Reques
 			Error: &Nip47Error{
 				Code:    code,
 				Message: message,
-			}}, ss)
+			}}, signer)
 	}
 
 	svc.Logger.WithFields(logrus.Fields{
@@ -59,7 +59,7 @@ func (svc *Service) HandleGetInfoEvent(ctx context.Context, request *Nip47Reques
 				Code:    NIP_47_ERROR_INTERNAL,
 				Message: fmt.Sprintf("Something went wrong while fetching node info: %s", err.Error()),
 			},
-		}, ss)
+		}, signer)
 	}
 
 	responsePayload := &Nip47GetInfoResponse{
@@ -69,7 +69,7 @@ func (svc *Service) HandleGetInfoEvent(ctx context.Context, request *Nip47Reques
 		Network:     info.Network,
 		BlockHeight: info.BlockHeight,
 		BlockHash:   info.BlockHash,
-		Methods:     svc.GetMethods(&app),
+		Methods:     svc.GetMethods(ctx, &app),
 	}
 
 	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
@@ -77,5 +77,5 @@ func (svc *Service) HandleGetInfoEvent(ctx context.Context, request *Nip47Reques
 	return svc.createResponse(event, Nip47Response{
 		ResultType: request.Method,
 		Result:     responsePayload,
-	}, ss)
+	}, signer)
 }
@@ -9,7 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func (svc *Service) HandleListTransactionsEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+func (svc *Service) HandleListTransactionsEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
 
 	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
 	err = svc.db.Create(&nostrEvent).Error
@@ -48,7 +48,7 @@ func (svc *Service) HandleListTransactionsEvent(ctx context.Context, request *Ni
 			Error: &Nip47Error{
 				Code:    code,
 				Message: message,
-			}}, ss)
+			}}, signer)
 	}
 
 	svc.Logger.WithFields(logrus.Fields{
@@ -74,11 +74,11 @@ func (svc *Service) HandleListTransactionsEvent(ctx context.Context, request *Ni
 				Code:    NIP_47_ERROR_INTERNAL,
 				Message: fmt.Sprintf("Something went wrong while fetching transactions: %s", err.Error()),
 			},
-		}, ss)
+		}, signer)
 	}
 
 	responsePayload := &Nip47ListTransactionsResponse{
-		Transactions: transactions,
+		Transactions: svc.addLightningAddressComments(transactions),
 	}
 	// fmt.Println(responsePayload)
 
@@ -88,5 +88,5 @@ func (svc *Service) HandleListTransactionsEvent(ctx context.Context, request *Ni
 		ResultType: request.Method,
 		Result:     responsePayload,
 	},
-		ss)
+		signer)
 }
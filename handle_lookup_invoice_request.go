@@ -11,7 +11,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func (svc *Service) HandleLookupInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+func (svc *Service) HandleLookupInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
 	// TODO: move to a shared function
 	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
 	err = svc.db.Create(&nostrEvent).Error
@@ -39,7 +39,7 @@ func (svc *Service) HandleLookupInvoiceEvent(ctx context.Context, request *Nip47
 			Error: &Nip47Error{
 				Code:    code,
 				Message: message,
-			}}, ss)
+			}}, signer)
 	}
 
 	// TODO: move to a shared generic function
@@ -80,7 +80,7 @@ func (svc *Service) HandleLookupInvoiceEvent(ctx context.Context, request *Nip47
 					Code:    NIP_47_ERROR_INTERNAL,
 					Message: fmt.Sprintf("Failed to decode bolt11 invoice: %s", err.Error()),
 				},
-			}, ss)
+			}, signer)
 		}
 		paymentHash = paymentRequest.PaymentHash
 	}
@@ -102,11 +102,11 @@ func (svc *Service) HandleLookupInvoiceEvent(ctx context.Context, request *Nip47
 				Code:    NIP_47_ERROR_INTERNAL,
 				Message: fmt.Sprintf("Something went wrong while looking up invoice: %s", err.Error()),
 			},
-		}, ss)
+		}, signer)
 	}
 
 	responsePayload := &Nip47LookupInvoiceResponse{
-		Nip47Transaction: *transaction,
+		Nip47Transaction: svc.addLightningAddressComments([]Nip47Transaction{*transaction})[0],
 	}
 
 	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
@@ -115,5 +115,5 @@ func (svc *Service) HandleLookupInvoiceEvent(ctx context.Context, request *Nip47
 		ResultType: NIP_47_LOOKUP_INVOICE_METHOD,
 		Result:     responsePayload,
 	},
-		ss)
+		signer)
 }
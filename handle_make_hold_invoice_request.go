@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleMakeHoldInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	makeHoldInvoiceParams := &Nip47MakeHoldInvoiceParams{}
+	err = json.Unmarshal(request.Params, makeHoldInvoiceParams)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to decode nostr event: %v", err)
+		return nil, err
+	}
+
+	if makeHoldInvoiceParams.PaymentHash == "" {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_OTHER,
+				Message: "payment_hash is required",
+			},
+		}, signer)
+	}
+	if makeHoldInvoiceParams.Description != "" && makeHoldInvoiceParams.DescriptionHash != "" {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_OTHER,
+				Message: "Only one of description, description_hash can be provided",
+			},
+		}, signer)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":     event.ID,
+		"eventKind":   event.Kind,
+		"appId":       app.ID,
+		"amount":      makeHoldInvoiceParams.Amount,
+		"paymentHash": makeHoldInvoiceParams.PaymentHash,
+		"expiry":      makeHoldInvoiceParams.Expiry,
+	}).Info("Making hold invoice")
+
+	transaction, err := svc.lnClient.MakeHoldInvoice(ctx, event.PubKey, makeHoldInvoiceParams.Amount, makeHoldInvoiceParams.Description, makeHoldInvoiceParams.DescriptionHash, makeHoldInvoiceParams.PaymentHash, makeHoldInvoiceParams.Expiry)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":     event.ID,
+			"eventKind":   event.Kind,
+			"appId":       app.ID,
+			"paymentHash": makeHoldInvoiceParams.PaymentHash,
+		}).Infof("Failed to make hold invoice: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    nip47ErrorCode(err),
+				Message: fmt.Sprintf("Something went wrong while making hold invoice: %s", err.Error()),
+			},
+		}, signer)
+	}
+
+	holdInvoice := HoldInvoice{
+		App:         app,
+		PaymentHash: transaction.PaymentHash,
+		Invoice:     transaction.Invoice,
+		Amount:      transaction.Amount,
+		State:       HOLD_INVOICE_STATE_OPEN,
+	}
+	if transaction.ExpiresAt != nil {
+		expiresAt := time.Unix(*transaction.ExpiresAt, 0)
+		holdInvoice.ExpiresAt = &expiresAt
+	}
+	err = svc.db.Create(&holdInvoice).Error
+	if err != nil {
+		return nil, err
+	}
+
+	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result: &Nip47MakeInvoiceResponse{
+			Nip47Transaction: *transaction,
+		},
+	}, signer)
+}
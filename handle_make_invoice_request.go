@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 
@@ -11,7 +13,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func (svc *Service) HandleMakeInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+func (svc *Service) HandleMakeInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
 
 	// TODO: move to a shared function
 	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
@@ -40,7 +42,7 @@ func (svc *Service) HandleMakeInvoiceEvent(ctx context.Context, request *Nip47Re
 			Error: &Nip47Error{
 				Code:    code,
 				Message: message,
-			}}, ss)
+			}}, signer)
 	}
 
 	// TODO: move to a shared generic function
@@ -68,7 +70,33 @@ func (svc *Service) HandleMakeInvoiceEvent(ctx context.Context, request *Nip47Re
 				Code:    NIP_47_OTHER,
 				Message: "Only one of description, description_hash can be provided",
 			},
-		}, ss)
+		}, signer)
+	}
+
+	zapRequest, err := parseZapRequest(makeInvoiceParams.Description, makeInvoiceParams.Amount)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Invalid zap request: %v", err)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: NIP_47_MAKE_INVOICE_METHOD,
+			Error: &Nip47Error{
+				Code:    NIP_47_OTHER,
+				Message: err.Error(),
+			},
+		}, signer)
+	}
+
+	description := makeInvoiceParams.Description
+	descriptionHash := makeInvoiceParams.DescriptionHash
+	if zapRequest != nil {
+		// NIP-57: the invoice commits to the zap request through the description hash
+		hash := sha256.Sum256([]byte(description))
+		descriptionHash = hex.EncodeToString(hash[:])
+		description = ""
 	}
 
 	svc.Logger.WithFields(logrus.Fields{
@@ -77,11 +105,12 @@ func (svc *Service) HandleMakeInvoiceEvent(ctx context.Context, request *Nip47Re
 		"appId":           app.ID,
 		"amount":          makeInvoiceParams.Amount,
 		"description":     makeInvoiceParams.Description,
-		"descriptionHash": makeInvoiceParams.DescriptionHash,
+		"descriptionHash": descriptionHash,
 		"expiry":          makeInvoiceParams.Expiry,
+		"zap":             zapRequest != nil,
 	}).Info("Making invoice")
 
-	transaction, err := svc.lnClient.MakeInvoice(ctx, event.PubKey, makeInvoiceParams.Amount, makeInvoiceParams.Description, makeInvoiceParams.DescriptionHash, makeInvoiceParams.Expiry)
+	transaction, err := svc.lnClient.MakeInvoice(ctx, event.PubKey, makeInvoiceParams.Amount, description, descriptionHash, makeInvoiceParams.Expiry)
 	if err != nil {
 		svc.Logger.WithFields(logrus.Fields{
 			"eventId":         event.ID,
@@ -100,7 +129,20 @@ func (svc *Service) HandleMakeInvoiceEvent(ctx context.Context, request *Nip47Re
 				Code:    NIP_47_ERROR_INTERNAL,
 				Message: fmt.Sprintf("Something went wrong while making invoice: %s", err.Error()),
 			},
-		}, ss)
+		}, signer)
+	}
+
+	if zapRequest != nil {
+		// the LNURL service of the app has to advertise the service pubkey
+		err = svc.watchZap(&app, transaction, makeInvoiceParams.Description, svc.activeIdentity().pubkey)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":     event.ID,
+				"eventKind":   event.Kind,
+				"appId":       app.ID,
+				"paymentHash": transaction.PaymentHash,
+			}).Errorf("Failed to save zap: %v", err)
+		}
 	}
 
 	responsePayload := &Nip47MakeInvoiceResponse{
@@ -113,5 +155,5 @@ func (svc *Service) HandleMakeInvoiceEvent(ctx context.Context, request *Nip47Re
 		ResultType: NIP_47_MAKE_INVOICE_METHOD,
 		Result:     responsePayload,
 	},
-		ss)
+		signer)
 }
@@ -9,7 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func (svc *Service) HandlePayKeysendEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+func (svc *Service) HandlePayKeysendEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
 
 	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
 	err = svc.db.Create(&nostrEvent).Error
@@ -34,7 +34,7 @@ func (svc *Service) HandlePayKeysendEvent(ctx context.Context, request *Nip47Req
 	}
 
 	// We use pay_invoice permissions for budget and max amount
-	hasPermission, code, message := svc.hasPermission(&app, event, NIP_47_PAY_INVOICE_METHOD, payParams.Amount)
+	hasPermission, code, message := svc.hasPaymentPermission(&app, event, request.Method, payParams.Amount)
 
 	if !hasPermission {
 		svc.Logger.WithFields(logrus.Fields{
@@ -49,10 +49,45 @@ func (svc *Service) HandlePayKeysendEvent(ctx context.Context, request *Nip47Req
 			Error: &Nip47Error{
 				Code:    code,
 				Message: message,
-			}}, ss)
+			}}, signer)
 	}
 
-	payment := Payment{App: app, NostrEvent: nostrEvent, Amount: uint(payParams.Amount / 1000)}
+	if svc.requiresApproval(&app, payParams.Amount) {
+		approved, code, message := svc.AwaitPaymentApproval(ctx, &app, &nostrEvent, request.Method, payParams.Amount, "", payParams.Pubkey)
+		if approved {
+			// time has passed, so make sure the budget still allows the payment
+			approved, code, message = svc.hasPaymentPermission(&app, event, request.Method, payParams.Amount)
+		}
+		if !approved {
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":      event.ID,
+				"eventKind":    event.Kind,
+				"appId":        app.ID,
+				"senderPubkey": payParams.Pubkey,
+			}).Infof("Payment not approved: %s %s", code, message)
+			nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+			svc.db.Save(&nostrEvent)
+			return svc.createResponse(event, Nip47Response{
+				ResultType: request.Method,
+				Error: &Nip47Error{
+					Code:    code,
+					Message: message,
+				}}, signer)
+		}
+	}
+
+	fiatAmount, fiatCurrency, err := svc.paymentFiatAmount(&app, payParams.Amount)
+	if err != nil {
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_INTERNAL,
+				Message: "Failed to fetch exchange rate for budget",
+			}}, signer)
+	}
+	payment := Payment{App: app, NostrEvent: nostrEvent, Amount: uint(payParams.Amount / 1000), FiatAmount: fiatAmount, FiatCurrency: fiatCurrency, State: PAYMENT_STATE_PENDING}
 	insertPaymentResult := svc.db.Create(&payment)
 	if insertPaymentResult.Error != nil {
 		return nil, insertPaymentResult.Error
@@ -73,6 +108,7 @@ func (svc *Service) HandlePayKeysendEvent(ctx context.Context, request *Nip47Req
 			"appId":        app.ID,
 			"senderPubkey": payParams.Pubkey,
 		}).Infof("Failed to send payment: %v", err)
+		svc.failPayment(&payment)
 		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
 		svc.db.Save(&nostrEvent)
 		return svc.createResponse(event, Nip47Response{
@@ -81,9 +117,10 @@ func (svc *Service) HandlePayKeysendEvent(ctx context.Context, request *Nip47Req
 				Code:    NIP_47_ERROR_INTERNAL,
 				Message: fmt.Sprintf("Something went wrong while paying invoice: %s", err.Error()),
 			},
-		}, ss)
+		}, signer)
 	}
 	payment.Preimage = &preimage
+	payment.State = PAYMENT_STATE_SETTLED
 	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
 	svc.db.Save(&nostrEvent)
 	svc.db.Save(&payment)
@@ -92,5 +129,5 @@ func (svc *Service) HandlePayKeysendEvent(ctx context.Context, request *Nip47Req
 		Result: Nip47PayResponse{
 			Preimage: preimage,
 		},
-	}, ss)
+	}, signer)
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandlePayLnurlEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	payParams := &Nip47PayLnurlParams{}
+	err = json.Unmarshal(request.Params, payParams)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to decode nostr event: %v", err)
+		return nil, err
+	}
+
+	if payParams.Lnurl == "" || payParams.Amount <= 0 {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_OTHER,
+				Message: "lnurl and amount are required",
+			}}, signer)
+	}
+
+	// check the permission before contacting the LNURL service
+	hasPermission, code, message := svc.hasPaymentPermission(&app, event, request.Method, payParams.Amount)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+		"lnurl":     payParams.Lnurl,
+		"amount":    payParams.Amount,
+	}).Info("Fetching invoice from LNURL service")
+
+	bolt11, successAction, err := FetchLNURLInvoice(ctx, payParams.Lnurl, payParams.Amount, payParams.Comment)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+			"lnurl":     payParams.Lnurl,
+		}).Infof("Failed to fetch invoice: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_OTHER,
+				Message: fmt.Sprintf("Failed to fetch invoice: %s", err.Error()),
+			}}, signer)
+	}
+
+	preimage, nip47Error, err := svc.payInvoice(ctx, request.Method, event, &app, &nostrEvent, bolt11, 0)
+	if err != nil {
+		return nil, err
+	}
+	if nip47Error != nil {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error:      nip47Error,
+		}, signer)
+	}
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result: Nip47PayLnurlResponse{
+			Preimage:      preimage,
+			SuccessAction: successAction,
+		},
+	}, signer)
+}
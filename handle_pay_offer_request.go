@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandlePayOfferEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	payParams := &Nip47PayOfferParams{}
+	err = json.Unmarshal(request.Params, payParams)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to decode nostr event: %v", err)
+		return nil, err
+	}
+
+	if payParams.Offer == "" {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_OTHER,
+				Message: "offer is required",
+			}}, signer)
+	}
+
+	// check the permission before contacting the offer's node,
+	// the amount is checked again once the invoice of the offer is known
+	hasPermission, code, message := svc.hasPermission(&app, event, NIP_47_PAY_INVOICE_METHOD, payParams.Amount)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	invoice, paymentHash, amount, err := svc.lnClient.FetchOfferInvoice(ctx, event.PubKey, payParams.Offer, payParams.Amount, payParams.PayerNote)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+			"offer":     payParams.Offer,
+		}).Infof("Failed to fetch invoice for offer: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    nip47ErrorCode(err),
+				Message: fmt.Sprintf("Failed to fetch invoice for offer: %s", err.Error()),
+			}}, signer)
+	}
+
+	var invalid error
+	if payParams.Amount != 0 && amount != payParams.Amount {
+		invalid = errors.New("The invoice of the offer does not match the requested amount")
+	}
+	preimage, nip47Error, err := svc.sendPayment(ctx, request.Method, event, &app, &nostrEvent, &outgoingPayment{
+		invoice:     invoice,
+		paymentHash: paymentHash,
+		destination: payParams.Offer,
+		amount:      amount,
+		invalid:     invalid,
+		send: func(ctx context.Context) (string, error) {
+			return svc.lnClient.PayOfferInvoice(ctx, event.PubKey, invoice)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if nip47Error != nil {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error:      nip47Error,
+		}, signer)
+	}
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result: Nip47PayResponse{
+			Preimage: preimage,
+		},
+	}, signer)
+}
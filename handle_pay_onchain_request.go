@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandlePayOnchainEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	payParams := &Nip47PayOnchainParams{}
+	err = json.Unmarshal(request.Params, payParams)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to decode nostr event: %v", err)
+		return nil, err
+	}
+
+	// on-chain amounts are whole sats
+	if payParams.Address == "" || payParams.Amount <= 0 || payParams.Amount%MSAT_PER_SAT != 0 {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_OTHER,
+				Message: "address and an amount in whole sats are required",
+			}}, signer)
+	}
+
+	// concurrent requests must not all pass the budget check before one of them is recorded
+	svc.onchainPaymentsMu.Lock()
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, payParams.Amount)
+
+	if !hasPermission {
+		svc.onchainPaymentsMu.Unlock()
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	onchainPayment := OnchainPayment{App: app, NostrEvent: nostrEvent, Address: payParams.Address, Amount: uint(payParams.Amount / MSAT_PER_SAT), State: ONCHAIN_PAYMENT_STATE_PENDING}
+	err = svc.db.Create(&onchainPayment).Error
+	svc.onchainPaymentsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+		"address":   payParams.Address,
+		"amount":    payParams.Amount,
+	}).Info("Sending on-chain payment")
+
+	txId, err := svc.lnClient.SendOnchain(ctx, event.PubKey, payParams.Address, payParams.Amount/MSAT_PER_SAT, payParams.SatPerVbyte)
+	if err != nil {
+		// the transaction might have been broadcast if the request timed out, it then stays pending and counts against the budget
+		if errors.Is(err, ErrPaymentFailed) || errors.Is(err, ErrNotImplemented) {
+			svc.db.Model(&onchainPayment).Update("state", ONCHAIN_PAYMENT_STATE_FAILED)
+		}
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+			"address":   payParams.Address,
+		}).Infof("Failed to send on-chain payment: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    nip47ErrorCode(err),
+				Message: fmt.Sprintf("Something went wrong while sending on-chain payment: %s", err.Error()),
+			},
+		}, signer)
+	}
+
+	onchainPayment.TxId = &txId
+	onchainPayment.State = ONCHAIN_PAYMENT_STATE_SENT
+	svc.db.Save(&onchainPayment)
+	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result: Nip47PayOnchainResponse{
+			TxId: txId,
+		},
+	}, signer)
+}
@@ -3,15 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 	decodepay "github.com/nbd-wtf/ln-decodepay"
 	"github.com/sirupsen/logrus"
 )
 
-func (svc *Service) HandlePayInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, ss []byte) (result *nostr.Event, err error) {
+func (svc *Service) HandlePayInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
 
 	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
 	err = svc.db.Create(&nostrEvent).Error
@@ -24,7 +26,6 @@ func (svc *Service) HandlePayInvoiceEvent(ctx context.Context, request *Nip47Req
 		return nil, err
 	}
 
-	var bolt11 string
 	payParams := &Nip47PayParams{}
 	err = json.Unmarshal(request.Params, payParams)
 	if err != nil {
@@ -36,7 +37,39 @@ func (svc *Service) HandlePayInvoiceEvent(ctx context.Context, request *Nip47Req
 		return nil, err
 	}
 
-	bolt11 = payParams.Invoice
+	preimage, nip47Error, err := svc.payInvoice(ctx, request.Method, event, &app, &nostrEvent, payParams.Invoice, payParams.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if nip47Error != nil {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: NIP_47_PAY_INVOICE_METHOD,
+			Error:      nip47Error,
+		}, signer)
+	}
+	return svc.createResponse(event, Nip47Response{
+		ResultType: NIP_47_PAY_INVOICE_METHOD,
+		Result: Nip47PayResponse{
+			Preimage: preimage,
+		},
+	}, signer)
+}
+
+// outgoingPayment is an invoice to pay, a bolt11 invoice or the invoice fetched for a BOLT12 offer
+type outgoingPayment struct {
+	invoice     string
+	paymentHash string
+	destination string
+	// amount to pay in msat
+	amount int64
+	// set if the invoice can't be paid, it is only returned if the app didn't pay the invoice before
+	invalid error
+	send    func(ctx context.Context) (preimage string, err error)
+}
+
+// payInvoice runs the checks shared by all methods paying a bolt11 invoice and pays it.
+// amount is only needed for amountless invoices. Rejected payments return the error to reply with.
+func (svc *Service) payInvoice(ctx context.Context, requestMethod string, event *nostr.Event, app *App, nostrEvent *NostrEvent, bolt11 string, amount int64) (preimage string, nip47Error *Nip47Error, err error) {
 	// Convert invoice to lowercase string
 	bolt11 = strings.ToLower(bolt11)
 	paymentRequest, err := decodepay.Decodepay(bolt11)
@@ -48,16 +81,77 @@ func (svc *Service) HandlePayInvoiceEvent(ctx context.Context, request *Nip47Req
 			"bolt11":    bolt11,
 		}).Errorf("Failed to decode bolt11 invoice: %v", err)
 
-		return svc.createResponse(event, Nip47Response{
-			ResultType: NIP_47_PAY_INVOICE_METHOD,
-			Error: &Nip47Error{
-				Code:    NIP_47_ERROR_INTERNAL,
-				Message: fmt.Sprintf("Failed to decode bolt11 invoice: %s", err.Error()),
-			},
-		}, ss)
+		return "", &Nip47Error{
+			Code:    NIP_47_ERROR_INTERNAL,
+			Message: fmt.Sprintf("Failed to decode bolt11 invoice: %s", err.Error()),
+		}, nil
+	}
+
+	amount, invalid := validateInvoice(paymentRequest, amount, svc.network)
+	return svc.sendPayment(ctx, requestMethod, event, app, nostrEvent, &outgoingPayment{
+		invoice:     bolt11,
+		paymentHash: paymentRequest.PaymentHash,
+		destination: paymentRequest.Payee,
+		amount:      amount,
+		invalid:     invalid,
+		send: func(ctx context.Context) (string, error) {
+			// only pass the amount for amountless invoices
+			var sendAmount int64
+			if paymentRequest.MSatoshi == 0 {
+				sendAmount = amount
+			}
+			return svc.lnClient.SendPaymentSync(ctx, event.PubKey, bolt11, sendAmount)
+		},
+	})
+}
+
+// sendPayment pays an invoice once the app is allowed to, and returns the result of the earlier payment
+// if the app paid the invoice already. Rejected payments return the error to reply with.
+func (svc *Service) sendPayment(ctx context.Context, requestMethod string, event *nostr.Event, app *App, nostrEvent *NostrEvent, outgoing *outgoingPayment) (preimage string, nip47Error *Nip47Error, err error) {
+	// only one request of this process pays an invoice of the app at a time
+	paymentKey := fmt.Sprintf("%d:%s", app.ID, outgoing.paymentHash)
+	if _, inFlight := svc.paymentsInFlight.LoadOrStore(paymentKey, true); inFlight {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+			"invoice":   outgoing.invoice,
+		}).Info("Payment of invoice is already in progress")
+		return "", svc.paymentInProgress(nostrEvent), nil
+	}
+	defer svc.paymentsInFlight.Delete(paymentKey)
+
+	// a retry returns the result of the earlier payment before the invoice is checked again,
+	// by now it might have expired or the payment itself might have used up the budget
+	payment, err := svc.findPayment(app, outgoing.paymentHash)
+	if err != nil {
+		return "", nil, err
+	}
+	if payment != nil && payment.State == PAYMENT_STATE_PENDING {
+		// no request is handling it anymore, e.g. it timed out or the service restarted
+		svc.resolvePayment(ctx, event.PubKey, payment)
+	}
+	if payment != nil && payment.State != PAYMENT_STATE_FAILED {
+		return svc.existingPaymentResult(event, app, nostrEvent, payment)
+	}
+
+	if outgoing.invalid != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+			"invoice":   outgoing.invoice,
+		}).Errorf("Invalid invoice: %v", outgoing.invalid)
+
+		return "", &Nip47Error{
+			Code:    NIP_47_OTHER,
+			Message: outgoing.invalid.Error(),
+		}, nil
 	}
+	amount := outgoing.amount
 
-	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, paymentRequest.MSatoshi)
+	// all methods paying invoices use the pay_invoice permission for budget and max amount
+	hasPermission, code, message := svc.hasPermission(app, event, NIP_47_PAY_INVOICE_METHOD, amount)
 
 	if !hasPermission {
 		svc.Logger.WithFields(logrus.Fields{
@@ -66,53 +160,258 @@ func (svc *Service) HandlePayInvoiceEvent(ctx context.Context, request *Nip47Req
 			"appId":     app.ID,
 		}).Errorf("App does not have permission: %s %s", code, message)
 
-		return svc.createResponse(event, Nip47Response{
-			ResultType: NIP_47_PAY_INVOICE_METHOD,
-			Error: &Nip47Error{
-				Code:    code,
-				Message: message,
-			}}, ss)
+		return "", &Nip47Error{
+			Code:    code,
+			Message: message,
+		}, nil
 	}
 
-	payment := Payment{App: app, NostrEvent: nostrEvent, PaymentRequest: bolt11, Amount: uint(paymentRequest.MSatoshi / 1000)}
-	insertPaymentResult := svc.db.Create(&payment)
-	if insertPaymentResult.Error != nil {
-		return nil, insertPaymentResult.Error
+	fiatAmount, fiatCurrency, err := svc.paymentFiatAmount(app, amount)
+	if err != nil {
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(nostrEvent)
+		return "", &Nip47Error{
+			Code:    NIP_47_ERROR_INTERNAL,
+			Message: "Failed to fetch exchange rate for budget",
+		}, nil
+	}
+
+	payment, claimed, err := svc.claimPayment(app, nostrEvent, outgoing.invoice, outgoing.paymentHash, amount, fiatAmount, fiatCurrency)
+	if err != nil {
+		return "", nil, err
+	}
+	if !claimed {
+		// another instance of the service was faster
+		return svc.existingPaymentResult(event, app, nostrEvent, payment)
+	}
+
+	if svc.requiresApproval(app, amount) {
+		approved, code, message := svc.AwaitPaymentApproval(ctx, app, nostrEvent, requestMethod, amount, outgoing.invoice, outgoing.destination)
+		if approved {
+			// time has passed, so make sure the budget still allows the payment
+			approved, code, message = svc.hasPermission(app, event, NIP_47_PAY_INVOICE_METHOD, amount)
+		}
+		if !approved {
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":   event.ID,
+				"eventKind": event.Kind,
+				"appId":     app.ID,
+				"invoice":   outgoing.invoice,
+			}).Infof("Payment not approved: %s %s", code, message)
+			svc.failPayment(payment)
+			nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+			svc.db.Save(nostrEvent)
+			return "", &Nip47Error{
+				Code:    code,
+				Message: message,
+			}, nil
+		}
 	}
 
 	svc.Logger.WithFields(logrus.Fields{
 		"eventId":   event.ID,
 		"eventKind": event.Kind,
 		"appId":     app.ID,
-		"bolt11":    bolt11,
+		"invoice":   outgoing.invoice,
 	}).Info("Sending payment")
 
-	preimage, err := svc.lnClient.SendPaymentSync(ctx, event.PubKey, bolt11)
+	preimage, err = outgoing.send(ctx)
 	if err != nil {
 		svc.Logger.WithFields(logrus.Fields{
 			"eventId":   event.ID,
 			"eventKind": event.Kind,
 			"appId":     app.ID,
-			"bolt11":    bolt11,
+			"invoice":   outgoing.invoice,
 		}).Infof("Failed to send payment: %v", err)
+		// otherwise the payment might still be in flight, it stays pending and is looked up when the invoice is paid again
+		if errors.Is(err, ErrPaymentFailed) || errors.Is(err, ErrNotImplemented) {
+			svc.failPayment(payment)
+		}
 		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
-		svc.db.Save(&nostrEvent)
-		return svc.createResponse(event, Nip47Response{
-			ResultType: NIP_47_PAY_INVOICE_METHOD,
-			Error: &Nip47Error{
-				Code:    NIP_47_ERROR_INTERNAL,
-				Message: fmt.Sprintf("Something went wrong while paying invoice: %s", err.Error()),
-			},
-		}, ss)
+		svc.db.Save(nostrEvent)
+		return "", &Nip47Error{
+			Code:    nip47ErrorCode(err),
+			Message: fmt.Sprintf("Something went wrong while paying invoice: %s", err.Error()),
+		}, nil
 	}
 	payment.Preimage = &preimage
+	payment.State = PAYMENT_STATE_SETTLED
 	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
-	svc.db.Save(&nostrEvent)
-	svc.db.Save(&payment)
-	return svc.createResponse(event, Nip47Response{
-		ResultType: NIP_47_PAY_INVOICE_METHOD,
-		Result: Nip47PayResponse{
-			Preimage: preimage,
-		},
-	}, ss)
+	svc.db.Save(nostrEvent)
+	svc.db.Save(payment)
+	return preimage, nil, nil
+}
+
+// findPayment returns the payment of the invoice by the app, nil if it never paid it
+func (svc *Service) findPayment(app *App, paymentHash string) (*Payment, error) {
+	payment := &Payment{}
+	result := svc.db.Where("app_id = ? AND payment_hash = ?", app.ID, paymentHash).Limit(1).Find(payment)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return payment, nil
+}
+
+// resolvePayment looks up the state of a pending payment at the LN backend
+func (svc *Service) resolvePayment(ctx context.Context, senderPubkey string, payment *Payment) {
+	state, preimage, err := svc.lnClient.LookupPayment(ctx, senderPubkey, *payment.PaymentHash)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"appId":       payment.AppId,
+			"paymentId":   payment.ID,
+			"paymentHash": *payment.PaymentHash,
+		}).Errorf("Failed to lookup payment: %v", err)
+		return
+	}
+	switch state {
+	case PAYMENT_STATE_SETTLED:
+		payment.Preimage = &preimage
+		payment.State = PAYMENT_STATE_SETTLED
+		svc.db.Save(payment)
+	case PAYMENT_STATE_FAILED:
+		svc.failPayment(payment)
+		payment.State = PAYMENT_STATE_FAILED
+	}
+}
+
+// existingPaymentResult replies to a request for an invoice the app paid or is paying already
+func (svc *Service) existingPaymentResult(event *nostr.Event, app *App, nostrEvent *NostrEvent, payment *Payment) (preimage string, nip47Error *Nip47Error, err error) {
+	if payment.Preimage != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+			"paymentId": payment.ID,
+		}).Info("Invoice was already paid, returning stored preimage")
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
+		svc.db.Save(nostrEvent)
+		return *payment.Preimage, nil, nil
+	}
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":   event.ID,
+		"eventKind": event.Kind,
+		"appId":     app.ID,
+		"paymentId": payment.ID,
+	}).Info("Payment of invoice is already in progress")
+	return "", svc.paymentInProgress(nostrEvent), nil
+}
+
+func (svc *Service) paymentInProgress(nostrEvent *NostrEvent) *Nip47Error {
+	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+	svc.db.Save(nostrEvent)
+	return &Nip47Error{
+		Code:    NIP_47_OTHER,
+		Message: "Payment of this invoice is already in progress",
+	}
+}
+
+// claimPayment records a pending payment of the invoice for the app.
+// If the app already paid the invoice or is paying it right now, the existing payment is returned unclaimed.
+// Payments that failed before are claimed again so they can be retried.
+func (svc *Service) claimPayment(app *App, nostrEvent *NostrEvent, bolt11 string, paymentHash string, amount int64, fiatAmount int64, fiatCurrency string) (payment *Payment, claimed bool, err error) {
+	existing, err := svc.findPayment(app, paymentHash)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if existing == nil {
+		existing = &Payment{}
+		payment = &Payment{
+			App:            *app,
+			NostrEvent:     *nostrEvent,
+			PaymentRequest: bolt11,
+			PaymentHash:    &paymentHash,
+			Amount:         uint(amount / MSAT_PER_SAT),
+			FiatAmount:     fiatAmount,
+			FiatCurrency:   fiatCurrency,
+			State:          PAYMENT_STATE_PENDING,
+		}
+		err = svc.db.Create(payment).Error
+		if err == nil {
+			return payment, true, nil
+		}
+		// another request for the same invoice might have been faster
+		findErr := svc.db.Where("app_id = ? AND payment_hash = ?", app.ID, paymentHash).First(existing).Error
+		if findErr != nil {
+			return nil, false, err
+		}
+	}
+
+	if existing.State != PAYMENT_STATE_FAILED {
+		return existing, false, nil
+	}
+	// the retry counts against the budget period it is made in
+	createdAt := time.Now()
+	result := svc.db.Model(&Payment{}).
+		Where("id = ? AND state = ?", existing.ID, PAYMENT_STATE_FAILED).
+		Updates(map[string]interface{}{
+			"state":           PAYMENT_STATE_PENDING,
+			"nostr_event_id":  nostrEvent.ID,
+			"payment_request": bolt11,
+			"amount":          uint(amount / MSAT_PER_SAT),
+			"fiat_amount":     fiatAmount,
+			"fiat_currency":   fiatCurrency,
+			"created_at":      createdAt,
+		})
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// a concurrent retry claimed the payment
+		existing.State = PAYMENT_STATE_PENDING
+		return existing, false, nil
+	}
+	existing.State = PAYMENT_STATE_PENDING
+	existing.NostrEventId = nostrEvent.ID
+	existing.PaymentRequest = bolt11
+	existing.Amount = uint(amount / MSAT_PER_SAT)
+	existing.FiatAmount = fiatAmount
+	existing.FiatCurrency = fiatCurrency
+	existing.CreatedAt = createdAt
+	return existing, true, nil
+}
+
+// failPayment marks a claimed payment as failed so it can be retried
+func (svc *Service) failPayment(payment *Payment) {
+	svc.db.Model(payment).Update("state", PAYMENT_STATE_FAILED)
+}
+
+// bolt11 prefixes of the networks reported by the LN backends
+var networkInvoicePrefixes = map[string]string{
+	"mainnet": "bc",
+	"bitcoin": "bc",
+	"testnet": "tb",
+	"signet":  "tbs",
+	"regtest": "bcrt",
+	"simnet":  "sb",
+}
+
+// validateInvoice makes sure the invoice can be paid and returns the amount to pay in msat
+func validateInvoice(paymentRequest decodepay.Bolt11, amount int64, network string) (int64, error) {
+	expiresAt := time.Unix(int64(paymentRequest.CreatedAt+paymentRequest.Expiry), 0)
+	if time.Now().After(expiresAt) {
+		return 0, errors.New("Invoice expired")
+	}
+
+	prefix, ok := networkInvoicePrefixes[network]
+	if !ok {
+		return 0, errors.New("Network of the wallet is unknown")
+	}
+	if prefix != paymentRequest.Currency {
+		return 0, fmt.Errorf("Invoice is for network %s but the wallet is on %s", paymentRequest.Currency, network)
+	}
+
+	if paymentRequest.MSatoshi == 0 {
+		if amount <= 0 {
+			return 0, errors.New("Amount is required to pay an amountless invoice")
+		}
+		return amount, nil
+	}
+	if amount != 0 && amount != paymentRequest.MSatoshi {
+		return 0, errors.New("Amount does not match the invoice amount")
+	}
+	return paymentRequest.MSatoshi, nil
 }
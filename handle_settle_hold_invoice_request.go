@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+func (svc *Service) HandleSettleHoldInvoiceEvent(ctx context.Context, request *Nip47Request, event *nostr.Event, app App, signer Signer) (result *nostr.Event, err error) {
+
+	nostrEvent := NostrEvent{App: app, NostrId: event.ID, Content: event.Content, State: "received"}
+	err = svc.db.Create(&nostrEvent).Error
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to save nostr event: %v", err)
+		return nil, err
+	}
+
+	hasPermission, code, message := svc.hasPermission(&app, event, request.Method, 0)
+
+	if !hasPermission {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("App does not have permission: %s %s", code, message)
+
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    code,
+				Message: message,
+			}}, signer)
+	}
+
+	settleParams := &Nip47SettleHoldInvoiceParams{}
+	err = json.Unmarshal(request.Params, settleParams)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":   event.ID,
+			"eventKind": event.Kind,
+			"appId":     app.ID,
+		}).Errorf("Failed to decode nostr event: %v", err)
+		return nil, err
+	}
+
+	// apps can only settle their own hold invoices
+	preimage, err := hex.DecodeString(settleParams.Preimage)
+	paymentHash := sha256.Sum256(preimage)
+	holdInvoice := HoldInvoice{}
+	findResult := svc.db.Where("app_id = ? AND payment_hash = ?", app.ID, hex.EncodeToString(paymentHash[:])).Limit(1).Find(&holdInvoice)
+	if err != nil || findResult.RowsAffected == 0 {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error:      svc.holdInvoiceNotFoundError(ctx, event.PubKey, hex.EncodeToString(paymentHash[:])),
+		}, signer)
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"eventId":     event.ID,
+		"eventKind":   event.Kind,
+		"appId":       app.ID,
+		"paymentHash": holdInvoice.PaymentHash,
+	}).Info("Settling hold invoice")
+
+	err = svc.lnClient.SettleHoldInvoice(ctx, event.PubKey, settleParams.Preimage)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":     event.ID,
+			"eventKind":   event.Kind,
+			"appId":       app.ID,
+			"paymentHash": holdInvoice.PaymentHash,
+		}).Infof("Failed to settle hold invoice: %v", err)
+		nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_ERROR
+		svc.db.Save(&nostrEvent)
+		return svc.createResponse(event, Nip47Response{
+			ResultType: request.Method,
+			Error: &Nip47Error{
+				Code:    nip47ErrorCode(err),
+				Message: fmt.Sprintf("Something went wrong while settling hold invoice: %s", err.Error()),
+			},
+		}, signer)
+	}
+
+	svc.db.Model(&holdInvoice).Update("state", HOLD_INVOICE_STATE_SETTLED)
+	nostrEvent.State = NOSTR_EVENT_STATE_HANDLER_EXECUTED
+	svc.db.Save(&nostrEvent)
+	return svc.createResponse(event, Nip47Response{
+		ResultType: request.Method,
+		Result:     struct{}{},
+	}, signer)
+}
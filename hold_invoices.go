@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// how often open hold invoices are checked for incoming payments
+const holdInvoicePollInterval = 5 * time.Second
+
+// WatchHoldInvoices periodically checks the hold invoices that are not settled or canceled yet
+// and notifies the apps once a payment for their hold invoice was accepted
+func (svc *Service) WatchHoldInvoices(ctx context.Context) {
+	ticker := time.NewTicker(holdInvoicePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			svc.processHoldInvoices(ctx)
+		}
+	}
+}
+
+func (svc *Service) processHoldInvoices(ctx context.Context) {
+	holdInvoices := []HoldInvoice{}
+	err := svc.db.Preload("App").Where("state IN ?", []string{HOLD_INVOICE_STATE_OPEN, HOLD_INVOICE_STATE_ACCEPTED}).Find(&holdInvoices).Error
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to load hold invoices")
+		return
+	}
+
+	for _, holdInvoice := range holdInvoices {
+		state, err := svc.lnClient.GetHoldInvoiceState(ctx, holdInvoice.App.NostrPubkey, holdInvoice.PaymentHash)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"holdInvoiceId": holdInvoice.ID,
+				"appId":         holdInvoice.AppId,
+				"paymentHash":   holdInvoice.PaymentHash,
+			}).Errorf("Failed to look up hold invoice: %v", err)
+			continue
+		}
+		if state == holdInvoice.State {
+			continue
+		}
+
+		if state == HOLD_INVOICE_STATE_ACCEPTED {
+			transaction, err := svc.lnClient.LookupInvoice(ctx, holdInvoice.App.NostrPubkey, holdInvoice.PaymentHash)
+			if err == nil {
+				err = svc.PublishNotification(ctx, &holdInvoice.App, NIP_47_HOLD_INVOICE_ACCEPTED, transaction)
+			}
+			if err != nil {
+				// the state is kept so the notification is retried
+				svc.Logger.WithFields(logrus.Fields{
+					"holdInvoiceId": holdInvoice.ID,
+					"appId":         holdInvoice.AppId,
+					"paymentHash":   holdInvoice.PaymentHash,
+				}).Errorf("Failed to notify app about accepted hold invoice: %v", err)
+				continue
+			}
+		}
+
+		svc.db.Model(&holdInvoice).Update("state", state)
+		svc.Logger.WithFields(logrus.Fields{
+			"holdInvoiceId": holdInvoice.ID,
+			"appId":         holdInvoice.AppId,
+			"paymentHash":   holdInvoice.PaymentHash,
+			"state":         state,
+		}).Info("Hold invoice state changed")
+	}
+}
+
+// holdInvoiceNotFoundError is returned for a hold invoice the app did not create.
+// Backends without hold invoices never have one, they are told apart from an unknown hold invoice.
+func (svc *Service) holdInvoiceNotFoundError(ctx context.Context, senderPubkey string, paymentHash string) *Nip47Error {
+	_, err := svc.lnClient.GetHoldInvoiceState(ctx, senderPubkey, paymentHash)
+	if errors.Is(err, ErrNotImplemented) {
+		return &Nip47Error{
+			Code:    nip47ErrorCode(err),
+			Message: "Hold invoices are not supported by this wallet",
+		}
+	}
+	return &Nip47Error{
+		Code:    NIP_47_ERROR_NOT_FOUND,
+		Message: "Hold invoice not found",
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,40 +18,56 @@ import (
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type LNClient interface {
-	SendPaymentSync(ctx context.Context, senderPubkey string, payReq string) (preimage string, err error)
+	SendPaymentSync(ctx context.Context, senderPubkey string, payReq string, amount int64) (preimage string, err error)
 	SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, custom_records []TLVRecord) (preImage string, err error)
 	GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error)
 	GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error)
 	MakeInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error)
 	LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error)
 	ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, invoiceType string) (transactions []Nip47Transaction, err error)
+	MakeHoldInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, paymentHash string, expiry int64) (transaction *Nip47Transaction, err error)
+	SettleHoldInvoice(ctx context.Context, senderPubkey string, preimage string) (err error)
+	CancelHoldInvoice(ctx context.Context, senderPubkey string, paymentHash string) (err error)
+	GetHoldInvoiceState(ctx context.Context, senderPubkey string, paymentHash string) (state string, err error)
+	FetchOfferInvoice(ctx context.Context, senderPubkey string, offer string, amount int64, payerNote string) (invoice string, paymentHash string, invoiceAmount int64, err error)
+	PayOfferInvoice(ctx context.Context, senderPubkey string, invoice string) (preimage string, err error)
+	MakeOffer(ctx context.Context, senderPubkey string, amount int64, description string) (offer string, err error)
+	SignMessage(ctx context.Context, senderPubkey string, message string) (signature string, err error)
+	VerifyMessage(ctx context.Context, senderPubkey string, message string, signature string) (valid bool, pubkey string, err error)
+	GetOnchainBalance(ctx context.Context, senderPubkey string) (balance *OnchainBalance, err error)
+	MakeOnchainAddress(ctx context.Context, senderPubkey string) (address string, err error)
+	SendOnchain(ctx context.Context, senderPubkey string, address string, amount int64, satPerVbyte uint64) (txId string, err error)
+	ListChannels(ctx context.Context, senderPubkey string) (channels []Channel, err error)
+	ListPendingChannels(ctx context.Context, senderPubkey string) (channels []PendingChannel, err error)
+	// LookupPayment returns the PAYMENT_STATE_* of an outgoing payment and its preimage once it is settled
+	LookupPayment(ctx context.Context, senderPubkey string, paymentHash string) (state string, preimage string, err error)
+	// GetSupportedMethods returns the NIP-47 methods the backend can serve for the user, for all users without a user
+	GetSupportedMethods(ctx context.Context, user *User) (methods []string, err error)
 }
 
+// returned by backends for features they do not support
+var ErrNotImplemented = errors.New("Not implemented by this wallet backend")
+
+// returned by backends when a payment definitively failed, other errors leave it unknown whether the payment is still in flight
+var ErrPaymentFailed = errors.New("Payment failed")
+
 // wrap it again :sweat_smile:
 // todo: drop dependency on lndhub package
 type LNDService struct {
 	client *lnd.LNDWrapper
 	db     *gorm.DB
 	Logger *logrus.Logger
-}
-
-func (svc *LNDService) AuthHandler(c echo.Context) error {
-	user := &User{}
-	err := svc.db.FirstOrInit(user, User{AlbyIdentifier: "lnd"}).Error
-	if err != nil {
-		return err
-	}
-
-	sess, _ := session.Get(CookieName, c)
-	sess.Values["user_id"] = user.ID
-	sess.Save(c.Request(), c.Response())
-	return c.Redirect(302, "/")
+	// without the methods the macaroon has no permission for
+	supportedMethods []string
 }
 
 func (svc *LNDService) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
@@ -193,6 +211,204 @@ func (svc *LNDService) MakeInvoice(ctx context.Context, senderPubkey string, amo
 	return transaction, nil
 }
 
+func (svc *LNDService) MakeHoldInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, paymentHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	paymentHashBytes, err := hex.DecodeString(paymentHash)
+	if err != nil || len(paymentHashBytes) != 32 {
+		return nil, errors.New("Payment hash must be 32 bytes hex")
+	}
+	var descriptionHashBytes []byte
+	if descriptionHash != "" {
+		descriptionHashBytes, err = hex.DecodeString(descriptionHash)
+		if err != nil || len(descriptionHashBytes) != 32 {
+			return nil, errors.New("Description hash must be 32 bytes hex")
+		}
+	}
+
+	_, err = svc.client.AddHoldInvoice(ctx, &invoicesrpc.AddHoldInvoiceRequest{Hash: paymentHashBytes, ValueMsat: amount, Memo: description, DescriptionHash: descriptionHashBytes, Expiry: expiry})
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err := svc.client.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: paymentHashBytes})
+	if err != nil {
+		return nil, err
+	}
+	return lndInvoiceToTransaction(inv), nil
+}
+
+func (svc *LNDService) SettleHoldInvoice(ctx context.Context, senderPubkey string, preimage string) (err error) {
+	preimageBytes, err := hex.DecodeString(preimage)
+	if err != nil || len(preimageBytes) != 32 {
+		return errors.New("Preimage must be 32 bytes hex")
+	}
+	_, err = svc.client.SettleInvoice(ctx, &invoicesrpc.SettleInvoiceMsg{Preimage: preimageBytes})
+	return err
+}
+
+func (svc *LNDService) CancelHoldInvoice(ctx context.Context, senderPubkey string, paymentHash string) (err error) {
+	paymentHashBytes, err := hex.DecodeString(paymentHash)
+	if err != nil || len(paymentHashBytes) != 32 {
+		return errors.New("Payment hash must be 32 bytes hex")
+	}
+	_, err = svc.client.CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: paymentHashBytes})
+	return err
+}
+
+func (svc *LNDService) GetHoldInvoiceState(ctx context.Context, senderPubkey string, paymentHash string) (state string, err error) {
+	paymentHashBytes, err := hex.DecodeString(paymentHash)
+	if err != nil || len(paymentHashBytes) != 32 {
+		return "", errors.New("Payment hash must be 32 bytes hex")
+	}
+	inv, err := svc.client.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: paymentHashBytes})
+	if err != nil {
+		return "", err
+	}
+	switch inv.State {
+	case lnrpc.Invoice_ACCEPTED:
+		return HOLD_INVOICE_STATE_ACCEPTED, nil
+	case lnrpc.Invoice_SETTLED:
+		return HOLD_INVOICE_STATE_SETTLED, nil
+	case lnrpc.Invoice_CANCELED:
+		return HOLD_INVOICE_STATE_CANCELED, nil
+	default:
+		return HOLD_INVOICE_STATE_OPEN, nil
+	}
+}
+
+// LND does not support BOLT12 offers
+func (svc *LNDService) FetchOfferInvoice(ctx context.Context, senderPubkey string, offer string, amount int64, payerNote string) (invoice string, paymentHash string, invoiceAmount int64, err error) {
+	return "", "", 0, ErrNotImplemented
+}
+
+func (svc *LNDService) PayOfferInvoice(ctx context.Context, senderPubkey string, invoice string) (preimage string, err error) {
+	return "", ErrNotImplemented
+}
+
+func (svc *LNDService) MakeOffer(ctx context.Context, senderPubkey string, amount int64, description string) (offer string, err error) {
+	return "", ErrNotImplemented
+}
+
+func (svc *LNDService) GetSupportedMethods(ctx context.Context, user *User) (methods []string, err error) {
+	return svc.supportedMethods, nil
+}
+
+func (svc *LNDService) SignMessage(ctx context.Context, senderPubkey string, message string) (signature string, err error) {
+	resp, err := svc.client.SignMessage(ctx, &lnrpc.SignMessageRequest{Msg: []byte(message)})
+	if err != nil {
+		return "", err
+	}
+	return resp.Signature, nil
+}
+
+func (svc *LNDService) VerifyMessage(ctx context.Context, senderPubkey string, message string, signature string) (valid bool, pubkey string, err error) {
+	resp, err := svc.client.VerifyMessage(ctx, &lnrpc.VerifyMessageRequest{Msg: []byte(message), Signature: signature})
+	if err != nil {
+		return false, "", err
+	}
+	return resp.Valid, resp.Pubkey, nil
+}
+
+func (svc *LNDService) GetOnchainBalance(ctx context.Context, senderPubkey string) (balance *OnchainBalance, err error) {
+	resp, err := svc.client.WalletBalance(ctx, &lnrpc.WalletBalanceRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return &OnchainBalance{
+		Confirmed:   resp.ConfirmedBalance,
+		Unconfirmed: resp.UnconfirmedBalance,
+		Reserved:    resp.ReservedBalanceAnchorChan,
+	}, nil
+}
+
+func (svc *LNDService) MakeOnchainAddress(ctx context.Context, senderPubkey string) (address string, err error) {
+	resp, err := svc.client.NewAddress(ctx, &lnrpc.NewAddressRequest{Type: lnrpc.AddressType_WITNESS_PUBKEY_HASH})
+	if err != nil {
+		return "", err
+	}
+	return resp.Address, nil
+}
+
+func (svc *LNDService) SendOnchain(ctx context.Context, senderPubkey string, address string, amount int64, satPerVbyte uint64) (txId string, err error) {
+	// without a fee rate LND estimates the fee for confirmation within a few blocks
+	resp, err := svc.client.SendCoins(ctx, &lnrpc.SendCoinsRequest{
+		Addr:        address,
+		Amount:      amount,
+		SatPerVbyte: satPerVbyte,
+		Label:       "Nostr Wallet Connect",
+	})
+	if err != nil {
+		// the transaction might have been broadcast before the request timed out or the connection was lost
+		if ctx.Err() != nil || status.Code(err) == codes.DeadlineExceeded || status.Code(err) == codes.Canceled || status.Code(err) == codes.Unavailable {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: %s", ErrPaymentFailed, status.Convert(err).Message())
+	}
+	return resp.Txid, nil
+}
+
+func (svc *LNDService) ListChannels(ctx context.Context, senderPubkey string) (channels []Channel, err error) {
+	resp, err := svc.client.ListChannels(ctx, &lnrpc.ListChannelsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	channels = []Channel{}
+	for _, lndChannel := range resp.Channels {
+		channel := Channel{
+			Id:            strconv.FormatUint(lndChannel.ChanId, 10),
+			ChannelPoint:  lndChannel.ChannelPoint,
+			RemotePubkey:  lndChannel.RemotePubkey,
+			Capacity:      lndChannel.Capacity,
+			LocalBalance:  lndChannel.LocalBalance,
+			RemoteBalance: lndChannel.RemoteBalance,
+			Active:        lndChannel.Active,
+			Public:        !lndChannel.Private,
+		}
+		if lndChannel.LocalConstraints != nil {
+			channel.LocalReserve = int64(lndChannel.LocalConstraints.ChanReserveSat)
+		}
+		if lndChannel.RemoteConstraints != nil {
+			channel.RemoteReserve = int64(lndChannel.RemoteConstraints.ChanReserveSat)
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+func (svc *LNDService) ListPendingChannels(ctx context.Context, senderPubkey string) (channels []PendingChannel, err error) {
+	resp, err := svc.client.PendingChannels(ctx, &lnrpc.PendingChannelsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	channels = []PendingChannel{}
+	appendChannel := func(lndChannel *lnrpc.PendingChannelsResponse_PendingChannel, state string, closingTxId string) {
+		if lndChannel == nil {
+			return
+		}
+		channels = append(channels, PendingChannel{
+			ChannelPoint:  lndChannel.ChannelPoint,
+			RemotePubkey:  lndChannel.RemoteNodePub,
+			Capacity:      lndChannel.Capacity,
+			LocalBalance:  lndChannel.LocalBalance,
+			RemoteBalance: lndChannel.RemoteBalance,
+			State:         state,
+			ClosingTxId:   closingTxId,
+		})
+	}
+	for _, pending := range resp.PendingOpenChannels {
+		appendChannel(pending.Channel, PENDING_CHANNEL_STATE_OPENING, "")
+	}
+	for _, pending := range resp.WaitingCloseChannels {
+		appendChannel(pending.Channel, PENDING_CHANNEL_STATE_WAITING_CLOSE, pending.ClosingTxid)
+	}
+	for _, pending := range resp.PendingClosingChannels {
+		appendChannel(pending.Channel, PENDING_CHANNEL_STATE_CLOSING, pending.ClosingTxid)
+	}
+	for _, pending := range resp.PendingForceClosingChannels {
+		appendChannel(pending.Channel, PENDING_CHANNEL_STATE_FORCE_CLOSING, pending.ClosingTxid)
+	}
+	return channels, nil
+}
+
 func (svc *LNDService) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
 	paymentHashBytes, err := hex.DecodeString(paymentHash)
 
@@ -212,14 +428,49 @@ func (svc *LNDService) LookupInvoice(ctx context.Context, senderPubkey string, p
 	return transaction, nil
 }
 
-func (svc *LNDService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string) (preimage string, err error) {
-	resp, err := svc.client.SendPaymentSync(ctx, &lnrpc.SendRequest{PaymentRequest: payReq})
+func (svc *LNDService) SendPaymentSync(ctx context.Context, senderPubkey, payReq string, amount int64) (preimage string, err error) {
+	// amount is only set for amountless invoices
+	resp, err := svc.client.SendPaymentSync(ctx, &lnrpc.SendRequest{PaymentRequest: payReq, AmtMsat: amount})
 	if err != nil {
 		return "", err
 	}
+	if resp.PaymentError != "" {
+		return "", fmt.Errorf("%w: %s", ErrPaymentFailed, resp.PaymentError)
+	}
 	return hex.EncodeToString(resp.PaymentPreimage), nil
 }
 
+func (svc *LNDService) LookupPayment(ctx context.Context, senderPubkey string, paymentHash string) (state string, preimage string, err error) {
+	paymentHashBytes, err := hex.DecodeString(paymentHash)
+	if err != nil || len(paymentHashBytes) != 32 {
+		return "", "", errors.New("Payment hash must be 32 bytes hex")
+	}
+
+	// the first update of the stream is the current state of the payment
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := svc.client.SubscribePayment(ctx, &routerrpc.TrackPaymentRequest{PaymentHash: paymentHashBytes})
+	if err != nil {
+		return "", "", err
+	}
+	payment, err := stream.Recv()
+	if err != nil {
+		// LND never started the payment
+		if status.Code(err) == codes.NotFound {
+			return PAYMENT_STATE_FAILED, "", nil
+		}
+		return "", "", err
+	}
+	switch payment.Status {
+	case lnrpc.Payment_SUCCEEDED:
+		return PAYMENT_STATE_SETTLED, payment.PaymentPreimage, nil
+	case lnrpc.Payment_FAILED:
+		return PAYMENT_STATE_FAILED, "", nil
+	default:
+		return PAYMENT_STATE_PENDING, "", nil
+	}
+}
+
 func (svc *LNDService) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, custom_records []TLVRecord) (respPreimage string, err error) {
 	destBytes, err := hex.DecodeString(destination)
 	if err != nil {
@@ -324,34 +575,133 @@ func makePreimageHex() ([]byte, error) {
 	return bytes, nil
 }
 
+// LND RPCs needed by the NIP-47 methods, methods not listed don't need any
+var lndMethodRpcs = map[string][]string{
+	// payments left pending are tracked, invoices are checked against the network of the node
+	NIP_47_PAY_INVOICE_METHOD:           {"/lnrpc.Lightning/SendPaymentSync", "/routerrpc.Router/TrackPaymentV2", "/lnrpc.Lightning/GetInfo"},
+	NIP_47_PAY_KEYSEND_METHOD:           {"/lnrpc.Lightning/SendPaymentSync", "/routerrpc.Router/TrackPaymentV2", "/lnrpc.Lightning/GetInfo"},
+	NIP_47_PAY_LNURL_METHOD:             {"/lnrpc.Lightning/SendPaymentSync", "/routerrpc.Router/TrackPaymentV2", "/lnrpc.Lightning/GetInfo"},
+	NIP_47_GET_BALANCE_METHOD:           {"/lnrpc.Lightning/ChannelBalance"},
+	NIP_47_GET_INFO_METHOD:              {"/lnrpc.Lightning/GetInfo"},
+	NIP_47_MAKE_INVOICE_METHOD:          {"/lnrpc.Lightning/AddInvoice", "/lnrpc.Lightning/LookupInvoice"},
+	NIP_47_LOOKUP_INVOICE_METHOD:        {"/lnrpc.Lightning/LookupInvoice"},
+	NIP_47_LIST_TRANSACTIONS_METHOD:     {"/lnrpc.Lightning/ListInvoices", "/lnrpc.Lightning/ListPayments"},
+	NIP_47_MAKE_HOLD_INVOICE_METHOD:     {"/invoicesrpc.Invoices/AddHoldInvoice", "/lnrpc.Lightning/LookupInvoice"},
+	NIP_47_SETTLE_HOLD_INVOICE_METHOD:   {"/invoicesrpc.Invoices/SettleInvoice"},
+	NIP_47_CANCEL_HOLD_INVOICE_METHOD:   {"/invoicesrpc.Invoices/CancelInvoice"},
+	NIP_47_SIGN_MESSAGE_METHOD:          {"/lnrpc.Lightning/SignMessage"},
+	NIP_47_VERIFY_MESSAGE_METHOD:        {"/lnrpc.Lightning/VerifyMessage"},
+	NIP_47_MAKE_ONCHAIN_ADDRESS_METHOD:  {"/lnrpc.Lightning/NewAddress"},
+	NIP_47_GET_ONCHAIN_BALANCE_METHOD:   {"/lnrpc.Lightning/WalletBalance"},
+	NIP_47_PAY_ONCHAIN_METHOD:           {"/lnrpc.Lightning/SendCoins"},
+	NIP_47_LIST_CHANNELS_METHOD:         {"/lnrpc.Lightning/ListChannels"},
+	NIP_47_GET_LIQUIDITY_METHOD:         {"/lnrpc.Lightning/ListChannels"},
+	NIP_47_LIST_PENDING_CHANNELS_METHOD: {"/lnrpc.Lightning/PendingChannels"},
+}
+
+// lndDisabledMethods returns the permissions the macaroon lacks and the NIP-47 methods that can't work without them
+func lndDisabledMethods(permissions lnd.MacaroonPermissions) (missingPermissions []string, disabledMethods map[string]bool) {
+	missing := map[string]bool{}
+	disabledMethods = map[string]bool{}
+	for method, rpcs := range lndMethodRpcs {
+		for _, rpc := range rpcs {
+			if !permissions.Allows(rpc) {
+				missing[lnd.RPC_PERMISSIONS[rpc]] = true
+				disabledMethods[method] = true
+			}
+		}
+	}
+	for permission := range missing {
+		missingPermissions = append(missingPermissions, permission)
+	}
+	sort.Strings(missingPermissions)
+	return missingPermissions, disabledMethods
+}
+
+// lndOptions returns the LND connection options, a lndconnect URI takes precedence over the single values
+func lndOptions(cfg *Config) (lnd.LNDoptions, error) {
+	if cfg.LNDConnectUri != "" {
+		return lnd.ParseLNDConnectUri(cfg.LNDConnectUri)
+	}
+	return lnd.LNDoptions{
+		Address:      cfg.LNDAddress,
+		CertFile:     cfg.LNDCertFile,
+		CertHex:      cfg.LNDCertHex,
+		MacaroonFile: cfg.LNDMacaroonFile,
+		MacaroonHex:  cfg.LNDMacaroonHex,
+	}, nil
+}
+
 func NewLNDService(ctx context.Context, svc *Service, e *echo.Echo) (result *LNDService, err error) {
-	lndClient, err := lnd.NewLNDclient(lnd.LNDoptions{
-		Address:      svc.cfg.LNDAddress,
-		CertFile:     svc.cfg.LNDCertFile,
-		MacaroonFile: svc.cfg.LNDMacaroonFile,
-	}, ctx)
+	options, err := lndOptions(svc.cfg)
 	if err != nil {
 		return nil, err
 	}
-	info, err := lndClient.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+	lndClient, err := lnd.NewLNDclient(options, ctx)
 	if err != nil {
 		return nil, err
 	}
+
+	disabledMethods := map[string]bool{}
+	permissions, err := lndClient.Permissions()
+	if err != nil {
+		svc.Logger.WithError(err).Warn("Failed to read the permissions of the LND macaroon, not checking them")
+	} else {
+		var missingPermissions []string
+		missingPermissions, disabledMethods = lndDisabledMethods(permissions)
+		if len(missingPermissions) > 0 {
+			methods := []string{}
+			for method := range disabledMethods {
+				methods = append(methods, method)
+			}
+			sort.Strings(methods)
+			svc.Logger.WithFields(logrus.Fields{
+				"missingPermissions": strings.Join(missingPermissions, ","),
+				"disabledMethods":    strings.Join(methods, ","),
+			}).Warn("The LND macaroon lacks permissions, disabling the methods that need them")
+		}
+	}
+	supportedMethods := []string{}
+	for _, method := range strings.Split(NIP_47_CAPABILITIES, " ") {
+		// LND does not support BOLT12 offers
+		if !disabledMethods[method] && method != NIP_47_PAY_OFFER_METHOD && method != NIP_47_MAKE_OFFER_METHOD {
+			supportedMethods = append(supportedMethods, method)
+		}
+	}
+	// a macaroon without info:read can't fetch the alias, the node is then first reached by a request
+	alias := "unknown"
+	if !disabledMethods[NIP_47_GET_INFO_METHOD] {
+		info, err := lndClient.GetInfo(ctx, &lnrpc.GetInfoRequest{})
+		if err != nil {
+			return nil, err
+		}
+		alias = info.Alias
+	}
+
 	//add default user to db
 	user := &User{}
-	err = svc.db.FirstOrInit(user, User{AlbyIdentifier: "lnd"}).Error
+	err = svc.db.FirstOrInit(user, User{AlbyIdentifier: LND_USER_IDENTIFIER}).Error
 	if err != nil {
 		return nil, err
 	}
+	// served by the built-in LNURL-pay server
+	user.LightningAddress = svc.LightningAddress()
 	err = svc.db.Save(user).Error
 	if err != nil {
 		return nil, err
 	}
 
-	lndService := &LNDService{client: lndClient, Logger: svc.Logger, db: svc.db}
+	lndService := &LNDService{client: lndClient, Logger: svc.Logger, db: svc.db, supportedMethods: supportedMethods}
 
-	e.GET("/lnd/auth", lndService.AuthHandler)
-	svc.Logger.Infof("Connected to LND - alias %s", info.Alias)
+	err = svc.RegisterLNDAuthRoutes(e, user)
+	if err != nil {
+		return nil, err
+	}
+	if svc.LightningAddress() != "" {
+		svc.RegisterLNURLRoutes(e)
+		svc.Logger.Infof("Serving lightning address %s", svc.LightningAddress())
+	}
+	svc.Logger.Infof("Connected to LND - alias %s", alias)
 
 	return lndService, nil
 }
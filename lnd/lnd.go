@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
 	"github.com/lightningnetwork/lnd/macaroons"
 	"google.golang.org/grpc"
@@ -33,6 +34,8 @@ type LNDoptions struct {
 type LNDWrapper struct {
 	client         lnrpc.LightningClient
 	routerClient   routerrpc.RouterClient
+	invoicesClient invoicesrpc.InvoicesClient
+	macaroon       *macaroon.Macaroon
 	IdentityPubkey string
 }
 
@@ -95,8 +98,10 @@ func NewLNDclient(lndOptions LNDoptions, ctx context.Context) (result *LNDWrappe
 	}
 	lnClient := lnrpc.NewLightningClient(conn)
 	return &LNDWrapper{
-		client:       lnClient,
-		routerClient: routerrpc.NewRouterClient(conn),
+		client:         lnClient,
+		routerClient:   routerrpc.NewRouterClient(conn),
+		invoicesClient: invoicesrpc.NewInvoicesClient(conn),
+		macaroon:       mac,
 	}, nil
 }
 
@@ -104,6 +109,10 @@ func (wrapper *LNDWrapper) ListChannels(ctx context.Context, req *lnrpc.ListChan
 	return wrapper.client.ListChannels(ctx, req, options...)
 }
 
+func (wrapper *LNDWrapper) PendingChannels(ctx context.Context, req *lnrpc.PendingChannelsRequest, options ...grpc.CallOption) (*lnrpc.PendingChannelsResponse, error) {
+	return wrapper.client.PendingChannels(ctx, req, options...)
+}
+
 func (wrapper *LNDWrapper) SendPaymentSync(ctx context.Context, req *lnrpc.SendRequest, options ...grpc.CallOption) (*lnrpc.SendResponse, error) {
 	return wrapper.client.SendPaymentSync(ctx, req, options...)
 }
@@ -132,10 +141,42 @@ func (wrapper *LNDWrapper) LookupInvoice(ctx context.Context, req *lnrpc.Payment
 	return wrapper.client.LookupInvoice(ctx, req, options...)
 }
 
+func (wrapper *LNDWrapper) AddHoldInvoice(ctx context.Context, req *invoicesrpc.AddHoldInvoiceRequest, options ...grpc.CallOption) (*invoicesrpc.AddHoldInvoiceResp, error) {
+	return wrapper.invoicesClient.AddHoldInvoice(ctx, req, options...)
+}
+
+func (wrapper *LNDWrapper) SettleInvoice(ctx context.Context, req *invoicesrpc.SettleInvoiceMsg, options ...grpc.CallOption) (*invoicesrpc.SettleInvoiceResp, error) {
+	return wrapper.invoicesClient.SettleInvoice(ctx, req, options...)
+}
+
+func (wrapper *LNDWrapper) CancelInvoice(ctx context.Context, req *invoicesrpc.CancelInvoiceMsg, options ...grpc.CallOption) (*invoicesrpc.CancelInvoiceResp, error) {
+	return wrapper.invoicesClient.CancelInvoice(ctx, req, options...)
+}
+
 func (wrapper *LNDWrapper) GetInfo(ctx context.Context, req *lnrpc.GetInfoRequest, options ...grpc.CallOption) (*lnrpc.GetInfoResponse, error) {
 	return wrapper.client.GetInfo(ctx, req, options...)
 }
 
+func (wrapper *LNDWrapper) WalletBalance(ctx context.Context, req *lnrpc.WalletBalanceRequest, options ...grpc.CallOption) (*lnrpc.WalletBalanceResponse, error) {
+	return wrapper.client.WalletBalance(ctx, req, options...)
+}
+
+func (wrapper *LNDWrapper) NewAddress(ctx context.Context, req *lnrpc.NewAddressRequest, options ...grpc.CallOption) (*lnrpc.NewAddressResponse, error) {
+	return wrapper.client.NewAddress(ctx, req, options...)
+}
+
+func (wrapper *LNDWrapper) SendCoins(ctx context.Context, req *lnrpc.SendCoinsRequest, options ...grpc.CallOption) (*lnrpc.SendCoinsResponse, error) {
+	return wrapper.client.SendCoins(ctx, req, options...)
+}
+
+func (wrapper *LNDWrapper) SignMessage(ctx context.Context, req *lnrpc.SignMessageRequest, options ...grpc.CallOption) (*lnrpc.SignMessageResponse, error) {
+	return wrapper.client.SignMessage(ctx, req, options...)
+}
+
+func (wrapper *LNDWrapper) VerifyMessage(ctx context.Context, req *lnrpc.VerifyMessageRequest, options ...grpc.CallOption) (*lnrpc.VerifyMessageResponse, error) {
+	return wrapper.client.VerifyMessage(ctx, req, options...)
+}
+
 func (wrapper *LNDWrapper) DecodeBolt11(ctx context.Context, bolt11 string, options ...grpc.CallOption) (*lnrpc.PayReq, error) {
 	return wrapper.client.DecodePayReq(ctx, &lnrpc.PayReqString{
 		PayReq: bolt11,
@@ -0,0 +1,51 @@
+package lnd
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ParseLNDConnectUri parses a lndconnect://host:port?cert=...&macaroon=... URI into connection options.
+// The cert (DER) and the macaroon are base64url encoded, the cert is left out for nodes with a CA signed certificate.
+func ParseLNDConnectUri(uri string) (options LNDoptions, err error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return options, err
+	}
+	if parsed.Scheme != "lndconnect" {
+		return options, errors.New("the LND connect URI has to start with lndconnect://")
+	}
+	if parsed.Host == "" {
+		return options, errors.New("the LND connect URI has no host")
+	}
+	options.Address = parsed.Host
+
+	macaroonParam := parsed.Query().Get("macaroon")
+	if macaroonParam == "" {
+		return options, errors.New("the LND connect URI has no macaroon")
+	}
+	macaroonBytes, err := decodeBase64Url(macaroonParam)
+	if err != nil {
+		return options, errors.New("invalid macaroon in the LND connect URI")
+	}
+	options.MacaroonHex = hex.EncodeToString(macaroonBytes)
+
+	if certParam := parsed.Query().Get("cert"); certParam != "" {
+		certBytes, err := decodeBase64Url(certParam)
+		if err != nil {
+			return options, errors.New("invalid cert in the LND connect URI")
+		}
+		// CertHex is the hex of the PEM file
+		options.CertHex = hex.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}))
+	}
+	return options, nil
+}
+
+// decodeBase64Url decodes base64url with or without padding, as both are found in the wild
+func decodeBase64Url(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
@@ -0,0 +1,78 @@
+package lnd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/macaroon.v2"
+)
+
+// version of the macaroon ids issued by LND (bakery.LatestVersion)
+const macaroonIdVersion = 3
+
+// RPC_PERMISSIONS are the permissions LND requires for the RPCs used by this service
+var RPC_PERMISSIONS = map[string]string{
+	"/lnrpc.Lightning/GetInfo":             "info:read",
+	"/lnrpc.Lightning/ChannelBalance":      "offchain:read",
+	"/lnrpc.Lightning/ListChannels":        "offchain:read",
+	"/lnrpc.Lightning/PendingChannels":     "offchain:read",
+	"/lnrpc.Lightning/ListPayments":        "offchain:read",
+	"/lnrpc.Lightning/DecodePayReq":        "offchain:read",
+	"/lnrpc.Lightning/SendPaymentSync":     "offchain:write",
+	"/lnrpc.Lightning/WalletBalance":       "onchain:read",
+	"/lnrpc.Lightning/SendCoins":           "onchain:write",
+	"/lnrpc.Lightning/NewAddress":          "address:write",
+	"/lnrpc.Lightning/AddInvoice":          "invoices:write",
+	"/lnrpc.Lightning/LookupInvoice":       "invoices:read",
+	"/lnrpc.Lightning/ListInvoices":        "invoices:read",
+	"/lnrpc.Lightning/SubscribeInvoices":   "invoices:read",
+	"/lnrpc.Lightning/SignMessage":         "message:write",
+	"/lnrpc.Lightning/VerifyMessage":       "message:read",
+	"/invoicesrpc.Invoices/AddHoldInvoice": "invoices:write",
+	"/invoicesrpc.Invoices/SettleInvoice":  "invoices:write",
+	"/invoicesrpc.Invoices/CancelInvoice":  "invoices:write",
+	"/routerrpc.Router/TrackPaymentV2":     "offchain:read",
+}
+
+// MacaroonPermissions are the permissions granted by a macaroon as entity:action,
+// custom macaroons can grant single RPCs as uri:<full method>
+type MacaroonPermissions map[string]bool
+
+// DecodeMacaroonPermissions reads the permissions from the id of a macaroon, like lncli printmacaroon does
+func DecodeMacaroonPermissions(mac *macaroon.Macaroon) (MacaroonPermissions, error) {
+	rawId := mac.Id()
+	if len(rawId) == 0 {
+		return nil, errors.New("macaroon has no id")
+	}
+	if rawId[0] != macaroonIdVersion {
+		return nil, fmt.Errorf("unsupported macaroon version: %d", rawId[0])
+	}
+	decodedId := &lnrpc.MacaroonId{}
+	err := proto.Unmarshal(rawId[1:], decodedId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode macaroon id: %v", err)
+	}
+	permissions := MacaroonPermissions{}
+	for _, op := range decodedId.Ops {
+		for _, action := range op.Actions {
+			permissions[op.Entity+":"+action] = true
+		}
+	}
+	return permissions, nil
+}
+
+// Allows returns whether the macaroon may call an RPC
+func (permissions MacaroonPermissions) Allows(rpc string) bool {
+	if permissions["uri:"+rpc] {
+		return true
+	}
+	permission, ok := RPC_PERMISSIONS[rpc]
+	return ok && permissions[permission]
+}
+
+// Permissions returns the permissions of the macaroon the client was created with
+func (wrapper *LNDWrapper) Permissions() (MacaroonPermissions, error) {
+	return DecodeMacaroonPermissions(wrapper.macaroon)
+}
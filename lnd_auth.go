@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+const (
+	LND_USER_IDENTIFIER = "lnd"
+	MIN_PASSWORD_LENGTH = 8
+	TOTP_PERIOD         = 30 // seconds
+	TOTP_ISSUER         = "Nostr Wallet Connect"
+	// login and setup attempts per minute and client IP
+	LOGIN_RATE_LIMIT = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RegisterLNDAuthRoutes registers the login of the single user in self-hosted LND mode.
+// Until a password is set, the setup requires a one-time token that is only written to the log,
+// so nobody else who can reach the port can claim the wallet.
+func (svc *Service) RegisterLNDAuthRoutes(e *echo.Echo, user *User) (err error) {
+	svc.loginLimiter = newLoginLimiter(perMinute(LOGIN_RATE_LIMIT), LOGIN_RATE_LIMIT)
+	if user.PasswordHash == "" {
+		token := make([]byte, 16)
+		_, err = rand.Read(token)
+		if err != nil {
+			return err
+		}
+		svc.lndSetupToken = hex.EncodeToString(token)
+		svc.Logger.Warnf("No password set for the web UI yet. Open /lnd/setup and enter the setup token %s", svc.lndSetupToken)
+	}
+
+	e.GET("/lnd/auth", svc.LNDLoginHandler)
+	e.POST("/lnd/auth", svc.LNDLoginSubmitHandler)
+	e.GET("/lnd/setup", svc.LNDSetupHandler)
+	e.POST("/lnd/setup", svc.LNDSetupSubmitHandler)
+	e.GET("/lnd/totp", svc.LNDTotpHandler, svc.requireUser, noStore)
+	e.POST("/lnd/totp", svc.LNDTotpEnableHandler, svc.requireUser)
+	e.POST("/lnd/totp/disable", svc.LNDTotpDisableHandler, svc.requireUser)
+	return nil
+}
+
+// newLoginLimiter limits the attempts per client IP, so a brute-forcing attacker can't lock out the owner
+func newLoginLimiter(limit rate.Limit, burst int) middleware.RateLimiterStore {
+	return middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:      limit,
+		Burst:     burst,
+		ExpiresIn: time.Minute,
+	})
+}
+
+// allowLogin reports whether the client may make another login or setup attempt
+func (svc *Service) allowLogin(c echo.Context) bool {
+	allowed, err := svc.loginLimiter.Allow(c.RealIP())
+	return err == nil && allowed
+}
+
+func (svc *Service) getLNDUser() (user *User, err error) {
+	user = &User{}
+	err = svc.db.First(user, &User{AlbyIdentifier: LND_USER_IDENTIFIER}).Error
+	return user, err
+}
+
+func (svc *Service) LNDLoginHandler(c echo.Context) error {
+	user, err := svc.getLNDUser()
+	if err != nil {
+		return err
+	}
+	if user.PasswordHash == "" {
+		return c.Redirect(302, "/lnd/setup")
+	}
+	sessionUser, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if sessionUser != nil {
+		return c.Redirect(302, "/")
+	}
+	return svc.renderLNDLogin(c, http.StatusOK, user, "")
+}
+
+func (svc *Service) renderLNDLogin(c echo.Context, status int, user *User, message string) error {
+	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	return c.Render(status, "lnd/login.html", map[string]interface{}{
+		"Csrf":  csrf,
+		"Totp":  user.TotpSecret != "",
+		"Error": message,
+	})
+}
+
+func (svc *Service) LNDLoginSubmitHandler(c echo.Context) error {
+	user, err := svc.getLNDUser()
+	if err != nil {
+		return err
+	}
+	if user.PasswordHash == "" {
+		return c.Redirect(302, "/lnd/setup")
+	}
+	if !svc.allowLogin(c) {
+		svc.Logger.WithField("ip", c.RealIP()).Warn("Login rate limited")
+		return svc.renderLNDLogin(c, http.StatusTooManyRequests, user, "Too many login attempts, please try again in a minute.")
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(c.FormValue("password")))
+	if err != nil {
+		svc.Logger.WithField("ip", c.RealIP()).Warn("Login with wrong password")
+		svc.auditRequest(c, user.ID, 0, AUDIT_LOGIN_FAILED, map[string]interface{}{"reason": "wrong password"})
+		return svc.renderLNDLogin(c, http.StatusUnauthorized, user, "Wrong password or code.")
+	}
+	if user.TotpSecret != "" {
+		valid, err := svc.useTotpCode(user, c.FormValue("totp"))
+		if err != nil {
+			return err
+		}
+		if !valid {
+			svc.Logger.WithField("ip", c.RealIP()).Warn("Login with wrong TOTP code")
+			svc.auditRequest(c, user.ID, 0, AUDIT_LOGIN_FAILED, map[string]interface{}{"reason": "wrong code"})
+			return svc.renderLNDLogin(c, http.StatusUnauthorized, user, "Wrong password or code.")
+		}
+	}
+
+	setSessionUser(c, svc.cfg, user.ID)
+	svc.auditRequest(c, user.ID, 0, AUDIT_LOGIN, map[string]interface{}{"method": "password", "totp": user.TotpSecret != ""})
+	// the index redirects to the page that required the login
+	return c.Redirect(302, "/")
+}
+
+func (svc *Service) LNDSetupHandler(c echo.Context) error {
+	user, err := svc.getLNDUser()
+	if err != nil {
+		return err
+	}
+	if user.PasswordHash != "" {
+		return c.Redirect(302, "/lnd/auth")
+	}
+	return svc.renderLNDSetup(c, http.StatusOK, "")
+}
+
+func (svc *Service) renderLNDSetup(c echo.Context, status int, message string) error {
+	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	return c.Render(status, "lnd/setup.html", map[string]interface{}{
+		"Csrf":              csrf,
+		"MinPasswordLength": MIN_PASSWORD_LENGTH,
+		"Error":             message,
+	})
+}
+
+func (svc *Service) LNDSetupSubmitHandler(c echo.Context) error {
+	user, err := svc.getLNDUser()
+	if err != nil {
+		return err
+	}
+	if user.PasswordHash != "" {
+		return c.Redirect(302, "/lnd/auth")
+	}
+	if !svc.allowLogin(c) {
+		return svc.renderLNDSetup(c, http.StatusTooManyRequests, "Too many attempts, please try again in a minute.")
+	}
+	if svc.lndSetupToken == "" || subtle.ConstantTimeCompare([]byte(c.FormValue("token")), []byte(svc.lndSetupToken)) != 1 {
+		svc.Logger.WithField("ip", c.RealIP()).Warn("Setup with wrong token")
+		return svc.renderLNDSetup(c, http.StatusUnauthorized, "Wrong setup token, it can be found in the log of the service.")
+	}
+	password := c.FormValue("password")
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return svc.renderLNDSetup(c, http.StatusBadRequest, fmt.Sprintf("The password needs at least %d characters.", MIN_PASSWORD_LENGTH))
+	}
+	if password != c.FormValue("password_confirmation") {
+		return svc.renderLNDSetup(c, http.StatusBadRequest, "The passwords do not match.")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	// only the first of concurrent setups wins
+	result := svc.db.Model(&User{}).Where("id = ? AND (password_hash = '' OR password_hash IS NULL)", user.ID).Update("password_hash", string(hash))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return c.Redirect(302, "/lnd/auth")
+	}
+	svc.lndSetupToken = ""
+	svc.Logger.Info("Password for the web UI set")
+	svc.auditRequest(c, user.ID, 0, AUDIT_PASSWORD_SET, nil)
+
+	setSessionUser(c, svc.cfg, user.ID)
+	return c.Redirect(302, "/")
+}
+
+func (svc *Service) LNDTotpHandler(c echo.Context) error {
+	csrf, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user.TotpSecret != "" {
+		return c.Render(http.StatusOK, "lnd/totp.html", map[string]interface{}{
+			"User":    user,
+			"Csrf":    csrf,
+			"Enabled": true,
+			"Error":   c.QueryParam("error"),
+		})
+	}
+
+	// the secret is only stored after the user confirmed a code
+	secret, err := generateTotpSecret()
+	if err != nil {
+		return err
+	}
+	sess, _ := session.Get(CookieName, c)
+	sess.Values["totp_secret"] = secret
+	sess.Save(c.Request(), c.Response())
+
+	return c.Render(http.StatusOK, "lnd/totp.html", map[string]interface{}{
+		"User":    user,
+		"Csrf":    csrf,
+		"Secret":  secret,
+		"TotpUri": totpUri(secret),
+		"Error":   c.QueryParam("error"),
+	})
+}
+
+func (svc *Service) LNDTotpEnableHandler(c echo.Context) error {
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	sess, _ := session.Get(CookieName, c)
+	secret, _ := sess.Values["totp_secret"].(string)
+	if secret == "" {
+		return c.Redirect(302, "/lnd/totp?error=1")
+	}
+	step, valid := validateTotp(secret, c.FormValue("totp"), time.Now(), 0)
+	if !valid {
+		return c.Redirect(302, "/lnd/totp?error=1")
+	}
+	encryptedSecret, err := svc.secrets.Encrypt(secret)
+	if err != nil {
+		return err
+	}
+	// the confirmation code can't be used to log in
+	err = svc.db.Model(user).Updates(map[string]interface{}{
+		"totp_secret":    encryptedSecret,
+		"totp_last_step": step,
+	}).Error
+	if err != nil {
+		return err
+	}
+	delete(sess.Values, "totp_secret")
+	sess.Save(c.Request(), c.Response())
+	svc.Logger.Info("Two-factor login enabled")
+	svc.auditRequest(c, user.ID, 0, AUDIT_TOTP_ENABLED, nil)
+	return c.Redirect(302, "/lnd/totp")
+}
+
+func (svc *Service) LNDTotpDisableHandler(c echo.Context) error {
+	user, err := svc.GetUser(c)
+	if err != nil {
+		return err
+	}
+	if user.TotpSecret == "" {
+		return c.Redirect(302, "/lnd/totp")
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(c.FormValue("password")))
+	if err != nil {
+		return c.Redirect(302, "/lnd/totp?error=1")
+	}
+	// a stolen session alone can't turn off the second factor
+	valid, err := svc.useTotpCode(user, c.FormValue("totp"))
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return c.Redirect(302, "/lnd/totp?error=1")
+	}
+	err = svc.db.Model(user).Update("totp_secret", "").Error
+	if err != nil {
+		return err
+	}
+	svc.Logger.Info("Two-factor login disabled")
+	svc.auditRequest(c, user.ID, 0, AUDIT_TOTP_DISABLED, nil)
+	return c.Redirect(302, "/lnd/totp")
+}
+
+func generateTotpSecret() (secret string, err error) {
+	key := make([]byte, 20)
+	_, err = rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+func totpUri(secret string) string {
+	return fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=%s", url.PathEscape(TOTP_ISSUER), secret, url.QueryEscape(TOTP_ISSUER))
+}
+
+// totpCode returns the 6 digit RFC 6238 code with HMAC-SHA1 for the time step
+func totpCode(secret string, step uint64) (code string, err error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000), nil
+}
+
+// validateTotp accepts the codes of the previous, current and next time step to allow for clock drift,
+// as long as the step is after the last one used. It returns the time step of the code
+func validateTotp(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != 6 {
+		return 0, false
+	}
+	step := now.Unix() / TOTP_PERIOD
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if s <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, uint64(s))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// useTotpCode checks the code of the user and records its time step, so every code is accepted only once
+func (svc *Service) useTotpCode(user *User, code string) (bool, error) {
+	secret, err := svc.secrets.Decrypt(user.TotpSecret)
+	if err != nil {
+		return false, err
+	}
+	step, valid := validateTotp(secret, code, time.Now(), user.TotpLastStep)
+	if !valid {
+		return false, nil
+	}
+	// concurrent requests with the same code can't both use it
+	result := svc.db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	user.TotpLastStep = step
+	return result.RowsAffected == 1, nil
+}
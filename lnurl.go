@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LNURL_MIN_SENDABLE    = 1000         // msat
+	LNURL_MAX_SENDABLE    = 100000000000 // msat
+	LNURL_COMMENT_ALLOWED = 255
+	// invoices per minute and IP, each invoice of a zap is watched until it is settled or expires
+	LNURL_CALLBACK_RATE_LIMIT = 30
+	LNURL_INVOICE_EXPIRY      = 600 // seconds
+)
+
+// LNURL-pay response (LUD-06, LUD-12 and NIP-57)
+type LNURLPayResponse struct {
+	Tag            string `json:"tag"`
+	Callback       string `json:"callback"`
+	MinSendable    int64  `json:"minSendable"`
+	MaxSendable    int64  `json:"maxSendable"`
+	Metadata       string `json:"metadata"`
+	CommentAllowed int    `json:"commentAllowed"`
+	AllowsNostr    bool   `json:"allowsNostr"`
+	NostrPubkey    string `json:"nostrPubkey"`
+}
+
+type LNURLCallbackResponse struct {
+	Pr            string          `json:"pr"`
+	Routes        []string        `json:"routes"`
+	SuccessAction json.RawMessage `json:"successAction,omitempty"`
+}
+
+type LNURLErrorResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// LightningAddress returns the lightning address served by this instance,
+// or an empty string if the LNURL-pay server is not configured
+func (svc *Service) LightningAddress() string {
+	if svc.cfg.LNURLBaseUrl == "" || svc.cfg.LNURLUsername == "" {
+		return ""
+	}
+	baseUrl, err := url.Parse(svc.cfg.LNURLBaseUrl)
+	if err != nil || baseUrl.Host == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s@%s", strings.ToLower(svc.cfg.LNURLUsername), baseUrl.Host)
+}
+
+func (svc *Service) RegisterLNURLRoutes(e *echo.Echo) {
+	// wallets running in the browser request these directly
+	e.GET("/.well-known/lnurlp/:username", svc.LNURLPayHandler, middleware.CORS())
+	e.GET("/lnurlp/:username/callback", svc.LNURLPayCallbackHandler, middleware.CORS(), lnurlCallbackRateLimit())
+}
+
+func lnurlCallbackRateLimit() echo.MiddlewareFunc {
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      perMinute(LNURL_CALLBACK_RATE_LIMIT),
+			Burst:     LNURL_CALLBACK_RATE_LIMIT,
+			ExpiresIn: time.Minute,
+		}),
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			return lnurlError(c, http.StatusTooManyRequests, "Too many requests, try again later")
+		},
+	})
+}
+
+func (svc *Service) lnurlMetadata() string {
+	metadata, _ := json.Marshal([][]string{
+		{"text/plain", fmt.Sprintf("Sats for %s", svc.LightningAddress())},
+		{"text/identifier", svc.LightningAddress()},
+	})
+	return string(metadata)
+}
+
+func (svc *Service) isLNURLUser(username string) bool {
+	return svc.LightningAddress() != "" && strings.EqualFold(username, svc.cfg.LNURLUsername)
+}
+
+func lnurlError(c echo.Context, status int, reason string) error {
+	return c.JSON(status, LNURLErrorResponse{
+		Status: "ERROR",
+		Reason: reason,
+	})
+}
+
+func (svc *Service) LNURLPayHandler(c echo.Context) error {
+	if !svc.isLNURLUser(c.Param("username")) {
+		return lnurlError(c, http.StatusNotFound, "User not found")
+	}
+	return c.JSON(http.StatusOK, LNURLPayResponse{
+		Tag:            "payRequest",
+		Callback:       fmt.Sprintf("%s/lnurlp/%s/callback", strings.TrimSuffix(svc.cfg.LNURLBaseUrl, "/"), strings.ToLower(svc.cfg.LNURLUsername)),
+		MinSendable:    LNURL_MIN_SENDABLE,
+		MaxSendable:    LNURL_MAX_SENDABLE,
+		Metadata:       svc.lnurlMetadata(),
+		CommentAllowed: LNURL_COMMENT_ALLOWED,
+		AllowsNostr:    true,
+		NostrPubkey:    svc.activeIdentity().pubkey,
+	})
+}
+
+func (svc *Service) LNURLPayCallbackHandler(c echo.Context) error {
+	if !svc.isLNURLUser(c.Param("username")) {
+		return lnurlError(c, http.StatusNotFound, "User not found")
+	}
+
+	amount, err := strconv.ParseInt(c.QueryParam("amount"), 10, 64)
+	if err != nil || amount < LNURL_MIN_SENDABLE || amount > LNURL_MAX_SENDABLE {
+		return lnurlError(c, http.StatusBadRequest, fmt.Sprintf("Amount must be between %d and %d msat", LNURL_MIN_SENDABLE, LNURL_MAX_SENDABLE))
+	}
+	comment := c.QueryParam("comment")
+	if utf8.RuneCountInString(comment) > LNURL_COMMENT_ALLOWED {
+		return lnurlError(c, http.StatusBadRequest, fmt.Sprintf("Comment must not be longer than %d characters", LNURL_COMMENT_ALLOWED))
+	}
+
+	// the invoice commits to the metadata, or to the zap request for zaps
+	description := svc.lnurlMetadata()
+	zapRequestJson := c.QueryParam("nostr")
+	if zapRequestJson != "" {
+		zapRequest, err := parseZapRequest(zapRequestJson, amount)
+		if err == nil && zapRequest == nil {
+			err = errors.New("Not a zap request")
+		}
+		if err != nil {
+			return lnurlError(c, http.StatusBadRequest, fmt.Sprintf("Invalid zap request: %s", err.Error()))
+		}
+		description = zapRequestJson
+	}
+	hash := sha256.Sum256([]byte(description))
+
+	transaction, err := svc.lnClient.MakeInvoice(c.Request().Context(), "", amount, "", hex.EncodeToString(hash[:]), LNURL_INVOICE_EXPIRY)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"amount": amount,
+		}).Errorf("Failed to make LNURL invoice: %v", err)
+		return lnurlError(c, http.StatusInternalServerError, "Failed to create invoice")
+	}
+
+	if comment != "" {
+		err = svc.db.Create(&LightningAddressComment{PaymentHash: transaction.PaymentHash, Comment: comment}).Error
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"paymentHash": transaction.PaymentHash,
+			}).Errorf("Failed to save comment: %v", err)
+		}
+	}
+
+	if zapRequestJson != "" {
+		err = svc.watchZap(nil, transaction, zapRequestJson, svc.activeIdentity().pubkey)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"paymentHash": transaction.PaymentHash,
+			}).Errorf("Failed to save zap: %v", err)
+		}
+	}
+
+	svc.Logger.WithFields(logrus.Fields{
+		"amount":      amount,
+		"paymentHash": transaction.PaymentHash,
+		"zap":         zapRequestJson != "",
+	}).Info("Created LNURL invoice")
+
+	return c.JSON(http.StatusOK, LNURLCallbackResponse{
+		Pr:     transaction.Invoice,
+		Routes: []string{},
+	})
+}
+
+// addLightningAddressComments returns the transactions with the comments that were sent along with payments to the lightning address
+func (svc *Service) addLightningAddressComments(transactions []Nip47Transaction) []Nip47Transaction {
+	paymentHashes := []string{}
+	for _, transaction := range transactions {
+		if transaction.Type == "incoming" {
+			paymentHashes = append(paymentHashes, transaction.PaymentHash)
+		}
+	}
+	if len(paymentHashes) == 0 {
+		return transactions
+	}
+	comments := []LightningAddressComment{}
+	err := svc.db.Where("payment_hash IN ?", paymentHashes).Find(&comments).Error
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to load lightning address comments")
+		return transactions
+	}
+	if len(comments) == 0 {
+		return transactions
+	}
+	commentsByHash := map[string]string{}
+	for _, comment := range comments {
+		commentsByHash[comment.PaymentHash] = comment.Comment
+	}
+	// the transactions of the LN backend are not modified
+	withComments := make([]Nip47Transaction, len(transactions))
+	for i, transaction := range transactions {
+		if transaction.Type == "incoming" {
+			transaction.Comment = commentsByHash[transaction.PaymentHash]
+		}
+		withComments[i] = transaction
+	}
+	return withComments
+}
+
+// used to talk to LNURL services of other wallets. Apps choose the URL, so the client
+// refuses to connect to the host and its private network, also after redirects
+var lnurlHttpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: refusePrivateAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// refusePrivateAddress is checked on the resolved address of every connection
+func refusePrivateAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("LNURL service address is not public: %s", host)
+	}
+	return nil
+}
+
+// resolveLNURL returns the LNURL-pay URL of a lightning address, bech32 encoded LNURL or lnurlp:// URL
+func resolveLNURL(lnurl string) (*url.URL, error) {
+	lnurl = strings.TrimPrefix(strings.TrimSpace(lnurl), "lightning:")
+	var rawUrl string
+	switch {
+	case strings.Contains(lnurl, "@"):
+		username, domain, _ := strings.Cut(strings.ToLower(lnurl), "@")
+		if username == "" || domain == "" {
+			return nil, errors.New("Invalid lightning address")
+		}
+		rawUrl = fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, username)
+	case strings.HasPrefix(strings.ToLower(lnurl), "lnurl1"):
+		hrp, data, err := bech32.DecodeNoLimit(strings.ToLower(lnurl))
+		if err != nil || hrp != "lnurl" {
+			return nil, errors.New("Invalid LNURL")
+		}
+		decoded, err := bech32.ConvertBits(data, 5, 8, false)
+		if err != nil {
+			return nil, errors.New("Invalid LNURL")
+		}
+		rawUrl = string(decoded)
+	case strings.HasPrefix(lnurl, "lnurlp://"):
+		rawUrl = "https://" + strings.TrimPrefix(lnurl, "lnurlp://")
+	default:
+		rawUrl = lnurl
+	}
+	return parseLNURLServiceUrl(rawUrl)
+}
+
+// parseLNURLServiceUrl only accepts https URLs, or http for onion services (LUD-01)
+func parseLNURLServiceUrl(rawUrl string) (*url.URL, error) {
+	serviceUrl, err := url.Parse(rawUrl)
+	if err != nil || serviceUrl.Host == "" {
+		return nil, fmt.Errorf("Invalid LNURL service URL: %s", rawUrl)
+	}
+	onion := strings.HasSuffix(serviceUrl.Hostname(), ".onion")
+	if serviceUrl.Scheme != "https" && !(onion && serviceUrl.Scheme == "http") {
+		return nil, fmt.Errorf("LNURL service URL must use https: %s", rawUrl)
+	}
+	return serviceUrl, nil
+}
+
+func fetchLNURL(ctx context.Context, serviceUrl *url.URL, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serviceUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := lnurlHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	lnurlErr := LNURLErrorResponse{}
+	if json.Unmarshal(body, &lnurlErr) == nil && strings.EqualFold(lnurlErr.Status, "ERROR") {
+		return fmt.Errorf("LNURL service error: %s", lnurlErr.Reason)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("LNURL service responded with status %d", resp.StatusCode)
+	}
+	return json.Unmarshal(body, result)
+}
+
+// FetchLNURLInvoice performs the LNURL-pay handshake (LUD-06, LUD-12) and returns the invoice
+// after verifying that it is for the requested amount and commits to the metadata of the LNURL service
+func FetchLNURLInvoice(ctx context.Context, lnurl string, amount int64, comment string) (bolt11 string, successAction json.RawMessage, err error) {
+	serviceUrl, err := resolveLNURL(lnurl)
+	if err != nil {
+		return "", nil, err
+	}
+	payParams := LNURLPayResponse{}
+	err = fetchLNURL(ctx, serviceUrl, &payParams)
+	if err != nil {
+		return "", nil, err
+	}
+	if payParams.Tag != "payRequest" {
+		return "", nil, errors.New("Not an LNURL-pay service")
+	}
+	if amount < payParams.MinSendable || amount > payParams.MaxSendable {
+		return "", nil, fmt.Errorf("Amount must be between %d and %d msat", payParams.MinSendable, payParams.MaxSendable)
+	}
+	if utf8.RuneCountInString(comment) > payParams.CommentAllowed {
+		return "", nil, fmt.Errorf("Comment must not be longer than %d characters", payParams.CommentAllowed)
+	}
+
+	callbackUrl, err := parseLNURLServiceUrl(payParams.Callback)
+	if err != nil {
+		return "", nil, err
+	}
+	query := callbackUrl.Query()
+	query.Set("amount", strconv.FormatInt(amount, 10))
+	if comment != "" {
+		query.Set("comment", comment)
+	}
+	callbackUrl.RawQuery = query.Encode()
+	callbackResponse := LNURLCallbackResponse{}
+	err = fetchLNURL(ctx, callbackUrl, &callbackResponse)
+	if err != nil {
+		return "", nil, err
+	}
+
+	paymentRequest, err := decodepay.Decodepay(strings.ToLower(callbackResponse.Pr))
+	if err != nil {
+		return "", nil, fmt.Errorf("LNURL service returned an invalid invoice: %s", err.Error())
+	}
+	if paymentRequest.MSatoshi != amount {
+		return "", nil, errors.New("LNURL service returned an invoice for a different amount")
+	}
+	metadataHash := sha256.Sum256([]byte(payParams.Metadata))
+	if paymentRequest.DescriptionHash != hex.EncodeToString(metadataHash[:]) {
+		return "", nil, errors.New("LNURL service returned an invoice that does not commit to its metadata")
+	}
+	return callbackResponse.Pr, callbackResponse.SuccessAction, nil
+}
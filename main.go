@@ -86,7 +86,32 @@ func main() {
 	}
 	log.Println("Any pending migrations ran successfully")
 
-	if cfg.NostrSecretKey == "" {
+	secrets, err := NewSecretBox(db, cfg)
+	if err != nil {
+		log.Fatalf("Failed to unlock secrets: %v", err)
+	}
+	if secrets == nil {
+		log.Warn("No master key configured, secrets are stored in plaintext")
+	}
+	encryptedCount, err := secrets.EncryptStoredSecrets(db)
+	if err != nil {
+		log.Fatalf("Failed to encrypt stored secrets: %v", err)
+	}
+	if encryptedCount > 0 {
+		log.Infof("Encrypted %d rows with plaintext secrets", encryptedCount)
+	}
+
+	if cfg.NostrSignerUri != "" {
+		if cfg.NostrSecretKey != "" {
+			log.Fatal("NOSTR_PRIVKEY and NOSTR_SIGNER_URI can't be used together.")
+		}
+		if cfg.PerAppServiceKeys {
+			//the app keys are derived from the private key
+			log.Fatal("PER_APP_SERVICE_KEYS can't be used with a remote signer.")
+		}
+	}
+	identityStored := cfg.NostrSecretKey == "" && cfg.NostrSignerUri == ""
+	if identityStored {
 		if cfg.LNBackendType == AlbyBackendType {
 			//not allowed
 			log.Fatal("Nostr private key is required with this backend type.")
@@ -94,35 +119,81 @@ func main() {
 		//first look up if we already have the private key in the database
 		//else, generate and store private key
 		identity := &Identity{}
-		err = db.FirstOrInit(identity).Error
+		err = db.Where("retired_at IS NULL").FirstOrInit(identity).Error
 		if err != nil {
 			log.WithError(err).Fatal("Error retrieving private key from database")
 		}
 		if identity.Privkey == "" {
 			log.Info("No private key found in database, generating & saving.")
-			identity.Privkey = nostr.GeneratePrivateKey()
+			identity.Privkey, err = secrets.Encrypt(nostr.GeneratePrivateKey())
+			if err != nil {
+				log.WithError(err).Fatal("Error encrypting private key")
+			}
 			err = db.Save(identity).Error
 			if err != nil {
 				log.WithError(err).Fatal("Error saving private key to database")
 			}
 		}
-		cfg.NostrSecretKey = identity.Privkey
+		cfg.NostrSecretKey, err = secrets.Decrypt(identity.Privkey)
+		if err != nil {
+			log.WithError(err).Fatal("Error decrypting private key")
+		}
 	}
 
-	identityPubkey, err := nostr.GetPublicKey(cfg.NostrSecretKey)
-	if err != nil {
-		log.Fatalf("Error converting nostr privkey to pubkey: %v", err)
+	var signer Signer
+	if cfg.NostrSignerUri != "" {
+		log.Info("Connecting to the remote signer")
+		remoteSigner, err := ConnectNip46Signer(context.Background(), cfg.NostrSignerUri, cfg.NostrSignerClientKey, NIP_46_REQUEST_TIMEOUT)
+		if err != nil {
+			log.Fatalf("Failed to connect to the remote signer: %v", err)
+		}
+		defer remoteSigner.Close()
+		signer = remoteSigner
+		cfg.IdentityPubkey = remoteSigner.GetPublicKey()
+	} else {
+		identityPubkey, err := nostr.GetPublicKey(cfg.NostrSecretKey)
+		if err != nil {
+			log.Fatalf("Error converting nostr privkey to pubkey: %v", err)
+		}
+		cfg.IdentityPubkey = identityPubkey
 	}
-	cfg.IdentityPubkey = identityPubkey
+	identityPubkey := cfg.IdentityPubkey
 	npub, err := nip19.EncodePublicKey(identityPubkey)
 	if err != nil {
 		log.Fatalf("Error converting nostr privkey to pubkey: %v", err)
 	}
 
 	log.Infof("Starting nostr-wallet-connect. npub: %s hex: %s", npub, identityPubkey)
+	rateLimiter, err := NewRateLimiter(cfg)
+	if err != nil {
+		log.Fatalf("Invalid rate limit config: %v", err)
+	}
+
+	rateProvider, err := NewRateProvider(cfg)
+	if err != nil {
+		log.Fatalf("Invalid fiat rates config: %v", err)
+	}
+
+	ipExtractor, err := newIPExtractor(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+
 	svc := &Service{
-		cfg: cfg,
-		db:  db,
+		cfg:            cfg,
+		db:             db,
+		rateLimiter:    rateLimiter,
+		rateProvider:   rateProvider,
+		secrets:        secrets,
+		identityStored: identityStored,
+		signer:         signer,
+	}
+	svc.setActiveIdentity(cfg.NostrSecretKey, cfg.IdentityPubkey)
+
+	// nobody is waiting for approvals from a previous run anymore
+	err = svc.ExpirePendingPaymentApprovals()
+	if err != nil {
+		log.WithError(err).Error("Failed to expire pending payment approvals")
 	}
 
 	if os.Getenv("DATADOG_AGENT_URL") != "" {
@@ -137,6 +208,7 @@ func main() {
 	svc.Logger = echologrus.Logger
 
 	e := echo.New()
+	e.IPExtractor = ipExtractor
 	ctx := context.Background()
 	ctx, _ = signal.NotifyContext(ctx, os.Interrupt)
 	var wg sync.WaitGroup
@@ -147,13 +219,33 @@ func main() {
 			svc.Logger.Fatal(err)
 		}
 		svc.lnClient = lndClient
+		// invoices are only paid on the network of the node, which can't change while running
+		info, err := lndClient.GetInfo(ctx, "")
+		if err != nil {
+			svc.Logger.Warnf("Failed to fetch node network, invoices can't be paid: %v", err)
+		} else {
+			svc.network = info.Network
+		}
 	case AlbyBackendType:
 		oauthService, err := NewAlbyOauthService(svc, e)
 		if err != nil {
 			svc.Logger.Fatal(err)
 		}
 		svc.lnClient = oauthService
+		svc.network = "mainnet"
 	}
+	// announced in the info event and offered when creating apps
+	supportedMethods, err := svc.lnClient.GetSupportedMethods(ctx, nil)
+	if err != nil {
+		svc.Logger.Fatal(err)
+	}
+	svc.supportedMethods = supportedMethods
+	svc.Logger.Infof("Supported methods: %s", strings.Join(supportedMethods, " "))
+
+	// publish zap receipts for settled zap invoices
+	go svc.WatchZaps(ctx)
+	// notify apps about accepted hold invoices
+	go svc.WatchHoldInvoices(ctx)
 
 	//register shared routes
 	svc.RegisterSharedRoutes(e)
@@ -179,6 +271,7 @@ func main() {
 	if err != nil {
 		svc.Logger.Fatal(err)
 	}
+	svc.SetRelay(relay)
 
 	//publish event with NIP-47 info
 	err = svc.PublishNip47Info(ctx, relay)
@@ -202,6 +295,7 @@ func main() {
 			if err != nil {
 				svc.Logger.Fatal(err)
 			}
+			svc.SetRelay(relay)
 			continue
 		}
 		//err being nil means that the context was canceled and we should exit the program.
@@ -216,7 +310,7 @@ func main() {
 
 func (svc *Service) createFilters() nostr.Filters {
 	filter := nostr.Filter{
-		Tags:  nostr.TagMap{"p": []string{svc.cfg.IdentityPubkey}},
+		Tags:  nostr.TagMap{"p": svc.servicePubkeys()},
 		Kinds: []int{NIP_47_REQUEST_KIND},
 	}
 	if svc.cfg.ClientPubkey != "" {
@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add an approval threshold to app permissions and a table for payments waiting for the user's approval
+var _202402201200_add_payment_approvals = &gormigrate.Migration{
+	ID: "202402201200_add_payment_approvals",
+	Migrate: func(tx *gorm.DB) error {
+		type AppPermission struct {
+			ApprovalThreshold int
+		}
+		type App struct {
+			ID uint
+		}
+		type NostrEvent struct {
+			ID uint
+		}
+		type PaymentApproval struct {
+			ID             uint
+			AppId          uint
+			App            App `gorm:"constraint:OnDelete:CASCADE"`
+			NostrEventId   uint
+			NostrEvent     NostrEvent `gorm:"constraint:OnDelete:CASCADE"`
+			RequestMethod  string
+			Amount         uint
+			PaymentRequest string
+			Destination    string
+			State          string `gorm:"index"`
+			ExpiresAt      time.Time
+			CreatedAt      time.Time
+			UpdatedAt      time.Time
+		}
+
+		err := tx.Migrator().AddColumn(&AppPermission{}, "ApprovalThreshold")
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().CreateTable(&PaymentApproval{})
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add an account-wide budget to users
+var _202402211000_add_user_budget = &gormigrate.Migration{
+	ID: "202402211000_add_user_budget",
+	Migrate: func(tx *gorm.DB) error {
+		type User struct {
+			MaxAmount     int
+			BudgetRenewal string
+		}
+
+		err := tx.Migrator().AddColumn(&User{}, "MaxAmount")
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().AddColumn(&User{}, "BudgetRenewal")
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add the payment hash and state to payments so retried payments can be deduplicated
+var _202402221000_add_payment_hash = &gormigrate.Migration{
+	ID: "202402221000_add_payment_hash",
+	Migrate: func(tx *gorm.DB) error {
+		type Payment struct {
+			PaymentHash *string
+			State       string
+		}
+
+		err := tx.Migrator().AddColumn(&Payment{}, "PaymentHash")
+		if err != nil {
+			return err
+		}
+		err = tx.Migrator().AddColumn(&Payment{}, "State")
+		if err != nil {
+			return err
+		}
+		err = tx.Exec("UPDATE payments SET state = 'settled' WHERE preimage IS NOT NULL").Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec("UPDATE payments SET state = 'failed' WHERE preimage IS NULL").Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_app_id_payment_hash ON payments(app_id, payment_hash)").Error
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add zaps to track invoices created for NIP-57 zap requests
+var _202402231000_add_zaps = &gormigrate.Migration{
+	ID: "202402231000_add_zaps",
+	Migrate: func(tx *gorm.DB) error {
+		type App struct {
+			ID uint
+		}
+		type Zap struct {
+			ID          uint
+			AppId       uint `gorm:"index"`
+			App         App  `gorm:"constraint:OnDelete:CASCADE"`
+			PaymentHash string
+			Invoice     string
+			ZapRequest  string
+			ReceiptId   string
+			State       string `gorm:"index"`
+			ExpiresAt   *time.Time
+			CreatedAt   time.Time
+			UpdatedAt   time.Time
+		}
+
+		return tx.Migrator().CreateTable(&Zap{})
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
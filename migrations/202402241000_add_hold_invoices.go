@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add hold invoices to track hold invoices created by apps until they are settled or canceled
+var _202402241000_add_hold_invoices = &gormigrate.Migration{
+	ID: "202402241000_add_hold_invoices",
+	Migrate: func(tx *gorm.DB) error {
+		type App struct {
+			ID uint
+		}
+		type HoldInvoice struct {
+			ID          uint
+			AppId       uint `gorm:"index"`
+			App         App  `gorm:"constraint:OnDelete:CASCADE"`
+			PaymentHash string
+			Invoice     string
+			Amount      int64
+			State       string `gorm:"index"`
+			ExpiresAt   *time.Time
+			CreatedAt   time.Time
+			UpdatedAt   time.Time
+		}
+
+		return tx.Migrator().CreateTable(&HoldInvoice{})
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add on-chain payments to track the separate on-chain budget of apps
+var _202402251000_add_onchain_payments = &gormigrate.Migration{
+	ID: "202402251000_add_onchain_payments",
+	Migrate: func(tx *gorm.DB) error {
+		type App struct {
+			ID uint
+		}
+		type NostrEvent struct {
+			ID uint
+		}
+		type OnchainPayment struct {
+			ID           uint
+			AppId        uint       `gorm:"index"`
+			App          App        `gorm:"constraint:OnDelete:CASCADE"`
+			NostrEventId uint       `gorm:"index"`
+			NostrEvent   NostrEvent `gorm:"constraint:OnDelete:CASCADE"`
+			Address      string
+			Amount       uint
+			TxId         *string
+			State        string
+			CreatedAt    time.Time
+			UpdatedAt    time.Time
+		}
+
+		return tx.Migrator().CreateTable(&OnchainPayment{})
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,33 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add fiat budgets to app permissions and record the fiat amount of payments
+var _202402261000_add_fiat_budgets = &gormigrate.Migration{
+	ID: "202402261000_add_fiat_budgets",
+	Migrate: func(tx *gorm.DB) error {
+		type AppPermission struct {
+			BudgetCurrency string
+		}
+		type Payment struct {
+			FiatAmount   int64
+			FiatCurrency string
+		}
+
+		err := tx.Migrator().AddColumn(&AppPermission{}, "BudgetCurrency")
+		if err != nil {
+			return err
+		}
+		err = tx.Migrator().AddColumn(&Payment{}, "FiatAmount")
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().AddColumn(&Payment{}, "FiatCurrency")
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
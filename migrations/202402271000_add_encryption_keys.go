@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add the wrapped data key used to encrypt secrets at rest.
+// Existing secrets are encrypted at startup once a master key is configured.
+var _202402271000_add_encryption_keys = &gormigrate.Migration{
+	ID: "202402271000_add_encryption_keys",
+	Migrate: func(tx *gorm.DB) error {
+		type EncryptionKey struct {
+			gorm.Model
+			WrappedKey string
+			Salt       string
+		}
+
+		return tx.Migrator().CreateTable(&EncryptionKey{})
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add the password and optional TOTP secret for the web UI login in self-hosted LND mode
+var _202402281000_add_user_login = &gormigrate.Migration{
+	ID: "202402281000_add_user_login",
+	Migrate: func(tx *gorm.DB) error {
+		type User struct {
+			PasswordHash string
+			TotpSecret   string
+		}
+
+		err := tx.Migrator().AddColumn(&User{}, "PasswordHash")
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().AddColumn(&User{}, "TotpSecret")
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
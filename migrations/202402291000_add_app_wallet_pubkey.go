@@ -0,0 +1,25 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Add the service pubkey derived for apps that don't share the identity key
+var _202402291000_add_app_wallet_pubkey = &gormigrate.Migration{
+	ID: "202402291000_add_app_wallet_pubkey",
+	Migrate: func(tx *gorm.DB) error {
+		type App struct {
+			WalletPubkey string `gorm:"index"`
+		}
+
+		err := tx.Migrator().AddColumn(&App{}, "WalletPubkey")
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().CreateIndex(&App{}, "WalletPubkey")
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Record rotations of the identity key, retired keys are still answered until they expire
+var _202403011000_add_identity_rotation = &gormigrate.Migration{
+	ID: "202403011000_add_identity_rotation",
+	Migrate: func(tx *gorm.DB) error {
+		type Identity struct {
+			RetiredAt *time.Time
+			ExpiresAt *time.Time
+		}
+
+		err := tx.Migrator().AddColumn(&Identity{}, "RetiredAt")
+		if err != nil {
+			return err
+		}
+		return tx.Migrator().AddColumn(&Identity{}, "ExpiresAt")
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,29 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Append-only log of administrative and security relevant actions
+var _202403021000_add_audit_events = &gormigrate.Migration{
+	ID: "202403021000_add_audit_events",
+	Migrate: func(tx *gorm.DB) error {
+		type AuditEvent struct {
+			ID        uint
+			UserId    *uint  `gorm:"index"`
+			AppId     *uint  `gorm:"index"`
+			Action    string `gorm:"index"`
+			Details   string
+			IP        string
+			CreatedAt time.Time `gorm:"index"`
+		}
+
+		return tx.Migrator().CreateTable(&AuditEvent{})
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,26 @@
+package migrations
+
+import (
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Keep the comments of payments to the lightning address, they are not part of the invoice
+var _202403031000_add_lightning_address_comments = &gormigrate.Migration{
+	ID: "202403031000_add_lightning_address_comments",
+	Migrate: func(tx *gorm.DB) error {
+		type LightningAddressComment struct {
+			ID          uint
+			PaymentHash string `gorm:"index"`
+			Comment     string
+			CreatedAt   time.Time
+		}
+
+		return tx.Migrator().CreateTable(&LightningAddressComment{})
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,21 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Keep the OAuth scopes the user granted, they decide which methods the Alby backend can serve for the user
+var _202403041000_add_user_alby_scopes = &gormigrate.Migration{
+	ID: "202403041000_add_user_alby_scopes",
+	Migrate: func(tx *gorm.DB) error {
+		type User struct {
+			AlbyScopes string
+		}
+
+		return tx.Migrator().AddColumn(&User{}, "AlbyScopes")
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,27 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// pay_keysend, pay_lnurl and get_budget have their own permissions instead of the one of pay_invoice,
+// apps that could pay invoices keep them
+var _202403051000_add_payment_method_permissions = &gormigrate.Migration{
+	ID: "202403051000_add_payment_method_permissions",
+	Migrate: func(tx *gorm.DB) error {
+		for _, method := range []string{"pay_keysend", "pay_lnurl", "get_budget"} {
+			err := tx.Exec(`INSERT INTO app_permissions (app_id, request_method, expires_at, created_at, updated_at)
+				SELECT app_id, ?, expires_at, created_at, updated_at FROM app_permissions AS p
+				WHERE request_method = 'pay_invoice'
+				AND NOT EXISTS (SELECT 1 FROM app_permissions AS q WHERE q.app_id = p.app_id AND q.request_method = ?)`, method, method).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
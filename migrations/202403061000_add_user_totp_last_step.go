@@ -0,0 +1,21 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Keep the time step of the last TOTP code used to log in, so a code can't be used twice
+var _202403061000_add_user_totp_last_step = &gormigrate.Migration{
+	ID: "202403061000_add_user_totp_last_step",
+	Migrate: func(tx *gorm.DB) error {
+		type User struct {
+			TotpLastStep int64 `gorm:"not null;default:0"`
+		}
+
+		return tx.Migrator().AddColumn(&User{}, "TotpLastStep")
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
@@ -0,0 +1,21 @@
+package migrations
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+)
+
+// Keep the pubkey the LNURL service advertised for a zap, the receipt is signed with it after a key rotation
+var _202403071000_add_zap_signing_pubkey = &gormigrate.Migration{
+	ID: "202403071000_add_zap_signing_pubkey",
+	Migrate: func(tx *gorm.DB) error {
+		type Zap struct {
+			SigningPubkey string
+		}
+
+		return tx.Migrator().AddColumn(&Zap{}, "SigningPubkey")
+	},
+	Rollback: func(tx *gorm.DB) error {
+		return nil
+	},
+}
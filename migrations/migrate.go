@@ -12,6 +12,23 @@ func Migrate(db *gorm.DB) error {
 		_202309271617_fix_preimage_null,
 		_202309271618_add_payment_sum_index,
 		_202401092201_add_events_id_index,
+		_202402201200_add_payment_approvals,
+		_202402211000_add_user_budget,
+		_202402221000_add_payment_hash,
+		_202402231000_add_zaps,
+		_202402241000_add_hold_invoices,
+		_202402251000_add_onchain_payments,
+		_202402261000_add_fiat_budgets,
+		_202402271000_add_encryption_keys,
+		_202402281000_add_user_login,
+		_202402291000_add_app_wallet_pubkey,
+		_202403011000_add_identity_rotation,
+		_202403021000_add_audit_events,
+		_202403031000_add_lightning_address_comments,
+		_202403041000_add_user_alby_scopes,
+		_202403051000_add_payment_method_permissions,
+		_202403061000_add_user_totp_last_step,
+		_202403071000_add_zap_signing_pubkey,
 	})
 
 	return m.Migrate()
@@ -2,31 +2,55 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 
 	"gorm.io/gorm"
 )
 
 const (
-	NIP_47_INFO_EVENT_KIND            = 13194
-	NIP_47_REQUEST_KIND               = 23194
-	NIP_47_RESPONSE_KIND              = 23195
-	NIP_47_PAY_INVOICE_METHOD         = "pay_invoice"
-	NIP_47_GET_BALANCE_METHOD         = "get_balance"
-	NIP_47_GET_INFO_METHOD            = "get_info"
-	NIP_47_MAKE_INVOICE_METHOD        = "make_invoice"
-	NIP_47_LOOKUP_INVOICE_METHOD      = "lookup_invoice"
-	NIP_47_LIST_TRANSACTIONS_METHOD   = "list_transactions"
-	NIP_47_PAY_KEYSEND_METHOD         = "pay_keysend"
-	NIP_47_ERROR_INTERNAL             = "INTERNAL"
-	NIP_47_ERROR_NOT_IMPLEMENTED      = "NOT_IMPLEMENTED"
-	NIP_47_ERROR_QUOTA_EXCEEDED       = "QUOTA_EXCEEDED"
-	NIP_47_ERROR_INSUFFICIENT_BALANCE = "INSUFFICIENT_BALANCE"
-	NIP_47_ERROR_UNAUTHORIZED         = "UNAUTHORIZED"
-	NIP_47_ERROR_EXPIRED              = "EXPIRED"
-	NIP_47_ERROR_RESTRICTED           = "RESTRICTED"
-	NIP_47_OTHER                      = "OTHER"
-	NIP_47_CAPABILITIES               = "pay_invoice pay_keysend get_balance get_info make_invoice lookup_invoice list_transactions"
+	NIP_47_INFO_EVENT_KIND              = 13194
+	NIP_47_REQUEST_KIND                 = 23194
+	NIP_47_RESPONSE_KIND                = 23195
+	NIP_47_NOTIFICATION_KIND            = 23196
+	NIP_57_ZAP_REQUEST_KIND             = 9734
+	NIP_57_ZAP_RECEIPT_KIND             = 9735
+	NIP_47_PAY_INVOICE_METHOD           = "pay_invoice"
+	NIP_47_GET_BALANCE_METHOD           = "get_balance"
+	NIP_47_GET_INFO_METHOD              = "get_info"
+	NIP_47_GET_BUDGET_METHOD            = "get_budget"
+	NIP_47_MAKE_INVOICE_METHOD          = "make_invoice"
+	NIP_47_LOOKUP_INVOICE_METHOD        = "lookup_invoice"
+	NIP_47_LIST_TRANSACTIONS_METHOD     = "list_transactions"
+	NIP_47_PAY_KEYSEND_METHOD           = "pay_keysend"
+	NIP_47_PAY_LNURL_METHOD             = "pay_lnurl"
+	NIP_47_MAKE_HOLD_INVOICE_METHOD     = "make_hold_invoice"
+	NIP_47_SETTLE_HOLD_INVOICE_METHOD   = "settle_hold_invoice"
+	NIP_47_CANCEL_HOLD_INVOICE_METHOD   = "cancel_hold_invoice"
+	NIP_47_PAY_OFFER_METHOD             = "pay_offer"
+	NIP_47_MAKE_OFFER_METHOD            = "make_offer"
+	NIP_47_SIGN_MESSAGE_METHOD          = "sign_message"
+	NIP_47_MAKE_ONCHAIN_ADDRESS_METHOD  = "make_onchain_address"
+	NIP_47_GET_ONCHAIN_BALANCE_METHOD   = "get_onchain_balance"
+	NIP_47_PAY_ONCHAIN_METHOD           = "pay_onchain"
+	NIP_47_LIST_CHANNELS_METHOD         = "list_channels"
+	NIP_47_GET_LIQUIDITY_METHOD         = "get_liquidity"
+	NIP_47_LIST_PENDING_CHANNELS_METHOD = "list_pending_channels"
+	NIP_47_VERIFY_MESSAGE_METHOD        = "verify_message"
+	NIP_47_ERROR_INTERNAL               = "INTERNAL"
+	NIP_47_ERROR_NOT_IMPLEMENTED        = "NOT_IMPLEMENTED"
+	NIP_47_ERROR_QUOTA_EXCEEDED         = "QUOTA_EXCEEDED"
+	NIP_47_ERROR_INSUFFICIENT_BALANCE   = "INSUFFICIENT_BALANCE"
+	NIP_47_ERROR_UNAUTHORIZED           = "UNAUTHORIZED"
+	NIP_47_ERROR_EXPIRED                = "EXPIRED"
+	NIP_47_ERROR_RESTRICTED             = "RESTRICTED"
+	NIP_47_ERROR_RATE_LIMITED           = "RATE_LIMITED"
+	NIP_47_ERROR_NOT_FOUND              = "NOT_FOUND"
+	NIP_47_OTHER                        = "OTHER"
+	NIP_47_CAPABILITIES                 = "pay_invoice pay_keysend pay_lnurl get_balance get_info get_budget make_invoice lookup_invoice list_transactions make_hold_invoice settle_hold_invoice cancel_hold_invoice pay_offer make_offer sign_message verify_message make_onchain_address get_onchain_balance pay_onchain list_channels get_liquidity list_pending_channels"
+	NIP_47_NOTIFICATION_TYPES           = "hold_invoice_accepted service_key_rotated"
+	NIP_47_HOLD_INVOICE_ACCEPTED        = "hold_invoice_accepted"
+	NIP_47_SERVICE_KEY_ROTATED          = "service_key_rotated"
 )
 
 const (
@@ -37,22 +61,77 @@ const (
 	NOSTR_EVENT_STATE_PUBLISH_UNCONFIRMED = "sent"
 )
 
+const (
+	PAYMENT_APPROVAL_STATE_PENDING  = "pending"
+	PAYMENT_APPROVAL_STATE_APPROVED = "approved"
+	PAYMENT_APPROVAL_STATE_REJECTED = "rejected"
+	PAYMENT_APPROVAL_STATE_EXPIRED  = "expired"
+)
+
+const (
+	ZAP_STATE_PENDING   = "pending"
+	ZAP_STATE_PUBLISHED = "published"
+	ZAP_STATE_FAILED    = "failed"
+	ZAP_STATE_EXPIRED   = "expired"
+)
+
+const (
+	HOLD_INVOICE_STATE_OPEN     = "open"
+	HOLD_INVOICE_STATE_ACCEPTED = "accepted"
+	HOLD_INVOICE_STATE_SETTLED  = "settled"
+	HOLD_INVOICE_STATE_CANCELED = "canceled"
+)
+
+const (
+	PAYMENT_STATE_PENDING = "pending"
+	PAYMENT_STATE_SETTLED = "settled"
+	PAYMENT_STATE_FAILED  = "failed"
+)
+
 var nip47MethodDescriptions = map[string]string{
-	NIP_47_GET_BALANCE_METHOD:       "Read your balance",
-	NIP_47_GET_INFO_METHOD:          "Read your node info",
-	NIP_47_PAY_INVOICE_METHOD:       "Send payments",
-	NIP_47_MAKE_INVOICE_METHOD:      "Create invoices",
-	NIP_47_LOOKUP_INVOICE_METHOD:    "Lookup status of invoices",
-	NIP_47_LIST_TRANSACTIONS_METHOD: "Read incoming transaction history",
+	NIP_47_GET_BALANCE_METHOD:           "Read your balance",
+	NIP_47_GET_INFO_METHOD:              "Read your node info",
+	NIP_47_PAY_INVOICE_METHOD:           "Send payments",
+	NIP_47_GET_BUDGET_METHOD:            "Read your remaining budget",
+	NIP_47_PAY_KEYSEND_METHOD:           "Send keysend payments",
+	NIP_47_PAY_LNURL_METHOD:             "Pay lightning addresses",
+	NIP_47_MAKE_INVOICE_METHOD:          "Create invoices",
+	NIP_47_LOOKUP_INVOICE_METHOD:        "Lookup status of invoices",
+	NIP_47_LIST_TRANSACTIONS_METHOD:     "Read incoming transaction history",
+	NIP_47_MAKE_HOLD_INVOICE_METHOD:     "Create hold invoices",
+	NIP_47_SETTLE_HOLD_INVOICE_METHOD:   "Settle hold invoices",
+	NIP_47_CANCEL_HOLD_INVOICE_METHOD:   "Cancel hold invoices",
+	NIP_47_SIGN_MESSAGE_METHOD:          "Sign messages with your node key",
+	NIP_47_VERIFY_MESSAGE_METHOD:        "Verify signed messages",
+	NIP_47_MAKE_ONCHAIN_ADDRESS_METHOD:  "Create on-chain addresses",
+	NIP_47_GET_ONCHAIN_BALANCE_METHOD:   "Read your on-chain balance",
+	NIP_47_PAY_ONCHAIN_METHOD:           "Send on-chain payments",
+	NIP_47_LIST_CHANNELS_METHOD:         "Read your channels",
+	NIP_47_GET_LIQUIDITY_METHOD:         "Read your channel liquidity",
+	NIP_47_LIST_PENDING_CHANNELS_METHOD: "Read your pending channels",
 }
 
 var nip47MethodIcons = map[string]string{
-	NIP_47_GET_BALANCE_METHOD:       "wallet",
-	NIP_47_GET_INFO_METHOD:          "wallet",
-	NIP_47_PAY_INVOICE_METHOD:       "lightning",
-	NIP_47_MAKE_INVOICE_METHOD:      "invoice",
-	NIP_47_LOOKUP_INVOICE_METHOD:    "search",
-	NIP_47_LIST_TRANSACTIONS_METHOD: "transactions",
+	NIP_47_GET_BALANCE_METHOD:           "wallet",
+	NIP_47_GET_INFO_METHOD:              "wallet",
+	NIP_47_PAY_INVOICE_METHOD:           "lightning",
+	NIP_47_GET_BUDGET_METHOD:            "wallet",
+	NIP_47_PAY_KEYSEND_METHOD:           "lightning",
+	NIP_47_PAY_LNURL_METHOD:             "lightning",
+	NIP_47_MAKE_INVOICE_METHOD:          "invoice",
+	NIP_47_LOOKUP_INVOICE_METHOD:        "search",
+	NIP_47_LIST_TRANSACTIONS_METHOD:     "transactions",
+	NIP_47_MAKE_HOLD_INVOICE_METHOD:     "invoice",
+	NIP_47_SETTLE_HOLD_INVOICE_METHOD:   "invoice",
+	NIP_47_CANCEL_HOLD_INVOICE_METHOD:   "invoice",
+	NIP_47_SIGN_MESSAGE_METHOD:          "edit",
+	NIP_47_VERIFY_MESSAGE_METHOD:        "search",
+	NIP_47_MAKE_ONCHAIN_ADDRESS_METHOD:  "invoice",
+	NIP_47_GET_ONCHAIN_BALANCE_METHOD:   "wallet",
+	NIP_47_PAY_ONCHAIN_METHOD:           "lightning",
+	NIP_47_LIST_CHANNELS_METHOD:         "transactions",
+	NIP_47_GET_LIQUIDITY_METHOD:         "wallet",
+	NIP_47_LIST_PENDING_CHANNELS_METHOD: "transactions",
 }
 
 // TODO: move to models/Alby
@@ -68,12 +147,20 @@ type User struct {
 	AlbyIdentifier   string `validate:"required"`
 	AccessToken      string `validate:"required"`
 	RefreshToken     string `validate:"required"`
+	PasswordHash     string // web UI login in self-hosted LND mode
+	TotpSecret       string
+	TotpLastStep     int64 // time step of the last accepted TOTP code
 	Email            string
 	Expiry           time.Time
 	LightningAddress string
-	Apps             []App
-	CreatedAt        time.Time
-	UpdatedAt        time.Time
+	// space separated OAuth scopes granted to the service, empty if the user logged in before they were recorded
+	AlbyScopes string
+	// account-wide budget in sats across all apps of the user
+	MaxAmount     int
+	BudgetRenewal string
+	Apps          []App
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 type App struct {
@@ -83,8 +170,10 @@ type App struct {
 	Name        string `validate:"required"`
 	Description string
 	NostrPubkey string `validate:"required"`
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	// service pubkey derived for this app, empty if it is paired with the identity key
+	WalletPubkey string `gorm:"index"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 }
 
 type AppPermission struct {
@@ -94,9 +183,13 @@ type AppPermission struct {
 	RequestMethod string `validate:"required"`
 	MaxAmount     int
 	BudgetRenewal string
-	ExpiresAt     time.Time
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
+	// payments above this amount (in sats) have to be approved by the user
+	ApprovalThreshold int
+	// fiat currency of the budget, MaxAmount is in sats if empty and in whole units of the currency otherwise
+	BudgetCurrency string
+	ExpiresAt      time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
 }
 
 type NostrEvent struct {
@@ -114,17 +207,112 @@ type NostrEvent struct {
 
 type Payment struct {
 	ID             uint
-	AppId          uint `validate:"required"`
+	AppId          uint `validate:"required" gorm:"uniqueIndex:idx_payments_app_id_payment_hash"`
 	App            App
 	NostrEventId   uint `validate:"required"`
 	NostrEvent     NostrEvent
 	Amount         uint
 	PaymentRequest string
+	PaymentHash    *string `gorm:"uniqueIndex:idx_payments_app_id_payment_hash"`
+	State          string
 	Preimage       *string
+	// amount in the minor unit of the fiat budget currency at the rate applied to the payment
+	FiatAmount   int64
+	FiatCurrency string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+const (
+	ONCHAIN_PAYMENT_STATE_PENDING = "pending"
+	ONCHAIN_PAYMENT_STATE_SENT    = "sent"
+	ONCHAIN_PAYMENT_STATE_FAILED  = "failed"
+)
+
+type OnchainPayment struct {
+	ID           uint
+	AppId        uint `validate:"required"`
+	App          App
+	NostrEventId uint `validate:"required"`
+	NostrEvent   NostrEvent
+	Address      string
+	// in sats, excluding the transaction fee
+	Amount    uint
+	TxId      *string
+	State     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+type PaymentApproval struct {
+	ID             uint
+	AppId          uint `validate:"required"`
+	App            App
+	NostrEventId   uint `validate:"required"`
+	NostrEvent     NostrEvent
+	RequestMethod  string
+	Amount         uint
+	PaymentRequest string
+	Destination    string
+	State          string
+	ExpiresAt      time.Time
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
 }
 
+// Zap is an invoice created for a NIP-57 zap request, waiting to be settled.
+// Zaps received through the lightning address have no app.
+type Zap struct {
+	ID            uint
+	AppId         *uint
+	App           *App
+	PaymentHash   string
+	Invoice       string
+	ZapRequest    string
+	SigningPubkey string // the nostrPubkey of the LNURL service that received the zap request
+	ReceiptId     string
+	State         string
+	ExpiresAt     *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// LightningAddressComment is the LUD-12 comment of a payment to the lightning address.
+// The invoice commits to the LNURL metadata or the zap request, so the comment can't be its description.
+type LightningAddressComment struct {
+	ID          uint
+	PaymentHash string `gorm:"index"`
+	Comment     string
+	CreatedAt   time.Time
+}
+
+// HoldInvoice is a hold invoice created by an app, watched until it is settled or canceled
+type HoldInvoice struct {
+	ID          uint
+	AppId       uint `validate:"required"`
+	App         App
+	PaymentHash string
+	Invoice     string
+	Amount      int64
+	State       string
+	ExpiresAt   *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+type Nip47GetBudgetResponse struct {
+	TotalBudget   int64  `json:"total_budget"`
+	UsedBudget    int64  `json:"used_budget"`
+	Remaining     int64  `json:"remaining"`
+	RenewalPeriod string `json:"renewal_period"`
+	RenewsAt      *int64 `json:"renews_at,omitempty"`
+	// fiat budgets in whole units of the currency, the msat amounts are converted at the current rate
+	FiatCurrency    string   `json:"fiat_currency,omitempty"`
+	FiatTotalBudget *float64 `json:"fiat_total_budget,omitempty"`
+	FiatUsedBudget  *float64 `json:"fiat_used_budget,omitempty"`
+	FiatRemaining   *float64 `json:"fiat_remaining,omitempty"`
+}
+
 // TODO: move to models/Nip47
 type Nip47Transaction struct {
 	Type            string      `json:"type"`
@@ -139,6 +327,8 @@ type Nip47Transaction struct {
 	ExpiresAt       *int64      `json:"expires_at"`
 	SettledAt       *int64      `json:"settled_at"`
 	Metadata        interface{} `json:"metadata,omitempty"`
+	// LUD-12 comment of a payment to the lightning address of this instance
+	Comment string `json:"comment,omitempty"`
 }
 
 // TODO: move to models/Alby
@@ -172,6 +362,7 @@ type AlbyInvoice struct {
 
 type PayRequest struct {
 	Invoice string `json:"invoice"`
+	Amount  int64  `json:"amount,omitempty"`
 }
 
 // TODO: move to models/Alby
@@ -222,9 +413,117 @@ type NodeInfo struct {
 	BlockHash   string
 }
 
+// on-chain wallet balance in sats
+type OnchainBalance struct {
+	Confirmed   int64
+	Unconfirmed int64
+	// reserved for fee bumping of anchor channels
+	Reserved int64
+}
+
+// channel balances are in sats
+type Channel struct {
+	Id            string
+	ChannelPoint  string
+	RemotePubkey  string
+	Capacity      int64
+	LocalBalance  int64
+	RemoteBalance int64
+	LocalReserve  int64
+	RemoteReserve int64
+	Active        bool
+	Public        bool
+}
+
+const (
+	PENDING_CHANNEL_STATE_OPENING       = "opening"
+	PENDING_CHANNEL_STATE_WAITING_CLOSE = "waiting_close"
+	PENDING_CHANNEL_STATE_CLOSING       = "closing"
+	PENDING_CHANNEL_STATE_FORCE_CLOSING = "force_closing"
+)
+
+type PendingChannel struct {
+	ChannelPoint  string
+	RemotePubkey  string
+	Capacity      int64
+	LocalBalance  int64
+	RemoteBalance int64
+	State         string
+	ClosingTxId   string
+}
+
+// Identity is the service key, each rotation retires the active key and creates a new one
 type Identity struct {
 	gorm.Model
 	Privkey string
+	// set when the key was rotated, requests to it are still answered until it expires
+	RetiredAt *time.Time
+	ExpiresAt *time.Time
+}
+
+const (
+	AUDIT_LOGIN               = "login"
+	AUDIT_LOGIN_FAILED        = "login_failed"
+	AUDIT_LOGOUT              = "logout"
+	AUDIT_PASSWORD_SET        = "password_set"
+	AUDIT_TOTP_ENABLED        = "totp_enabled"
+	AUDIT_TOTP_DISABLED       = "totp_disabled"
+	AUDIT_APP_CREATED         = "app_created"
+	AUDIT_APP_DELETED         = "app_deleted"
+	AUDIT_APP_SECRET_ROTATED  = "app_secret_rotated"
+	AUDIT_BUDGET_UPDATED      = "budget_updated"
+	AUDIT_SERVICE_KEY_ROTATED = "service_key_rotated"
+	AUDIT_PAYMENT_APPROVED    = "payment_approved"
+	AUDIT_PAYMENT_REJECTED    = "payment_rejected"
+	AUDIT_PAYMENT_DENIED      = "payment_denied"
+)
+
+var AUDIT_ACTIONS = []string{
+	AUDIT_LOGIN,
+	AUDIT_LOGIN_FAILED,
+	AUDIT_LOGOUT,
+	AUDIT_PASSWORD_SET,
+	AUDIT_TOTP_ENABLED,
+	AUDIT_TOTP_DISABLED,
+	AUDIT_APP_CREATED,
+	AUDIT_APP_DELETED,
+	AUDIT_APP_SECRET_ROTATED,
+	AUDIT_BUDGET_UPDATED,
+	AUDIT_SERVICE_KEY_ROTATED,
+	AUDIT_PAYMENT_APPROVED,
+	AUDIT_PAYMENT_REJECTED,
+	AUDIT_PAYMENT_DENIED,
+}
+
+// AuditEvent records an administrative or security relevant action.
+// Audit events are append-only, updates and deletes are refused.
+type AuditEvent struct {
+	ID     uint
+	UserId *uint  `gorm:"index"`
+	AppId  *uint  `gorm:"index"`
+	Action string `gorm:"index"`
+	// JSON object, e.g. the name of a deleted app
+	Details   string
+	IP        string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+var ErrAuditEventImmutable = errors.New("audit events can't be changed")
+
+func (event *AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditEventImmutable
+}
+
+func (event *AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditEventImmutable
+}
+
+// EncryptionKey holds the data key used to encrypt secrets, wrapped with the master key
+type EncryptionKey struct {
+	gorm.Model
+	WrappedKey string
+	// salt used to derive the master key from a passphrase
+	Salt string
 }
 
 // TODO: move to models/Nip47
@@ -246,6 +545,7 @@ type Nip47Error struct {
 
 type Nip47PayParams struct {
 	Invoice string `json:"invoice"`
+	Amount  int64  `json:"amount"`
 }
 type Nip47PayResponse struct {
 	Preimage string `json:"preimage"`
@@ -258,15 +558,150 @@ type Nip47KeysendParams struct {
 	TLVRecords []TLVRecord `json:"tlv_records"`
 }
 
+type Nip47PayLnurlParams struct {
+	Lnurl   string `json:"lnurl"`
+	Amount  int64  `json:"amount"`
+	Comment string `json:"comment"`
+}
+
+type Nip47PayLnurlResponse struct {
+	Preimage      string          `json:"preimage"`
+	SuccessAction json.RawMessage `json:"success_action,omitempty"`
+}
+
+type Nip47MakeHoldInvoiceParams struct {
+	Amount          int64  `json:"amount"`
+	Description     string `json:"description"`
+	DescriptionHash string `json:"description_hash"`
+	PaymentHash     string `json:"payment_hash"`
+	Expiry          int64  `json:"expiry"`
+}
+
+type Nip47SettleHoldInvoiceParams struct {
+	Preimage string `json:"preimage"`
+}
+
+type Nip47CancelHoldInvoiceParams struct {
+	PaymentHash string `json:"payment_hash"`
+}
+
+type Nip47PayOfferParams struct {
+	Offer     string `json:"offer"`
+	Amount    int64  `json:"amount"`
+	PayerNote string `json:"payer_note"`
+}
+
+type Nip47MakeOfferParams struct {
+	Amount      int64  `json:"amount"`
+	Description string `json:"description"`
+}
+
+type Nip47MakeOfferResponse struct {
+	Offer string `json:"offer"`
+}
+
+type Nip47SignMessageParams struct {
+	Message string `json:"message"`
+}
+
+type Nip47SignMessageResponse struct {
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+}
+
+type Nip47VerifyMessageParams struct {
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+}
+
+type Nip47VerifyMessageResponse struct {
+	Valid  bool   `json:"valid"`
+	Pubkey string `json:"pubkey"`
+}
+
+type Nip47MakeOnchainAddressResponse struct {
+	Address string `json:"address"`
+}
+
+type Nip47GetOnchainBalanceResponse struct {
+	Confirmed   int64 `json:"confirmed"`
+	Unconfirmed int64 `json:"unconfirmed"`
+	Reserved    int64 `json:"reserved"`
+}
+
+type Nip47PayOnchainParams struct {
+	Address     string `json:"address"`
+	Amount      int64  `json:"amount"`
+	SatPerVbyte uint64 `json:"sat_per_vbyte"`
+}
+
+type Nip47PayOnchainResponse struct {
+	TxId string `json:"txid"`
+}
+
+type Nip47Channel struct {
+	Id            string `json:"id"`
+	ChannelPoint  string `json:"channel_point"`
+	RemotePubkey  string `json:"remote_pubkey"`
+	Capacity      int64  `json:"capacity"`
+	LocalBalance  int64  `json:"local_balance"`
+	RemoteBalance int64  `json:"remote_balance"`
+	Active        bool   `json:"active"`
+	Public        bool   `json:"public"`
+}
+
+type Nip47ListChannelsResponse struct {
+	Channels []Nip47Channel `json:"channels"`
+}
+
+type Nip47GetLiquidityResponse struct {
+	Outbound        int64 `json:"outbound"`
+	Inbound         int64 `json:"inbound"`
+	LargestOutbound int64 `json:"largest_outbound"`
+	LargestInbound  int64 `json:"largest_inbound"`
+	ActiveChannels  int   `json:"active_channels"`
+}
+
+type Nip47PendingChannel struct {
+	ChannelPoint  string `json:"channel_point"`
+	RemotePubkey  string `json:"remote_pubkey"`
+	Capacity      int64  `json:"capacity"`
+	LocalBalance  int64  `json:"local_balance"`
+	RemoteBalance int64  `json:"remote_balance"`
+	State         string `json:"state"`
+	ClosingTxId   string `json:"closing_txid,omitempty"`
+}
+
+type Nip47ListPendingChannelsResponse struct {
+	PendingChannels []Nip47PendingChannel `json:"pending_channels"`
+}
+
+type Nip47Notification struct {
+	NotificationType string      `json:"notification_type"`
+	Notification     interface{} `json:"notification"`
+}
+
+type Nip47ServiceKeyRotatedNotification struct {
+	Pubkey    string `json:"pubkey"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
 type TLVRecord struct {
 	Type  uint64 `json:"type"`
 	Value string `json:"value"`
 }
 
+type Nip47BalanceParams struct {
+	Currency string `json:"currency"`
+}
+
 type Nip47BalanceResponse struct {
 	Balance       int64  `json:"balance"`
 	MaxAmount     int    `json:"max_amount"`
 	BudgetRenewal string `json:"budget_renewal"`
+	// balance in whole units of the requested currency or the currency of the app's budget
+	FiatBalance  *float64 `json:"fiat_balance,omitempty"`
+	FiatCurrency string   `json:"fiat_currency,omitempty"`
 }
 
 // TODO: move to models/Nip47
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	NIP_46_KIND            = 24133
+	NIP_46_REQUEST_TIMEOUT = 30 * time.Second
+	// the delay between attempts to reconnect to the relay of the remote signer doubles up to the maximum
+	NIP_46_RECONNECT_DELAY     = time.Second
+	NIP_46_MAX_RECONNECT_DELAY = time.Minute
+)
+
+type Nip46Request struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type Nip46Response struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Nip46Signer holds the service key in a remote signer ("bunker") and talks to it over nostr connect (NIP-46).
+// Requests and responses are encrypted with NIP-04 between a client key of this service and the remote signer.
+type Nip46Signer struct {
+	clientKey    string
+	clientPubkey string
+	remotePubkey string
+	ss           []byte
+	pubkey       string
+	timeout      time.Duration
+	publish      func(ctx context.Context, event nostr.Event) error
+	relayUrl     string
+	logger       *logrus.Logger
+	closed       chan struct{}
+	closeOnce    sync.Once
+
+	mu      sync.Mutex
+	relay   *nostr.Relay
+	pending map[string]chan Nip46Response
+}
+
+// parseBunkerUri parses a bunker://<remote-signer-pubkey>?relay=wss://...&secret=... URI
+func parseBunkerUri(uri string) (remotePubkey string, relayUrl string, secret string, err error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", "", "", err
+	}
+	if parsed.Scheme != "bunker" {
+		return "", "", "", errors.New("the remote signer URI has to start with bunker://")
+	}
+	remotePubkey = parsed.Host
+	decoded, err := hex.DecodeString(remotePubkey)
+	if err != nil || len(decoded) != 32 {
+		return "", "", "", errors.New("invalid pubkey of the remote signer")
+	}
+	relayUrl = parsed.Query().Get("relay")
+	if relayUrl == "" {
+		return "", "", "", errors.New("the remote signer URI has no relay")
+	}
+	return remotePubkey, relayUrl, parsed.Query().Get("secret"), nil
+}
+
+// ConnectNip46Signer connects to the remote signer of a bunker URI through its relay.
+// Without a client key a new one is generated, the remote signer then has to accept the secret of the URI again.
+// The connection to the relay is re-established whenever it is lost.
+func ConnectNip46Signer(ctx context.Context, uri string, clientKey string, timeout time.Duration) (*Nip46Signer, error) {
+	remotePubkey, relayUrl, secret, err := parseBunkerUri(uri)
+	if err != nil {
+		return nil, err
+	}
+	if clientKey == "" {
+		clientKey = nostr.GeneratePrivateKey()
+	}
+	signer, err := NewNip46Signer(clientKey, remotePubkey, timeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	signer.publish = signer.publishToRelay
+	signer.relayUrl = relayUrl
+
+	relay, err := signer.connectRelay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go signer.keepConnected(relay)
+
+	err = signer.Connect(secret)
+	if err != nil {
+		signer.Close()
+		return nil, err
+	}
+	return signer, nil
+}
+
+// connectRelay connects to the relay of the remote signer and subscribes to the responses
+func (signer *Nip46Signer) connectRelay(ctx context.Context) (*nostr.Relay, error) {
+	relay, err := nostr.RelayConnect(ctx, signer.relayUrl)
+	if err != nil {
+		return nil, err
+	}
+	// after a reconnect, responses to the requests that are still waiting might have been sent already
+	since := nostr.Timestamp(time.Now().Add(-signer.timeout).Unix())
+	// ends together with the connection
+	sub, err := relay.Subscribe(relay.Context(), nostr.Filters{{
+		Kinds:   []int{NIP_46_KIND},
+		Authors: []string{signer.remotePubkey},
+		Tags:    nostr.TagMap{"p": []string{signer.clientPubkey}},
+		Since:   &since,
+	}})
+	if err != nil {
+		relay.Close()
+		return nil, err
+	}
+	go func() {
+		for event := range sub.Events {
+			signer.HandleResponse(event)
+		}
+	}()
+
+	signer.mu.Lock()
+	signer.relay = relay
+	signer.mu.Unlock()
+	return relay, nil
+}
+
+// keepConnected reconnects to the relay of the remote signer whenever the connection is lost, until the signer is closed
+func (signer *Nip46Signer) keepConnected(relay *nostr.Relay) {
+	for {
+		select {
+		case <-signer.closed:
+			return
+		case <-relay.Context().Done():
+		}
+		select {
+		case <-signer.closed:
+			return
+		default:
+		}
+		signer.logger.WithError(relay.ConnectionError).Warn("Lost the connection to the remote signer, reconnecting")
+
+		delay := NIP_46_RECONNECT_DELAY
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), signer.timeout)
+			reconnected, err := signer.connectRelay(ctx)
+			cancel()
+			if err == nil {
+				relay = reconnected
+				break
+			}
+			signer.logger.WithError(err).Errorf("Failed to reconnect to the remote signer, retrying in %s", delay)
+			select {
+			case <-signer.closed:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > NIP_46_MAX_RECONNECT_DELAY {
+				delay = NIP_46_MAX_RECONNECT_DELAY
+			}
+		}
+		signer.logger.Info("Reconnected to the remote signer")
+	}
+}
+
+func (signer *Nip46Signer) publishToRelay(ctx context.Context, event nostr.Event) error {
+	signer.mu.Lock()
+	relay := signer.relay
+	signer.mu.Unlock()
+	status, err := relay.Publish(ctx, event)
+	if err != nil || status != nostr.PublishStatusSucceeded {
+		return fmt.Errorf("Nostr publish not successful: %s error: %s", status, err)
+	}
+	return nil
+}
+
+// NewNip46Signer creates a signer that sends its requests with publish,
+// responses of the remote signer have to be passed to HandleResponse
+func NewNip46Signer(clientKey string, remotePubkey string, timeout time.Duration, publish func(ctx context.Context, event nostr.Event) error) (*Nip46Signer, error) {
+	clientPubkey, err := nostr.GetPublicKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := nip04.ComputeSharedSecret(remotePubkey, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Nip46Signer{
+		clientKey:    clientKey,
+		clientPubkey: clientPubkey,
+		remotePubkey: remotePubkey,
+		ss:           ss,
+		timeout:      timeout,
+		publish:      publish,
+		logger:       logrus.StandardLogger(),
+		closed:       make(chan struct{}),
+		pending:      map[string]chan Nip46Response{},
+	}, nil
+}
+
+// Connect authorizes the client key with the secret of the bunker URI and fetches the pubkey of the service key
+func (signer *Nip46Signer) Connect(secret string) error {
+	params := []string{signer.remotePubkey}
+	if secret != "" {
+		params = append(params, secret)
+	}
+	_, err := signer.request("connect", params...)
+	if err != nil {
+		return err
+	}
+	pubkey, err := signer.request("get_public_key")
+	if err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(pubkey)
+	if err != nil || len(decoded) != 32 {
+		return fmt.Errorf("remote signer returned an invalid pubkey: %s", pubkey)
+	}
+	signer.pubkey = pubkey
+	return nil
+}
+
+func (signer *Nip46Signer) GetPublicKey() string {
+	return signer.pubkey
+}
+
+func (signer *Nip46Signer) SignEvent(event *nostr.Event) error {
+	event.PubKey = signer.pubkey
+	unsigned, err := json.Marshal(map[string]interface{}{
+		"pubkey":     event.PubKey,
+		"created_at": event.CreatedAt,
+		"kind":       event.Kind,
+		"tags":       event.Tags,
+		"content":    event.Content,
+	})
+	if err != nil {
+		return err
+	}
+	result, err := signer.request("sign_event", string(unsigned))
+	if err != nil {
+		return err
+	}
+	signed := nostr.Event{}
+	err = json.Unmarshal([]byte(result), &signed)
+	if err != nil {
+		return err
+	}
+	// the remote signer must not sign anything else than what was requested
+	if signed.PubKey != event.PubKey || signed.GetID() != event.GetID() {
+		return errors.New("remote signer signed a different event")
+	}
+	ok, err := signed.CheckSignature()
+	if err != nil || !ok {
+		return errors.New("remote signer returned an invalid signature")
+	}
+	event.ID = signed.ID
+	event.Sig = signed.Sig
+	return nil
+}
+
+func (signer *Nip46Signer) Nip04Encrypt(pubkey string, plaintext string) (string, error) {
+	return signer.request("nip04_encrypt", pubkey, plaintext)
+}
+
+func (signer *Nip46Signer) Nip04Decrypt(pubkey string, ciphertext string) (string, error) {
+	return signer.request("nip04_decrypt", pubkey, ciphertext)
+}
+
+func (signer *Nip46Signer) Close() error {
+	signer.closeOnce.Do(func() {
+		close(signer.closed)
+	})
+	signer.mu.Lock()
+	relay := signer.relay
+	signer.mu.Unlock()
+	if relay == nil {
+		return nil
+	}
+	return relay.Close()
+}
+
+func (signer *Nip46Signer) request(method string, params ...string) (result string, err error) {
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	request := Nip46Request{ID: hex.EncodeToString(id), Method: method, Params: params}
+	payloadBytes, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	content, err := nip04.Encrypt(string(payloadBytes), signer.ss)
+	if err != nil {
+		return "", err
+	}
+	event := nostr.Event{
+		PubKey:    signer.clientPubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      NIP_46_KIND,
+		Tags:      nostr.Tags{[]string{"p", signer.remotePubkey}},
+		Content:   content,
+	}
+	err = event.Sign(signer.clientKey)
+	if err != nil {
+		return "", err
+	}
+
+	responses := make(chan Nip46Response, 1)
+	signer.mu.Lock()
+	signer.pending[request.ID] = responses
+	signer.mu.Unlock()
+	defer func() {
+		signer.mu.Lock()
+		delete(signer.pending, request.ID)
+		signer.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), signer.timeout)
+	defer cancel()
+	err = signer.publish(ctx, event)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case response := <-responses:
+		if response.Error != "" {
+			return "", fmt.Errorf("remote signer failed to %s: %s", method, response.Error)
+		}
+		return response.Result, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("remote signer did not answer %s: %w", method, ctx.Err())
+	}
+}
+
+// HandleResponse passes a response of the remote signer to the request waiting for it
+func (signer *Nip46Signer) HandleResponse(event *nostr.Event) {
+	if event.Kind != NIP_46_KIND || event.PubKey != signer.remotePubkey {
+		return
+	}
+	ok, err := event.CheckSignature()
+	if err != nil || !ok {
+		return
+	}
+	payload, err := nip04.Decrypt(event.Content, signer.ss)
+	if err != nil {
+		return
+	}
+	response := Nip46Response{}
+	err = json.Unmarshal([]byte(payload), &response)
+	if err != nil {
+		return
+	}
+	// the request has to be approved in the remote signer, the final response follows with the same id
+	if response.Result == "auth_url" {
+		signer.logger.WithFields(logrus.Fields{
+			"requestId": response.ID,
+			"url":       response.Error,
+		}).Warn("The remote signer asks to approve the request, open the URL to approve it")
+		return
+	}
+	signer.mu.Lock()
+	responses, ok := signer.pending[response.ID]
+	signer.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case responses <- response:
+	default:
+	}
+}
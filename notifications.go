@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SetRelay sets the relay used to publish events that are not replies to requests
+func (svc *Service) SetRelay(relay *nostr.Relay) {
+	svc.relay.Store(relay)
+}
+
+// PublishNotification sends an encrypted NIP-47 notification (kind 23196) to the app
+func (svc *Service) PublishNotification(ctx context.Context, app *App, notificationType string, notification interface{}) error {
+	relay := svc.relay.Load()
+	if relay == nil {
+		return errors.New("Not connected to the relay")
+	}
+	event, err := svc.createNotification(app, notificationType, notification)
+	if err != nil {
+		return err
+	}
+	status, err := relay.Publish(ctx, *event)
+	if err != nil || status != nostr.PublishStatusSucceeded {
+		return fmt.Errorf("Nostr publish not successful: %s error: %s", status, err)
+	}
+	return nil
+}
+
+func (svc *Service) createNotification(app *App, notificationType string, notification interface{}) (*nostr.Event, error) {
+	serviceKey, servicePubkey, err := svc.appServiceKey(app)
+	if err != nil {
+		return nil, err
+	}
+	return svc.createNotificationWithKey(app, serviceKey, servicePubkey, notificationType, notification)
+}
+
+// createNotificationWithKey creates a notification from a service key other than the app's current one
+func (svc *Service) createNotificationWithKey(app *App, serviceKey string, servicePubkey string, notificationType string, notification interface{}) (*nostr.Event, error) {
+	payloadBytes, err := json.Marshal(Nip47Notification{
+		NotificationType: notificationType,
+		Notification:     notification,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signer := svc.signerFor(serviceKey, servicePubkey)
+	msg, err := signer.Nip04Encrypt(app.NostrPubkey, string(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+	event := &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      NIP_47_NOTIFICATION_KIND,
+		Tags:      nostr.Tags{[]string{"p", app.NostrPubkey}},
+		Content:   msg,
+	}
+	err = signer.SignEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
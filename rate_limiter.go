@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter keeps token buckets for incoming NIP-47 requests.
+// Known apps get a bucket per app and optionally a bucket per app and method,
+// requests from unknown pubkeys share a single global bucket.
+// A nil RateLimiter allows everything.
+type RateLimiter struct {
+	mu             sync.Mutex
+	appLimit       rate.Limit
+	appBurst       int
+	methodLimits   map[string]int
+	appLimiters    map[uint]*rate.Limiter
+	methodLimiters map[string]*rate.Limiter
+	unknownLimiter *rate.Limiter
+}
+
+func NewRateLimiter(cfg *Config) (result *RateLimiter, err error) {
+	methodLimits, err := parseMethodRateLimits(cfg.RateLimitMethodRequests)
+	if err != nil {
+		return nil, err
+	}
+	rl := &RateLimiter{
+		appBurst:       cfg.RateLimitAppBurst,
+		methodLimits:   methodLimits,
+		appLimiters:    map[uint]*rate.Limiter{},
+		methodLimiters: map[string]*rate.Limiter{},
+	}
+	if cfg.RateLimitAppRequests > 0 {
+		rl.appLimit = perMinute(cfg.RateLimitAppRequests)
+		if rl.appBurst <= 0 {
+			rl.appBurst = cfg.RateLimitAppRequests
+		}
+	}
+	if cfg.RateLimitUnknownRequests > 0 {
+		rl.unknownLimiter = rate.NewLimiter(perMinute(cfg.RateLimitUnknownRequests), cfg.RateLimitUnknownRequests)
+	}
+	return rl, nil
+}
+
+// AllowUnknown reports whether a request from a pubkey without a connected app may be answered
+func (rl *RateLimiter) AllowUnknown() bool {
+	if rl == nil || rl.unknownLimiter == nil {
+		return true
+	}
+	return rl.unknownLimiter.Allow()
+}
+
+// AllowApp reports whether the app may execute a request for the given method.
+// Both the app bucket and the method bucket have to allow the request.
+func (rl *RateLimiter) AllowApp(appId uint, method string) bool {
+	if rl == nil {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.appLimit > 0 {
+		limiter, ok := rl.appLimiters[appId]
+		if !ok {
+			limiter = rate.NewLimiter(rl.appLimit, rl.appBurst)
+			rl.appLimiters[appId] = limiter
+		}
+		if !limiter.Allow() {
+			return false
+		}
+	}
+
+	methodLimit := rl.methodLimits[method]
+	if methodLimit > 0 {
+		key := fmt.Sprintf("%d:%s", appId, method)
+		limiter, ok := rl.methodLimiters[key]
+		if !ok {
+			limiter = rate.NewLimiter(perMinute(methodLimit), methodLimit)
+			rl.methodLimiters[key] = limiter
+		}
+		if !limiter.Allow() {
+			return false
+		}
+	}
+	return true
+}
+
+// Forget drops the buckets of an app, e.g. after it was deleted
+func (rl *RateLimiter) Forget(appId uint) {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.appLimiters, appId)
+	prefix := fmt.Sprintf("%d:", appId)
+	for key := range rl.methodLimiters {
+		if strings.HasPrefix(key, prefix) {
+			delete(rl.methodLimiters, key)
+		}
+	}
+}
+
+func perMinute(requests int) rate.Limit {
+	return rate.Every(time.Minute / time.Duration(requests))
+}
+
+// parseMethodRateLimits parses a comma separated list of method:requests_per_minute pairs
+// e.g. "get_balance:10,pay_invoice:5"
+func parseMethodRateLimits(value string) (result map[string]int, err error) {
+	result = map[string]int{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		method, limit, found := strings.Cut(entry, ":")
+		if !found {
+			return nil, fmt.Errorf("Invalid method rate limit: %s", entry)
+		}
+		requests, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil || requests < 0 {
+			return nil, fmt.Errorf("Invalid method rate limit: %s", entry)
+		}
+		result[strings.TrimSpace(method)] = requests
+	}
+	return result, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	MSAT_PER_BTC = 100000000000
+	// fetched rates are reused for this long, so the rate checked against the budget is the one recorded for the payment
+	fiatRateCacheDuration = time.Minute
+)
+
+var currencyRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// RateProvider returns the price of one bitcoin in a fiat currency
+type RateProvider interface {
+	GetRate(ctx context.Context, currency string) (rate float64, err error)
+}
+
+func NewRateProvider(cfg *Config) (result RateProvider, err error) {
+	if cfg.FiatRatesFile != "" {
+		return NewStaticRateProvider(cfg.FiatRatesFile)
+	}
+	if cfg.FiatRatesUrl != "" {
+		return NewHTTPRateProvider(cfg.FiatRatesUrl), nil
+	}
+	// fiat budgets and balances are disabled
+	return nil, nil
+}
+
+type cachedRate struct {
+	rate      float64
+	fetchedAt time.Time
+}
+
+// HTTPRateProvider fetches rates from a URL with a %s placeholder for the lowercase currency code.
+// The response has to contain the rate as rate_float, e.g. https://getalby.com/api/rates/%s.json
+type HTTPRateProvider struct {
+	url    string
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]cachedRate
+}
+
+func NewHTTPRateProvider(url string) *HTTPRateProvider {
+	return &HTTPRateProvider{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		cache:  map[string]cachedRate{},
+	}
+}
+
+func (provider *HTTPRateProvider) GetRate(ctx context.Context, currency string) (rate float64, err error) {
+	currency = strings.ToUpper(currency)
+	provider.mu.Lock()
+	cached, ok := provider.cache[currency]
+	provider.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < fiatRateCacheDuration {
+		return cached.rate, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(provider.url, strings.ToLower(currency)), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("Rate provider responded with status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return 0, err
+	}
+	var rateResponse struct {
+		RateFloat float64 `json:"rate_float"`
+	}
+	err = json.Unmarshal(body, &rateResponse)
+	if err != nil {
+		return 0, err
+	}
+	if rateResponse.RateFloat <= 0 {
+		return 0, fmt.Errorf("Rate provider returned no rate for %s", currency)
+	}
+
+	provider.mu.Lock()
+	provider.cache[currency] = cachedRate{rate: rateResponse.RateFloat, fetchedAt: time.Now()}
+	provider.mu.Unlock()
+	return rateResponse.RateFloat, nil
+}
+
+// StaticRateProvider serves fixed rates, e.g. for offline testing
+type StaticRateProvider struct {
+	rates map[string]float64
+}
+
+// NewStaticRateProvider reads the rates from a JSON file mapping currency codes to the price of one bitcoin
+// e.g. {"EUR": 50000, "USD": 55000}
+func NewStaticRateProvider(path string) (*StaticRateProvider, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rates := map[string]float64{}
+	err = json.Unmarshal(content, &rates)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rates file: %v", err)
+	}
+	provider := &StaticRateProvider{rates: map[string]float64{}}
+	for currency, rate := range rates {
+		if rate <= 0 {
+			return nil, fmt.Errorf("Invalid rate for %s: %v", currency, rate)
+		}
+		provider.rates[strings.ToUpper(currency)] = rate
+	}
+	return provider, nil
+}
+
+func (provider *StaticRateProvider) GetRate(ctx context.Context, currency string) (rate float64, err error) {
+	rate, ok := provider.rates[strings.ToUpper(currency)]
+	if !ok {
+		return 0, fmt.Errorf("No rate for %s", currency)
+	}
+	return rate, nil
+}
+
+func isValidCurrency(currency string) bool {
+	return currencyRegex.MatchString(currency)
+}
+
+// msatToFiatCents converts an amount to the minor unit of the currency
+func msatToFiatCents(amount int64, rate float64) int64 {
+	return int64(math.Round(float64(amount) / MSAT_PER_BTC * rate * 100))
+}
+
+func fiatCentsToMsat(cents int64, rate float64) int64 {
+	return int64(math.Floor(float64(cents) / 100 / rate * MSAT_PER_BTC))
+}
+
+// fiatCentsToUnits returns the amount in whole units of the currency for NIP-47 responses
+func fiatCentsToUnits(cents int64) *float64 {
+	units := float64(cents) / 100
+	return &units
+}
+
+func (svc *Service) getFiatRate(ctx context.Context, currency string) (rate float64, err error) {
+	if svc.rateProvider == nil {
+		return 0, errors.New("No rate provider configured")
+	}
+	return svc.rateProvider.GetRate(ctx, currency)
+}
+
+// paymentFiatAmount converts the amount of a payment at the current rate if the app has a fiat budget,
+// so the budget usage is recorded at the rate applied to the payment. Without a rate the payment can't be
+// counted against the budget and must not be made.
+func (svc *Service) paymentFiatAmount(app *App, amount int64) (fiatAmount int64, currency string, err error) {
+	appPermission := AppPermission{}
+	svc.db.Where("app_id = ? AND request_method = ?", app.ID, NIP_47_PAY_INVOICE_METHOD).Limit(1).Find(&appPermission)
+	if appPermission.BudgetCurrency == "" {
+		return 0, "", nil
+	}
+	rate, err := svc.getFiatRate(context.Background(), appPermission.BudgetCurrency)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"appId":    app.ID,
+			"currency": appPermission.BudgetCurrency,
+		}).Errorf("Failed to fetch rate for payment: %v", err)
+		return 0, "", err
+	}
+	return msatToFiatCents(amount, rate), appPermission.BudgetCurrency, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"gorm.io/gorm"
+)
+
+// encrypted column values are prefixed so plaintext rows from before encryption was enabled can still be read
+const ENCRYPTED_SECRET_PREFIX = "enc:v1:"
+
+var ErrNoMasterKey = errors.New("secret is encrypted but no master key is configured")
+
+// SecretBox encrypts secrets stored in the database with a random data key.
+// The data key is stored wrapped with the master key, so the master key never touches the database
+// and can be rotated by rewrapping a single row.
+// A nil SecretBox stores secrets in plaintext.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox loads the master key from the config and unwraps the data key, creating it on first use.
+// It returns nil if no master key is configured and no secrets have been encrypted yet.
+func NewSecretBox(db *gorm.DB, cfg *Config) (result *SecretBox, err error) {
+	encryptionKey := &EncryptionKey{}
+	err = db.FirstOrInit(encryptionKey).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.EncryptionKey == "" && cfg.EncryptionKeyFile == "" && !cfg.EncryptionPassphrasePrompt {
+		if encryptionKey.ID != 0 {
+			return nil, errors.New("secrets in the database are encrypted, set ENCRYPTION_KEY, ENCRYPTION_KEY_FILE or ENCRYPTION_PASSPHRASE_PROMPT")
+		}
+		return nil, nil
+	}
+
+	if encryptionKey.ID == 0 {
+		salt := make([]byte, 16)
+		_, err = rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		encryptionKey.Salt = hex.EncodeToString(salt)
+	}
+	salt, err := hex.DecodeString(encryptionKey.Salt)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := loadMasterKey(cfg, salt)
+	if err != nil {
+		return nil, err
+	}
+	wrapper, err := newSecretBox(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryptionKey.ID == 0 {
+		dataKey := make([]byte, 32)
+		_, err = rand.Read(dataKey)
+		if err != nil {
+			return nil, err
+		}
+		encryptionKey.WrappedKey, err = wrapper.Encrypt(hex.EncodeToString(dataKey))
+		if err != nil {
+			return nil, err
+		}
+		err = db.Save(encryptionKey).Error
+		if err != nil {
+			return nil, err
+		}
+		return newSecretBox(dataKey)
+	}
+
+	dataKeyHex, err := wrapper.Decrypt(encryptionKey.WrappedKey)
+	if err != nil {
+		return nil, errors.New("failed to unwrap the data key, the master key or passphrase is wrong")
+	}
+	dataKey, err := hex.DecodeString(dataKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	return newSecretBox(dataKey)
+}
+
+func newSecretBox(key []byte) (result *SecretBox, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// loadMasterKey reads a hex encoded 32 byte key from the config or a file,
+// or derives it from a passphrase entered at startup
+func loadMasterKey(cfg *Config, salt []byte) (key []byte, err error) {
+	keyHex := cfg.EncryptionKey
+	if cfg.EncryptionKeyFile != "" {
+		content, err := os.ReadFile(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keyHex = strings.TrimSpace(string(content))
+	}
+	if keyHex != "" {
+		key, err = hex.DecodeString(keyHex)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("master key has to be 32 bytes hex encoded")
+		}
+		return key, nil
+	}
+
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func readPassphrase() (passphrase string, err error) {
+	fmt.Fprint(os.Stderr, "Enter the passphrase to unlock the secrets: ")
+	defer fmt.Fprintln(os.Stderr)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		bytes, err := term.ReadPassword(int(os.Stdin.Fd()))
+		return string(bytes), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Encrypt returns the encrypted value, empty and already encrypted values are returned unchanged
+func (box *SecretBox) Encrypt(value string) (result string, err error) {
+	if box == nil || value == "" || strings.HasPrefix(value, ENCRYPTED_SECRET_PREFIX) {
+		return value, nil
+	}
+	nonce := make([]byte, box.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := box.aead.Seal(nonce, nonce, []byte(value), nil)
+	return ENCRYPTED_SECRET_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext value, values that were stored before encryption was enabled are returned unchanged
+func (box *SecretBox) Decrypt(value string) (result string, err error) {
+	if !strings.HasPrefix(value, ENCRYPTED_SECRET_PREFIX) {
+		return value, nil
+	}
+	if box == nil {
+		return "", ErrNoMasterKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, ENCRYPTED_SECRET_PREFIX))
+	if err != nil {
+		return "", err
+	}
+	nonceSize := box.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("encrypted secret is too short")
+	}
+	plaintext, err := box.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptStoredSecrets encrypts the service key, OAuth tokens and TOTP secrets that are still stored in plaintext
+func (box *SecretBox) EncryptStoredSecrets(db *gorm.DB) (count int, err error) {
+	if box == nil {
+		return 0, nil
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		identities := []Identity{}
+		err := tx.Where("privkey != '' AND privkey NOT LIKE ?", ENCRYPTED_SECRET_PREFIX+"%").Find(&identities).Error
+		if err != nil {
+			return err
+		}
+		for _, identity := range identities {
+			privkey, err := box.Encrypt(identity.Privkey)
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&identity).UpdateColumn("privkey", privkey).Error
+			if err != nil {
+				return err
+			}
+			count++
+		}
+
+		users := []User{}
+		err = tx.Where("access_token NOT LIKE ? OR refresh_token NOT LIKE ? OR totp_secret NOT LIKE ?", ENCRYPTED_SECRET_PREFIX+"%", ENCRYPTED_SECRET_PREFIX+"%", ENCRYPTED_SECRET_PREFIX+"%").Find(&users).Error
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			accessToken, err := box.Encrypt(user.AccessToken)
+			if err != nil {
+				return err
+			}
+			refreshToken, err := box.Encrypt(user.RefreshToken)
+			if err != nil {
+				return err
+			}
+			totpSecret, err := box.Encrypt(user.TotpSecret)
+			if err != nil {
+				return err
+			}
+			if accessToken == user.AccessToken && refreshToken == user.RefreshToken && totpSecret == user.TotpSecret {
+				continue
+			}
+			err = tx.Model(&user).UpdateColumns(map[string]interface{}{
+				"access_token":  accessToken,
+				"refresh_token": refreshToken,
+				"totp_secret":   totpSecret,
+			}).Error
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
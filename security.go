@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+// context key of the nonce that allows the inline scripts and styles of a page
+const CSP_NONCE_KEY = "csp_nonce"
+
+// a year, only sent on requests over TLS
+const HSTS_MAX_AGE = 31536000
+
+// contentSecurityPolicy only allows the embedded assets and the inline scripts and styles rendered with the nonce of the request.
+// Tailwind's form styles use data: images.
+func contentSecurityPolicy(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		nonceBytes := make([]byte, 16)
+		_, err := rand.Read(nonceBytes)
+		if err != nil {
+			return err
+		}
+		nonce := hex.EncodeToString(nonceBytes)
+		c.Set(CSP_NONCE_KEY, nonce)
+		c.Response().Header().Set(echo.HeaderContentSecurityPolicy, fmt.Sprintf(
+			"default-src 'none'; script-src 'self' 'nonce-%[1]s'; style-src 'self' 'nonce-%[1]s'; img-src 'self' data:; font-src 'self'; connect-src 'self'; base-uri 'none'; frame-ancestors 'none'",
+			nonce,
+		))
+		return next(c)
+	}
+}
+
+// newIPExtractor returns how the client IP of a request is determined. The X-Forwarded-For header is only
+// trusted if the request comes from one of the trusted proxies, a comma separated list of IPs and CIDR ranges,
+// otherwise anyone could pick the IP that is rate limited and recorded in the audit log.
+func newIPExtractor(trustedProxies string) (echo.IPExtractor, error) {
+	options := []echo.TrustOption{}
+	for _, proxy := range strings.Split(trustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		// a single IP
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			options = append(options, echo.TrustIPRange(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}))
+			continue
+		}
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy: %s", proxy)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	if len(options) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	// only the configured proxies, not every proxy on the local network
+	options = append(options, echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false))
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// secureCookies marks all cookies as Secure on requests over TLS, also when terminated by a reverse proxy
+func secureCookies(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Scheme() == "https" {
+			header := c.Response().Header()
+			c.Response().Before(func() {
+				cookies := header[echo.HeaderSetCookie]
+				for i, cookie := range cookies {
+					if !strings.Contains(cookie, "; Secure") {
+						cookies[i] = cookie + "; Secure"
+					}
+				}
+			})
+		}
+		return next(c)
+	}
+}
+
+// noStore keeps pages with secrets, like pairing secrets, out of browser and proxy caches
+func noStore(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+		return next(c)
+	}
+}
+
+// newSessionStore signs sessions with the cookie secret. Sessions signed with the previous secret
+// stay valid and are signed with the new one when saved, so the secret can be rotated without logging everyone out.
+func newSessionStore(cfg *Config) *sessions.CookieStore {
+	keyPairs := [][]byte{[]byte(cfg.CookieSecret), nil}
+	if cfg.CookieSecretPrevious != "" {
+		keyPairs = append(keyPairs, []byte(cfg.CookieSecretPrevious), nil)
+	}
+	store := sessions.NewCookieStore(keyPairs...)
+	store.Options = &sessions.Options{
+		Path:     "/",
+		Domain:   cfg.CookieDomain,
+		MaxAge:   86400 * 30,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return store
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip04"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
@@ -19,8 +22,39 @@ type Service struct {
 	cfg         *Config
 	db          *gorm.DB
 	lnClient    LNClient
+	rateLimiter *RateLimiter
+	// nil if fiat budgets and balances are disabled
+	rateProvider RateProvider
+	// nil if secrets are stored in plaintext
+	secrets     *SecretBox
 	ReceivedEOS bool
 	Logger      *logrus.Logger
+
+	// web UI login in self-hosted LND mode
+	loginLimiter  middleware.RateLimiterStore
+	lndSetupToken string
+	// the identity key is generated and stored in the database and can be rotated
+	identityStored bool
+	// nil unless the identity key is held by a remote signer
+	signer Signer
+	// methods the LN backend can serve for all users, queried at startup. nil if all are supported
+	supportedMethods []string
+	// network of the LN backend, read at startup. empty if it is unknown
+	network string
+
+	// invoices being paid by requests of this process, by app id and payment hash
+	paymentsInFlight sync.Map
+	// the methods the LN backend can serve for a user, by user id
+	userCapabilitiesCache sync.Map
+	// on-chain payments are checked against the budget and recorded one at a time
+	onchainPaymentsMu sync.Mutex
+
+	approvalsMu      sync.Mutex
+	approvalChannels map[uint]chan bool
+	relay            atomic.Pointer[nostr.Relay]
+	subscription     atomic.Pointer[nostr.Subscription]
+	// the identity key, cfg only holds the key the service was started with
+	identity atomic.Pointer[serviceIdentity]
 }
 
 /*var supportedMethods = map[string]bool{
@@ -35,13 +69,13 @@ type Service struct {
 func (svc *Service) GetUser(c echo.Context) (user *User, err error) {
 	sess, _ := session.Get(CookieName, c)
 	userID := sess.Values["user_id"]
-	if svc.cfg.LNBackendType == LNDBackendType {
-		//if we self-host, there is always only one user
-		userID = 1
-	}
 	if userID == nil {
 		return nil, nil
 	}
+	expiresAt, ok := sess.Values["expires_at"].(int64)
+	if !ok || time.Now().Unix() > expiresAt {
+		return nil, nil
+	}
 	user = &User{}
 	err = svc.db.Preload("Apps").First(&user, userID).Error
 	if err != nil {
@@ -54,6 +88,7 @@ func (svc *Service) GetUser(c echo.Context) (user *User, err error) {
 }
 
 func (svc *Service) StartSubscription(ctx context.Context, sub *nostr.Subscription) error {
+	svc.subscription.Store(sub)
 	go func() {
 		<-sub.EndOfStoredEvents
 		svc.ReceivedEOS = true
@@ -170,7 +205,16 @@ func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result
 		NostrPubkey: event.PubKey,
 	}).Error
 	if err != nil {
-		ss, err := nip04.ComputeSharedSecret(event.PubKey, svc.cfg.NostrSecretKey)
+		// don't spend an ECDH and a signature on every unknown sender
+		if !svc.rateLimiter.AllowUnknown() {
+			svc.Logger.WithFields(logrus.Fields{
+				"eventId":   event.ID,
+				"eventKind": event.Kind,
+				"pubkey":    event.PubKey,
+			}).Warn("Rate limit for unknown pubkeys exceeded, dropping event")
+			return nil, nil
+		}
+		signer, err := svc.eventSigner(event)
 		if err != nil {
 			return nil, err
 		}
@@ -179,7 +223,7 @@ func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result
 				Code:    NIP_47_ERROR_UNAUTHORIZED,
 				Message: "The public key does not have a wallet connected.",
 			},
-		}, ss)
+		}, signer)
 		return resp, err
 	}
 
@@ -189,12 +233,13 @@ func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result
 		"appId":     app.ID,
 	}).Info("App found for nostr event")
 
-	//to be extra safe, decrypt using the key found from the app
-	ss, err := nip04.ComputeSharedSecret(app.NostrPubkey, svc.cfg.NostrSecretKey)
+	//to be extra safe, decrypt using the pubkey found from the app
+	//and the service key the request was sent to, which might be a rotated one
+	signer, err := svc.eventSigner(event)
 	if err != nil {
 		return nil, err
 	}
-	payload, err := nip04.Decrypt(event.Content, ss)
+	payload, err := signer.Nip04Decrypt(app.NostrPubkey, event.Content)
 	if err != nil {
 		svc.Logger.WithFields(logrus.Fields{
 			"eventId":   event.ID,
@@ -208,71 +253,200 @@ func (svc *Service) HandleEvent(ctx context.Context, event *nostr.Event) (result
 	if err != nil {
 		return nil, err
 	}
+	if !svc.rateLimiter.AllowApp(app.ID, nip47Request.Method) {
+		svc.Logger.WithFields(logrus.Fields{
+			"eventId":       event.ID,
+			"eventKind":     event.Kind,
+			"appId":         app.ID,
+			"requestMethod": nip47Request.Method,
+		}).Warn("Rate limit exceeded")
+		return svc.createResponse(event, Nip47Response{
+			ResultType: nip47Request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_RATE_LIMITED,
+				Message: "Too many requests, please slow down.",
+			}}, signer)
+	}
+	if isCapability(nip47Request.Method) && !containsMethod(svc.userCapabilities(ctx, app.UserId), nip47Request.Method) {
+		return svc.createResponse(event, Nip47Response{
+			ResultType: nip47Request.Method,
+			Error: &Nip47Error{
+				Code:    NIP_47_ERROR_NOT_IMPLEMENTED,
+				Message: fmt.Sprintf("%s is not supported by this wallet", nip47Request.Method),
+			}}, signer)
+	}
 	switch nip47Request.Method {
 	case NIP_47_PAY_INVOICE_METHOD:
-		return svc.HandlePayInvoiceEvent(ctx, nip47Request, event, app, ss)
+		return svc.HandlePayInvoiceEvent(ctx, nip47Request, event, app, signer)
 	case NIP_47_PAY_KEYSEND_METHOD:
-		return svc.HandlePayKeysendEvent(ctx, nip47Request, event, app, ss)
+		return svc.HandlePayKeysendEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_PAY_LNURL_METHOD:
+		return svc.HandlePayLnurlEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_MAKE_HOLD_INVOICE_METHOD:
+		return svc.HandleMakeHoldInvoiceEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_SETTLE_HOLD_INVOICE_METHOD:
+		return svc.HandleSettleHoldInvoiceEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_CANCEL_HOLD_INVOICE_METHOD:
+		return svc.HandleCancelHoldInvoiceEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_PAY_OFFER_METHOD:
+		return svc.HandlePayOfferEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_MAKE_OFFER_METHOD:
+		return svc.HandleMakeOfferEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_GET_BUDGET_METHOD:
+		return svc.HandleGetBudgetEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_MAKE_ONCHAIN_ADDRESS_METHOD:
+		return svc.HandleMakeOnchainAddressEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_GET_ONCHAIN_BALANCE_METHOD:
+		return svc.HandleGetOnchainBalanceEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_PAY_ONCHAIN_METHOD:
+		return svc.HandlePayOnchainEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_LIST_CHANNELS_METHOD:
+		return svc.HandleListChannelsEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_GET_LIQUIDITY_METHOD:
+		return svc.HandleGetLiquidityEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_LIST_PENDING_CHANNELS_METHOD:
+		return svc.HandleListPendingChannelsEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_SIGN_MESSAGE_METHOD:
+		return svc.HandleSignMessageEvent(ctx, nip47Request, event, app, signer)
+	case NIP_47_VERIFY_MESSAGE_METHOD:
+		return svc.HandleVerifyMessageEvent(ctx, nip47Request, event, app, signer)
 	case NIP_47_GET_BALANCE_METHOD:
-		return svc.HandleGetBalanceEvent(ctx, nip47Request, event, app, ss)
+		return svc.HandleGetBalanceEvent(ctx, nip47Request, event, app, signer)
 	case NIP_47_MAKE_INVOICE_METHOD:
-		return svc.HandleMakeInvoiceEvent(ctx, nip47Request, event, app, ss)
+		return svc.HandleMakeInvoiceEvent(ctx, nip47Request, event, app, signer)
 	case NIP_47_LOOKUP_INVOICE_METHOD:
-		return svc.HandleLookupInvoiceEvent(ctx, nip47Request, event, app, ss)
+		return svc.HandleLookupInvoiceEvent(ctx, nip47Request, event, app, signer)
 	case NIP_47_LIST_TRANSACTIONS_METHOD:
-		return svc.HandleListTransactionsEvent(ctx, nip47Request, event, app, ss)
+		return svc.HandleListTransactionsEvent(ctx, nip47Request, event, app, signer)
 	case NIP_47_GET_INFO_METHOD:
-		return svc.HandleGetInfoEvent(ctx, nip47Request, event, app, ss)
+		return svc.HandleGetInfoEvent(ctx, nip47Request, event, app, signer)
 	default:
 		return svc.createResponse(event, Nip47Response{
 			ResultType: nip47Request.Method,
 			Error: &Nip47Error{
 				Code:    NIP_47_ERROR_NOT_IMPLEMENTED,
 				Message: fmt.Sprintf("Unknown method: %s", nip47Request.Method),
-			}}, ss)
+			}}, signer)
 	}
 }
 
-func (svc *Service) createResponse(initialEvent *nostr.Event, content interface{}, ss []byte) (result *nostr.Event, err error) {
+// nip47ErrorCode returns the NIP-47 error code for an error of the LN backend
+func nip47ErrorCode(err error) string {
+	if errors.Is(err, ErrNotImplemented) {
+		return NIP_47_ERROR_NOT_IMPLEMENTED
+	}
+	return NIP_47_ERROR_INTERNAL
+}
+
+func (svc *Service) createResponse(initialEvent *nostr.Event, content interface{}, signer Signer) (result *nostr.Event, err error) {
 	payloadBytes, err := json.Marshal(content)
 	if err != nil {
 		return nil, err
 	}
-	msg, err := nip04.Encrypt(string(payloadBytes), ss)
+	// the signer holds the key the request was sent to, the reply comes from the same key
+	msg, err := signer.Nip04Encrypt(initialEvent.PubKey, string(payloadBytes))
 	if err != nil {
 		return nil, err
 	}
 	resp := &nostr.Event{
-		PubKey:    svc.cfg.IdentityPubkey,
 		CreatedAt: nostr.Now(),
 		Kind:      NIP_47_RESPONSE_KIND,
 		Tags:      nostr.Tags{[]string{"p", initialEvent.PubKey}, []string{"e", initialEvent.ID}},
 		Content:   msg,
 	}
-	err = resp.Sign(svc.cfg.NostrSecretKey)
+	err = signer.SignEvent(resp)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func (svc *Service) GetMethods(app *App) []string {
+func (svc *Service) GetMethods(ctx context.Context, app *App) []string {
+	capabilities := svc.userCapabilities(ctx, app.UserId)
 	appPermissions := []AppPermission{}
 	findPermissionsResult := svc.db.Find(&appPermissions, &AppPermission{
 		AppId: app.ID,
 	})
 	if findPermissionsResult.RowsAffected == 0 {
-		// No permissions created for this app. It can do anything
-		return strings.Split(NIP_47_CAPABILITIES, " ")
+		// No permissions created for this app. It can do anything except the opt-in methods
+		requestMethods := []string{}
+		for _, method := range capabilities {
+			if method != NIP_47_PAY_ONCHAIN_METHOD {
+				requestMethods = append(requestMethods, method)
+			}
+		}
+		return requestMethods
 	}
 	requestMethods := make([]string, 0, len(appPermissions))
 	for _, appPermission := range appPermissions {
-		requestMethods = append(requestMethods, appPermission.RequestMethod)
+		if containsMethod(capabilities, appPermission.RequestMethod) {
+			requestMethods = append(requestMethods, appPermission.RequestMethod)
+		}
 	}
 	return requestMethods
 }
 
+// isCapability returns whether a method is implemented by this service, independent of the LN backend
+func isCapability(method string) bool {
+	return containsMethod(strings.Split(NIP_47_CAPABILITIES, " "), method)
+}
+
+// capabilities returns the methods announced in the info event, the ones the LN backend can serve for all users
+func (svc *Service) capabilities() []string {
+	if svc.supportedMethods == nil {
+		return strings.Split(NIP_47_CAPABILITIES, " ")
+	}
+	return svc.supportedMethods
+}
+
+// how long the methods the LN backend can serve for a user are reused, e.g. until newly granted OAuth scopes take effect
+const userCapabilitiesCacheDuration = 10 * time.Minute
+
+type cachedCapabilities struct {
+	methods   []string
+	fetchedAt time.Time
+}
+
+// userCapabilities returns the methods the LN backend can serve for a user, e.g. for the user of an app.
+// They are queried once per user and cache duration, not on every request.
+func (svc *Service) userCapabilities(ctx context.Context, userId uint) []string {
+	if cached, ok := svc.userCapabilitiesCache.Load(userId); ok && time.Since(cached.(cachedCapabilities).fetchedAt) < userCapabilitiesCacheDuration {
+		return cached.(cachedCapabilities).methods
+	}
+	user := User{}
+	err := svc.db.First(&user, userId).Error
+	if err != nil {
+		svc.Logger.WithField("userId", userId).WithError(err).Error("Failed to load the user")
+		return svc.capabilities()
+	}
+	methods, err := svc.lnClient.GetSupportedMethods(ctx, &user)
+	if err != nil {
+		svc.Logger.WithField("userId", userId).WithError(err).Error("Failed to fetch the supported methods of the wallet backend")
+		return svc.capabilities()
+	}
+	svc.userCapabilitiesCache.Store(userId, cachedCapabilities{methods: methods, fetchedAt: time.Now()})
+	return methods
+}
+
+// hasPaymentPermission checks the permission of a payment method, other methods than pay_invoice need their own permission.
+// The payment is always counted against the pay_invoice budget.
+func (svc *Service) hasPaymentPermission(app *App, event *nostr.Event, requestMethod string, amount int64) (result bool, code string, message string) {
+	if requestMethod != NIP_47_PAY_INVOICE_METHOD {
+		result, code, message = svc.hasPermission(app, event, requestMethod, 0)
+		if !result {
+			return result, code, message
+		}
+	}
+	return svc.hasPermission(app, event, NIP_47_PAY_INVOICE_METHOD, amount)
+}
+
 func (svc *Service) hasPermission(app *App, event *nostr.Event, requestMethod string, amount int64) (result bool, code string, message string) {
+	defer func() {
+		// other requests check the permission without an amount
+		if !result && amount > 0 {
+			svc.auditPaymentDenied(app, requestMethod, amount, code, message)
+		}
+	}()
 	// find all permissions for the app
 	appPermissions := []AppPermission{}
 	findPermissionsResult := svc.db.Find(&appPermissions, &AppPermission{
@@ -286,6 +460,13 @@ func (svc *Service) hasPermission(app *App, event *nostr.Event, requestMethod st
 			"appId":         app.ID,
 			"pubkey":        app.NostrPubkey,
 		}).Info("No permissions found for app")
+		if requestMethod == NIP_47_PAY_ONCHAIN_METHOD {
+			// on-chain payments are opt-in
+			return false, NIP_47_ERROR_RESTRICTED, fmt.Sprintf("This app does not have permission to request %s", requestMethod)
+		}
+		if requestMethod == NIP_47_PAY_INVOICE_METHOD {
+			return svc.hasUserBudget(app, amount)
+		}
 		return true, "", ""
 	}
 
@@ -311,13 +492,57 @@ func (svc *Service) hasPermission(app *App, event *nostr.Event, requestMethod st
 
 	if requestMethod == NIP_47_PAY_INVOICE_METHOD {
 		maxAmount := appPermission.MaxAmount
-		if maxAmount != 0 {
+		if maxAmount != 0 && appPermission.BudgetCurrency != "" {
+			rate, err := svc.getFiatRate(context.Background(), appPermission.BudgetCurrency)
+			if err != nil {
+				svc.Logger.WithFields(logrus.Fields{
+					"eventId":  event.ID,
+					"appId":    app.ID,
+					"currency": appPermission.BudgetCurrency,
+				}).Errorf("Failed to fetch rate for budget: %v", err)
+				return false, NIP_47_ERROR_INTERNAL, "Failed to fetch exchange rate for budget"
+			}
+			budgetUsage := svc.GetFiatBudgetUsage(&appPermission)
+
+			if budgetUsage+msatToFiatCents(amount, rate) > int64(maxAmount)*100 {
+				return false, NIP_47_ERROR_QUOTA_EXCEEDED, "Insufficient budget remaining to make payment"
+			}
+		} else if maxAmount != 0 {
 			budgetUsage := svc.GetBudgetUsage(&appPermission)
 
 			if budgetUsage+amount/1000 > int64(maxAmount) {
 				return false, NIP_47_ERROR_QUOTA_EXCEEDED, "Insufficient budget remaining to make payment"
 			}
 		}
+		return svc.hasUserBudget(app, amount)
+	}
+
+	if requestMethod == NIP_47_PAY_ONCHAIN_METHOD {
+		maxAmount := appPermission.MaxAmount
+		if maxAmount != 0 {
+			budgetUsage := svc.GetOnchainBudgetUsage(&appPermission)
+
+			if budgetUsage+amount/1000 > int64(maxAmount) {
+				return false, NIP_47_ERROR_QUOTA_EXCEEDED, "Insufficient on-chain budget remaining to make payment"
+			}
+		}
+	}
+	return true, "", ""
+}
+
+// hasUserBudget checks the account-wide budget shared by all apps of the user
+func (svc *Service) hasUserBudget(app *App, amount int64) (result bool, code string, message string) {
+	user := User{}
+	err := svc.db.First(&user, app.UserId).Error
+	if err != nil {
+		return false, NIP_47_ERROR_INTERNAL, "Failed to load account budget"
+	}
+	if user.MaxAmount == 0 {
+		return true, "", ""
+	}
+	budgetUsage := svc.GetUserBudgetUsage(&user)
+	if budgetUsage+amount/1000 > int64(user.MaxAmount) {
+		return false, NIP_47_ERROR_QUOTA_EXCEEDED, "Insufficient account budget remaining to make payment"
 	}
 	return true, "", ""
 }
@@ -330,13 +555,67 @@ func (svc *Service) GetBudgetUsage(appPermission *AppPermission) int64 {
 	return int64(result.Sum)
 }
 
+// GetFiatBudgetUsage sums the payments of the app in the minor unit of its budget currency
+func (svc *Service) GetFiatBudgetUsage(appPermission *AppPermission) int64 {
+	var result struct {
+		Sum int64
+	}
+	svc.db.Table("payments").Select("SUM(fiat_amount) as sum").Where("app_id = ? AND fiat_currency = ? AND preimage IS NOT NULL AND created_at > ?", appPermission.AppId, appPermission.BudgetCurrency, GetStartOfBudget(appPermission.BudgetRenewal, appPermission.App.CreatedAt)).Scan(&result)
+	return result.Sum
+}
+
+// GetOnchainBudgetUsage sums the broadcast on-chain payments of the app, excluding fees
+func (svc *Service) GetOnchainBudgetUsage(appPermission *AppPermission) int64 {
+	var result struct {
+		Sum uint
+	}
+	// pending payments might have been broadcast already
+	svc.db.Table("onchain_payments").Select("SUM(amount) as sum").Where("app_id = ? AND state <> ? AND created_at > ?", appPermission.AppId, ONCHAIN_PAYMENT_STATE_FAILED, GetStartOfBudget(appPermission.BudgetRenewal, appPermission.App.CreatedAt)).Scan(&result)
+	return int64(result.Sum)
+}
+
+func (svc *Service) GetUserBudgetUsage(user *User) int64 {
+	var result struct {
+		Sum uint
+	}
+	svc.db.Table("payments").Select("SUM(payments.amount) as sum").Joins("JOIN apps ON apps.id = payments.app_id").Where("apps.user_id = ? AND payments.preimage IS NOT NULL AND payments.created_at > ?", user.ID, GetStartOfBudget(user.BudgetRenewal, user.CreatedAt)).Scan(&result)
+	return int64(result.Sum)
+}
+
+// PublishNip47Info publishes the info event of the identity key and of the service keys of all apps
 func (svc *Service) PublishNip47Info(ctx context.Context, relay *nostr.Relay) error {
+	identity := svc.activeIdentity()
+	err := svc.publishNip47Info(ctx, relay, identity.secretKey, identity.pubkey, svc.capabilities())
+	if err != nil {
+		return err
+	}
+	apps := []App{}
+	svc.db.Where("wallet_pubkey != ''").Find(&apps)
+	for _, app := range apps {
+		err = svc.PublishAppNip47Info(ctx, relay, &app)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *Service) PublishAppNip47Info(ctx context.Context, relay *nostr.Relay, app *App) error {
+	serviceKey, servicePubkey, err := svc.appServiceKey(app)
+	if err != nil {
+		return err
+	}
+	// an own service key announces what the backend can serve for the user of the app
+	return svc.publishNip47Info(ctx, relay, serviceKey, servicePubkey, svc.userCapabilities(ctx, app.UserId))
+}
+
+func (svc *Service) publishNip47Info(ctx context.Context, relay *nostr.Relay, serviceKey string, servicePubkey string, capabilities []string) error {
 	ev := &nostr.Event{}
 	ev.Kind = NIP_47_INFO_EVENT_KIND
-	ev.Content = NIP_47_CAPABILITIES
+	ev.Content = strings.Join(capabilities, " ")
+	ev.Tags = nostr.Tags{[]string{"notifications", NIP_47_NOTIFICATION_TYPES}}
 	ev.CreatedAt = nostr.Now()
-	ev.PubKey = svc.cfg.IdentityPubkey
-	err := ev.Sign(svc.cfg.NostrSecretKey)
+	err := svc.signerFor(serviceKey, servicePubkey).SignEvent(ev)
 	if err != nil {
 		return err
 	}
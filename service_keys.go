@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// prefix of the HMAC input so the derived keys can't collide with other uses of the identity key
+const APP_SERVICE_KEY_DERIVATION_PREFIX = "nwc-app-service-key:"
+
+// deriveAppServiceKey derives the wallet service key of an app deterministically from the identity key
+// and the app's pubkey, so it never has to be stored and survives restarts
+func deriveAppServiceKey(identityKey string, appPubkey string) (secretKey string, pubkey string, err error) {
+	identityKeyBytes, err := hex.DecodeString(identityKey)
+	if err != nil {
+		return "", "", err
+	}
+	// e.g. the identity key is held by a remote signer
+	if len(identityKeyBytes) != 32 {
+		return "", "", errors.New("app service keys can only be derived from a local identity key")
+	}
+	mac := hmac.New(sha256.New, identityKeyBytes)
+	mac.Write([]byte(APP_SERVICE_KEY_DERIVATION_PREFIX + appPubkey))
+	// reduces the digest modulo the curve order
+	privateKey, _ := btcec.PrivKeyFromBytes(mac.Sum(nil))
+	secretKey = hex.EncodeToString(privateKey.Serialize())
+	pubkey, err = nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return "", "", err
+	}
+	return secretKey, pubkey, nil
+}
+
+type serviceIdentity struct {
+	secretKey string
+	pubkey    string
+}
+
+// activeIdentity returns the identity key, read it once per use as it is replaced when the key is rotated
+func (svc *Service) activeIdentity() serviceIdentity {
+	return *svc.identity.Load()
+}
+
+func (svc *Service) setActiveIdentity(secretKey string, pubkey string) {
+	svc.identity.Store(&serviceIdentity{secretKey: secretKey, pubkey: pubkey})
+}
+
+// appServiceKey returns the wallet service key the app is paired with,
+// apps created without a key of their own use the identity key
+func (svc *Service) appServiceKey(app *App) (secretKey string, pubkey string, err error) {
+	identity := svc.activeIdentity()
+	if app.WalletPubkey == "" {
+		return identity.secretKey, identity.pubkey, nil
+	}
+	return deriveAppServiceKey(identity.secretKey, app.NostrPubkey)
+}
+
+// serviceIdentities returns the active identity key first,
+// followed by rotated keys that are still answered during their grace period
+func (svc *Service) serviceIdentities() []serviceIdentity {
+	identities := []serviceIdentity{svc.activeIdentity()}
+	retired := []Identity{}
+	svc.db.Where("retired_at IS NOT NULL AND expires_at > ?", time.Now()).Order("retired_at desc").Find(&retired)
+	for _, identity := range retired {
+		secretKey, err := svc.secrets.Decrypt(identity.Privkey)
+		if err != nil {
+			svc.Logger.WithField("identityId", identity.ID).WithError(err).Error("Failed to decrypt rotated key")
+			continue
+		}
+		pubkey, err := nostr.GetPublicKey(secretKey)
+		if err != nil {
+			continue
+		}
+		identities = append(identities, serviceIdentity{secretKey: secretKey, pubkey: pubkey})
+	}
+	return identities
+}
+
+// eventServiceKey returns the wallet service key a request was addressed to in its p tag,
+// including the keys that are still answered during the grace period after a rotation.
+// Unknown pubkeys fall back to the identity key.
+func (svc *Service) eventServiceKey(event *nostr.Event) (secretKey string, pubkey string, err error) {
+	servicePubkey := ""
+	if tag := event.Tags.GetFirst([]string{"p", ""}); tag != nil {
+		servicePubkey = tag.Value()
+	}
+	active := svc.activeIdentity()
+	if servicePubkey == "" || servicePubkey == active.pubkey {
+		return active.secretKey, active.pubkey, nil
+	}
+	app := App{}
+	err = svc.db.Where("wallet_pubkey = ?", servicePubkey).Limit(1).Find(&app).Error
+	if err != nil {
+		return "", "", err
+	}
+	if app.ID != 0 {
+		return svc.appServiceKey(&app)
+	}
+
+	retired := svc.serviceIdentities()[1:]
+	for _, identity := range retired {
+		if identity.pubkey == servicePubkey {
+			return identity.secretKey, identity.pubkey, nil
+		}
+	}
+	if len(retired) > 0 {
+		apps := []App{}
+		err = svc.db.Where("wallet_pubkey != ''").Find(&apps).Error
+		if err != nil {
+			return "", "", err
+		}
+		for _, app := range apps {
+			for _, identity := range retired {
+				secretKey, pubkey, err := deriveAppServiceKey(identity.secretKey, app.NostrPubkey)
+				if err != nil {
+					return "", "", err
+				}
+				if pubkey == servicePubkey {
+					return secretKey, pubkey, nil
+				}
+			}
+		}
+	}
+	return active.secretKey, active.pubkey, nil
+}
+
+// servicePubkeys returns the pubkeys of all service identities and the service pubkeys of all apps
+func (svc *Service) servicePubkeys() []string {
+	identities := svc.serviceIdentities()
+	pubkeys := []string{}
+	for _, identity := range identities {
+		pubkeys = append(pubkeys, identity.pubkey)
+	}
+	apps := []App{}
+	svc.db.Where("wallet_pubkey != ''").Find(&apps)
+	for _, app := range apps {
+		pubkeys = append(pubkeys, app.WalletPubkey)
+		// the keys derived from rotated identities
+		for _, identity := range identities[1:] {
+			_, pubkey, err := deriveAppServiceKey(identity.secretKey, app.NostrPubkey)
+			if err == nil {
+				pubkeys = append(pubkeys, pubkey)
+			}
+		}
+	}
+	return pubkeys
+}
+
+// UpdateSubscription replaces the filters of the running subscription, e.g. to listen to the key of a new app
+func (svc *Service) UpdateSubscription(ctx context.Context) {
+	sub := svc.subscription.Load()
+	if sub == nil {
+		return
+	}
+	sub.Sub(ctx, svc.createFilters())
+}
+
+// RotateIdentity replaces the identity key with a new one. The previous key is still answered
+// for the grace period and connected apps are notified of their new service pubkey from their previous key.
+func (svc *Service) RotateIdentity(ctx context.Context) (identity *Identity, err error) {
+	if !svc.identityStored {
+		return nil, errors.New("The service key is set with NOSTR_PRIVKEY and can't be rotated")
+	}
+	previous := svc.activeIdentity()
+	secretKey := nostr.GeneratePrivateKey()
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := svc.secrets.Encrypt(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	retiredAt := time.Now()
+	expiresAt := retiredAt.Add(time.Duration(svc.cfg.KeyRotationGracePeriod) * time.Second)
+
+	identity = &Identity{Privkey: encryptedKey}
+	apps := []App{}
+	err = svc.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Identity{}).Where("retired_at IS NULL").Updates(map[string]interface{}{
+			"retired_at": retiredAt,
+			"expires_at": expiresAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Create(identity).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Find(&apps).Error
+		if err != nil {
+			return err
+		}
+		for i := range apps {
+			if apps[i].WalletPubkey == "" {
+				continue
+			}
+			_, apps[i].WalletPubkey, err = deriveAppServiceKey(secretKey, apps[i].NostrPubkey)
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&apps[i]).UpdateColumn("wallet_pubkey", apps[i].WalletPubkey).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	svc.setActiveIdentity(secretKey, pubkey)
+	svc.Logger.WithFields(logrus.Fields{
+		"previousPubkey": previous.pubkey,
+		"pubkey":         pubkey,
+		"expiresAt":      expiresAt,
+	}).Info("Rotated the service key")
+	svc.UpdateSubscription(ctx)
+
+	if relay := svc.relay.Load(); relay != nil {
+		go svc.announceRotation(context.Background(), relay, previous, apps, expiresAt)
+	}
+	return identity, nil
+}
+
+// announceRotation publishes the info events of the new keys and notifies each app from the key it is still using
+func (svc *Service) announceRotation(ctx context.Context, relay *nostr.Relay, previous serviceIdentity, apps []App, expiresAt time.Time) {
+	err := svc.PublishNip47Info(ctx, relay)
+	if err != nil {
+		svc.Logger.WithError(err).Error("Could not publish NIP47 info")
+	}
+	for _, app := range apps {
+		event, err := svc.createRotationNotification(&app, previous, expiresAt)
+		if err == nil {
+			_, err = relay.Publish(ctx, *event)
+		}
+		if err != nil {
+			svc.Logger.WithField("appId", app.ID).WithError(err).Error("Failed to notify app about the rotated service key")
+		}
+	}
+}
+
+func (svc *Service) createRotationNotification(app *App, previous serviceIdentity, expiresAt time.Time) (*nostr.Event, error) {
+	_, pubkey, err := svc.appServiceKey(app)
+	if err != nil {
+		return nil, err
+	}
+	previousKey, previousPubkey := previous.secretKey, previous.pubkey
+	if app.WalletPubkey != "" {
+		previousKey, previousPubkey, err = deriveAppServiceKey(previous.secretKey, app.NostrPubkey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return svc.createNotificationWithKey(app, previousKey, previousPubkey, NIP_47_SERVICE_KEY_ROTATED, Nip47ServiceKeyRotatedNotification{
+		Pubkey:    pubkey,
+		ExpiresAt: expiresAt.Unix(),
+	})
+}
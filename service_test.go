@@ -2,16 +2,47 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	echologrus "github.com/davrux/echo-logrus/v4"
+	"github.com/getAlby/nostr-wallet-connect/lnd"
 	"github.com/glebarez/sqlite"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/labstack/echo/v4"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip04"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/macaroon.v2"
 	"gorm.io/gorm"
 )
 
@@ -74,14 +105,16 @@ const nip47KeysendJson = `
 }
 `
 
-const nip47PayJson = `
+// the invoice is for 123 sats
+var nip47PayJson = fmt.Sprintf(`
 {
 	"method": "pay_invoice",
 	"params": {
-		"invoice": "lntb1230n1pjypux0pp5xgxzcks5jtx06k784f9dndjh664wc08ucrganpqn52d0ftrh9n8sdqyw3jscqzpgxqyz5vqsp5rkx7cq252p3frx8ytjpzc55rkgyx2mfkzzraa272dqvr2j6leurs9qyyssqhutxa24r5hqxstchz5fxlslawprqjnarjujp5sm3xj7ex73s32sn54fthv2aqlhp76qmvrlvxppx9skd3r5ut5xutgrup8zuc6ay73gqmra29m"
+		"invoice": "%s"
 	}
 }
-`
+`, createMockInvoice(123000, time.Hour, &chaincfg.TestNet3Params))
+
 const nip47PayWrongMethodJson = `
 {
 	"method": "get_balance",
@@ -275,7 +308,9 @@ func TestHandleEvent(t *testing.T) {
 	err = json.Unmarshal([]byte(decrypted), received)
 	assert.NoError(t, err)
 	assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
-	// permissions: budget overflow
+	// permissions: budget overflow, with an invoice that wasn't paid yet
+	newPayload, err = nip04.Encrypt(fmt.Sprintf(`{"method": "pay_invoice", "params": {"invoice": "%s"}}`, createMockInvoice(123000, time.Hour, &chaincfg.TestNet3Params)), ss)
+	assert.NoError(t, err)
 	newMaxAmount := 100
 	err = svc.db.Model(&AppPermission{}).Where("app_id = ?", app.ID).Update("max_amount", newMaxAmount).Error
 
@@ -362,6 +397,22 @@ func TestHandleEvent(t *testing.T) {
 	err = svc.db.Model(&AppPermission{}).Where("app_id = ?", app.ID).Update("request_method", NIP_47_PAY_INVOICE_METHOD).Update("max_amount", newMaxAmount).Error
 	assert.NoError(t, err)
 	err = svc.db.Create(appPermission).Error
+	// the pay_invoice permission alone doesn't allow keysend payments
+	res, err = svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_pay_keysend_event_restricted",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: newPayload,
+	})
+	assert.NoError(t, err)
+	decrypted, err = nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+	err = svc.db.Create(&AppPermission{AppId: app.ID, RequestMethod: NIP_47_PAY_KEYSEND_METHOD}).Error
+	assert.NoError(t, err)
 	res, err = svc.HandleEvent(ctx, &nostr.Event{
 		ID:      "test_pay_keysend_event_2",
 		Kind:    NIP_47_REQUEST_KIND,
@@ -508,6 +559,9 @@ func TestHandleEvent(t *testing.T) {
 	// lookup_invoice: with permission
 	err = svc.db.Model(&AppPermission{}).Where("app_id = ?", app.ID).Update("request_method", NIP_47_LOOKUP_INVOICE_METHOD).Error
 	assert.NoError(t, err)
+	// the invoice was paid to the lightning address with a comment
+	err = svc.db.Create(&LightningAddressComment{PaymentHash: mockTransaction.PaymentHash, Comment: "thanks"}).Error
+	assert.NoError(t, err)
 	res, err = svc.HandleEvent(ctx, &nostr.Event{
 		ID:      "test_event_15",
 		Kind:    NIP_47_REQUEST_KIND,
@@ -524,6 +578,7 @@ func TestHandleEvent(t *testing.T) {
 	err = json.Unmarshal([]byte(decrypted), received)
 	assert.NoError(t, err)
 	assert.Equal(t, mockTransaction.Preimage, received.Result.(*Nip47LookupInvoiceResponse).Preimage)
+	assert.Equal(t, "thanks", received.Result.(*Nip47LookupInvoiceResponse).Comment)
 
 	// list_transactions: without permission
 	newPayload, err = nip04.Encrypt(nip47ListTransactionsJson, ss)
@@ -573,6 +628,9 @@ func TestHandleEvent(t *testing.T) {
 	assert.Equal(t, mockTransactions[0].Amount, transaction.Amount)
 	assert.Equal(t, mockTransactions[0].FeesPaid, transaction.FeesPaid)
 	assert.Equal(t, mockTransactions[0].SettledAt, transaction.SettledAt)
+	assert.Equal(t, "thanks", transaction.Comment)
+	assert.Empty(t, received.Result.(*Nip47ListTransactionsResponse).Transactions[1].Comment)
+	assert.Empty(t, mockTransactions[0].Comment)
 
 	// get_info: without permission
 	newPayload, err = nip04.Encrypt(nip47GetInfoJson, ss)
@@ -628,60 +686,2896 @@ func TestHandleEvent(t *testing.T) {
 	assert.Equal(t, []string{"get_info"}, received.Result.(*Nip47GetInfoResponse).Methods)
 }
 
-func createTestService(t *testing.T) (svc *Service, ln *MockLn) {
-	db, err := gorm.Open(sqlite.Open(testDB), &gorm.Config{})
+func TestHandleEventRateLimited(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+	rateLimiter, err := NewRateLimiter(&Config{
+		RateLimitAppRequests:     10,
+		RateLimitAppBurst:        10,
+		RateLimitMethodRequests:  "get_balance:1",
+		RateLimitUnknownRequests: 1,
+	})
 	assert.NoError(t, err)
-	err = db.AutoMigrate(&User{}, &App{}, &AppPermission{}, &NostrEvent{}, &Payment{}, &Identity{})
+	svc.rateLimiter = rateLimiter
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
 	assert.NoError(t, err)
-	ln = &MockLn{}
-	sk := nostr.GeneratePrivateKey()
-	pk, err := nostr.GetPublicKey(sk)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(nip47GetBalanceJson, ss)
 	assert.NoError(t, err)
 
-	logger := logrus.New()
-	logger.SetFormatter(&logrus.JSONFormatter{})
-	logger.SetOutput(os.Stdout)
-	logger.SetLevel(logrus.InfoLevel)
+	// unknown pubkey: first request is answered, second one is dropped
+	res, err := svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_rate_limit_event_1",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	res, err = svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_rate_limit_event_2",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, res)
 
-	return &Service{
-		cfg: &Config{
-			NostrSecretKey: sk,
-			IdentityPubkey: pk,
-		},
-		db:          db,
-		lnClient:    ln,
-		ReceivedEOS: false,
-		Logger:      logger,
-	}, ln
-}
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
 
-type MockLn struct {
-}
+	// known app: get_balance is limited to one request per minute
+	res, err = svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_rate_limit_event_3",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	decrypted, err := nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{
+		Result: &Nip47BalanceResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, int64(21000), received.Result.(*Nip47BalanceResponse).Balance)
 
-func (mln *MockLn) SendPaymentSync(ctx context.Context, senderPubkey string, payReq string) (preimage string, err error) {
-	return "123preimage", nil
-}
+	res, err = svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_rate_limit_event_4",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	decrypted, err = nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_RATE_LIMITED, received.Error.Code)
 
-func (mln *MockLn) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, custom_records []TLVRecord) (preImage string, err error) {
-	return "123preimage", nil
+	// other methods still have room in the app bucket
+	payload, err = nip04.Encrypt(nip47GetInfoJson, ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_rate_limit_event_5",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	decrypted, err = nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{
+		Result: &Nip47GetInfoResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Nil(t, received.Error)
 }
 
-func (mln *MockLn) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
-	return 21, nil
+func TestHandleEventPaymentApproval(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+	svc.cfg.PaymentApprovalTimeout = 5
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	// the invoice is for 123 sats
+	appPermission := &AppPermission{
+		AppId:             app.ID,
+		App:               app,
+		RequestMethod:     NIP_47_PAY_INVOICE_METHOD,
+		ApprovalThreshold: 100,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+
+	payload, err := nip04.Encrypt(nip47PayJson, ss)
+	assert.NoError(t, err)
+
+	decide := func(approve bool) {
+		approval := PaymentApproval{}
+		assert.Eventually(t, func() bool {
+			return svc.db.Where("state = ?", PAYMENT_APPROVAL_STATE_PENDING).Limit(1).Find(&approval).RowsAffected == 1
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, uint(123), approval.Amount)
+		err := svc.DecidePaymentApproval(user, approval.ID, approve)
+		assert.NoError(t, err)
+	}
+
+	// approved payment
+	go decide(true)
+	res, err := svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_approval_event_1",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	decrypted, err := nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{
+		Result: &Nip47PayResponse{},
+	}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
+
+	// rejected payment
+	go decide(false)
+	payload, err = nip04.Encrypt(fmt.Sprintf(`{"method": "pay_invoice", "params": {"invoice": "%s"}}`, createMockInvoice(123000, time.Hour, &chaincfg.TestNet3Params)), ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_approval_event_2",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	decrypted, err = nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+
+	// a decided approval can't be decided again
+	approval := PaymentApproval{}
+	svc.db.Where("state = ?", PAYMENT_APPROVAL_STATE_REJECTED).First(&approval)
+	err = svc.DecidePaymentApproval(user, approval.ID, true)
+	assert.Error(t, err)
+
+	// approved just before the timeout, before the decision was sent on the channel
+	svc.cfg.PaymentApprovalTimeout = 1
+	go func() {
+		pending := PaymentApproval{}
+		assert.Eventually(t, func() bool {
+			return svc.db.Where("state = ?", PAYMENT_APPROVAL_STATE_PENDING).Limit(1).Find(&pending).RowsAffected == 1
+		}, 2*time.Second, 10*time.Millisecond)
+		svc.db.Model(&pending).Update("state", PAYMENT_APPROVAL_STATE_APPROVED)
+	}()
+	payload, err = nip04.Encrypt(fmt.Sprintf(`{"method": "pay_invoice", "params": {"invoice": "%s"}}`, createMockInvoice(123000, time.Hour, &chaincfg.TestNet3Params)), ss)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_approval_event_3",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	decrypted, err = nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received = &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Nil(t, received.Error)
 }
 
-func (mln *MockLn) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
-	return &mockNodeInfo, nil
+func TestHandleEventUserBudget(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	// the invoice is for 123 sats, so only one payment fits into the account budget
+	user := &User{ID: 0, AlbyIdentifier: "dummy", MaxAmount: 200, BudgetRenewal: "monthly"}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+
+	for i, eventId := range []string{"test_user_budget_event_1", "test_user_budget_event_2"} {
+		senderPrivkey := nostr.GeneratePrivateKey()
+		senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+		assert.NoError(t, err)
+		ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+		assert.NoError(t, err)
+		// each app has its own budget which is big enough
+		app := App{Name: "test", NostrPubkey: senderPubkey}
+		err = svc.db.Model(&user).Association("Apps").Append(&app)
+		assert.NoError(t, err)
+		err = svc.db.Create(&AppPermission{
+			AppId:         app.ID,
+			App:           app,
+			RequestMethod: NIP_47_PAY_INVOICE_METHOD,
+			MaxAmount:     1000,
+			BudgetRenewal: "monthly",
+		}).Error
+		assert.NoError(t, err)
+
+		payload, err := nip04.Encrypt(nip47PayJson, ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		if i == 0 {
+			assert.Nil(t, received.Error)
+		} else {
+			assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+		}
+	}
+	assert.Equal(t, int64(123), svc.GetUserBudgetUsage(user))
 }
 
-func (mln *MockLn) MakeInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
-	return mockTransaction, nil
+func TestHandleEventPayInvoicePreflight(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_INVOICE_METHOD,
+		MaxAmount:     100,
+		BudgetRenewal: "never",
+	}).Error
+	assert.NoError(t, err)
+
+	pay := func(eventId string, invoice string, amount int64) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "pay_invoice", "params": {"invoice": "%s", "amount": %d}}`, invoice, amount), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{
+			Result: &Nip47PayResponse{},
+		}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	// expired invoice
+	received := pay("test_preflight_event_1", createMockInvoice(10000, -time.Minute, &chaincfg.TestNet3Params), 0)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+	assert.Equal(t, "Invoice expired", received.Error.Message)
+
+	// mainnet invoice while the node is on testnet
+	received = pay("test_preflight_event_2", createMockInvoice(10000, time.Hour, &chaincfg.MainNetParams), 0)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+
+	// amountless invoice without amount
+	amountlessInvoice := createMockInvoice(0, time.Hour, &chaincfg.TestNet3Params)
+	received = pay("test_preflight_event_3", amountlessInvoice, 0)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+
+	// amountless invoice above the budget
+	received = pay("test_preflight_event_4", amountlessInvoice, 200000)
+	assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+
+	// amountless invoice with amount
+	received = pay("test_preflight_event_5", amountlessInvoice, 50000)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
+	payment := Payment{}
+	svc.db.Where("app_id = ?", app.ID).Last(&payment)
+	assert.Equal(t, uint(50), payment.Amount)
+
+	// amount not matching the invoice amount
+	received = pay("test_preflight_event_6", createMockInvoice(10000, time.Hour, &chaincfg.TestNet3Params), 20000)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
 }
 
-func (mln *MockLn) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
-	return mockTransaction, nil
+func TestHandleEventPayInvoiceIdempotent(t *testing.T) {
+	ctx := context.TODO()
+	svc, ln := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+
+	pay := func(eventId string, invoice string) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "pay_invoice", "params": {"invoice": "%s"}}`, invoice), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{
+			Result: &Nip47PayResponse{},
+		}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	// a retry of a paid invoice returns the stored preimage
+	invoice := createMockInvoice(10000, time.Hour, &chaincfg.TestNet3Params)
+	received := pay("test_idempotent_event_1", invoice)
+	assert.Nil(t, received.Error)
+	received = pay("test_idempotent_event_2", invoice)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
+	assert.Equal(t, 1, ln.PaymentCount)
+	var paymentCount int64
+	svc.db.Model(&Payment{}).Where("app_id = ?", app.ID).Count(&paymentCount)
+	assert.Equal(t, int64(1), paymentCount)
+
+	// a failed payment can be retried
+	invoice = createMockInvoice(10000, time.Hour, &chaincfg.TestNet3Params)
+	ln.PaymentErr = fmt.Errorf("%w: no route", ErrPaymentFailed)
+	received = pay("test_idempotent_event_3", invoice)
+	assert.Equal(t, NIP_47_ERROR_INTERNAL, received.Error.Code)
+	// the failed payment was made in a previous budget period
+	paymentRequest, err := decodepay.Decodepay(invoice)
+	assert.NoError(t, err)
+	err = svc.db.Model(&Payment{}).Where("payment_hash = ?", paymentRequest.PaymentHash).Update("created_at", time.Now().AddDate(0, -2, 0)).Error
+	assert.NoError(t, err)
+	ln.PaymentErr = nil
+	received = pay("test_idempotent_event_4", invoice)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, 2, ln.PaymentCount)
+	svc.db.Model(&Payment{}).Where("app_id = ?", app.ID).Count(&paymentCount)
+	assert.Equal(t, int64(2), paymentCount)
+	retried := Payment{}
+	err = svc.db.Where("payment_hash = ?", paymentRequest.PaymentHash).First(&retried).Error
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), retried.CreatedAt, time.Minute)
+
+	// a pending payment is not sent again
+	invoice = createMockInvoice(10000, time.Hour, &chaincfg.TestNet3Params)
+	paymentRequest, err = decodepay.Decodepay(invoice)
+	assert.NoError(t, err)
+	nostrEvent := NostrEvent{App: app, NostrId: "test_idempotent_pending", State: NOSTR_EVENT_STATE_HANDLER_EXECUTED}
+	svc.db.Create(&nostrEvent)
+	svc.db.Create(&Payment{App: app, NostrEvent: nostrEvent, PaymentRequest: invoice, PaymentHash: &paymentRequest.PaymentHash, Amount: 10, State: PAYMENT_STATE_PENDING})
+	received = pay("test_idempotent_event_5", invoice)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+	assert.Equal(t, 2, ln.PaymentCount)
+
+	// a payment that timed out stays pending until the backend reports its outcome
+	invoice = createMockInvoice(10000, time.Hour, &chaincfg.TestNet3Params)
+	ln.PaymentErr = context.DeadlineExceeded
+	received = pay("test_idempotent_event_6", invoice)
+	assert.Equal(t, NIP_47_ERROR_INTERNAL, received.Error.Code)
+	ln.PaymentErr = nil
+	received = pay("test_idempotent_event_7", invoice)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+	ln.PaymentState = PAYMENT_STATE_SETTLED
+	received = pay("test_idempotent_event_8", invoice)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
+	assert.Equal(t, 2, ln.PaymentCount)
+	ln.PaymentState = ""
+
+	// a retry returns the preimage even if the payment itself used up the budget
+	appPermission := AppPermission{AppId: app.ID, RequestMethod: NIP_47_PAY_INVOICE_METHOD, BudgetRenewal: "never"}
+	appPermission.MaxAmount = int(svc.GetBudgetUsage(&appPermission)) + 100
+	err = svc.db.Create(&appPermission).Error
+	assert.NoError(t, err)
+	invoice = createMockInvoice(100000, time.Hour, &chaincfg.TestNet3Params)
+	received = pay("test_idempotent_event_9", invoice)
+	assert.Nil(t, received.Error)
+	received = pay("test_idempotent_event_10", invoice)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "123preimage", received.Result.(*Nip47PayResponse).Preimage)
+	assert.Equal(t, 3, ln.PaymentCount)
+	var deniedCount int64
+	svc.db.Model(&AuditEvent{}).Where("action = ?", AUDIT_PAYMENT_DENIED).Count(&deniedCount)
+	assert.Equal(t, int64(0), deniedCount)
 }
 
-func (mln *MockLn) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, invoiceType string) (invoices []Nip47Transaction, err error) {
-	return mockTransactions, nil
+func TestHandleEventZapRequest(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+
+	zapperPrivkey := nostr.GeneratePrivateKey()
+	zapRequest := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      NIP_57_ZAP_REQUEST_KIND,
+		Tags: nostr.Tags{
+			nostr.Tag{"p", svc.cfg.IdentityPubkey},
+			nostr.Tag{"e", "zapped_event_id"},
+			nostr.Tag{"amount", "1000"},
+			nostr.Tag{"relays", "ws://127.0.0.1:1"},
+		},
+	}
+	err = zapRequest.Sign(zapperPrivkey)
+	assert.NoError(t, err)
+
+	makeInvoice := func(eventId string, amount int64, description string) *Nip47Response {
+		params, err := json.Marshal(map[string]interface{}{"amount": amount, "description": description})
+		assert.NoError(t, err)
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "make_invoice", "params": %s}`, params), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{
+			Result: &Nip47MakeInvoiceResponse{},
+		}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	// the zap request amount has to match the invoice amount
+	received := makeInvoice("test_zap_event_1", 2000, zapRequest.String())
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+
+	received = makeInvoice("test_zap_event_2", 1000, zapRequest.String())
+	assert.Nil(t, received.Error)
+	zap := Zap{}
+	err = svc.db.Where("app_id = ?", app.ID).First(&zap).Error
+	assert.NoError(t, err)
+	assert.Equal(t, ZAP_STATE_PENDING, zap.State)
+	assert.Equal(t, mockTransaction.PaymentHash, zap.PaymentHash)
+	assert.Equal(t, svc.cfg.IdentityPubkey, zap.SigningPubkey)
+
+	receipt, _, err := svc.createZapReceipt(&zap, mockTransaction)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_57_ZAP_RECEIPT_KIND, receipt.Kind)
+	assert.Equal(t, svc.cfg.IdentityPubkey, receipt.PubKey)
+	assert.Equal(t, svc.cfg.IdentityPubkey, receipt.Tags.GetFirst([]string{"p"}).Value())
+	assert.Equal(t, "zapped_event_id", receipt.Tags.GetFirst([]string{"e"}).Value())
+	assert.Equal(t, zapRequest.PubKey, receipt.Tags.GetFirst([]string{"P"}).Value())
+	assert.Equal(t, zapRequest.String(), receipt.Tags.GetFirst([]string{"description"}).Value())
+	assert.Equal(t, nostr.Timestamp(mockTimeUnix), receipt.CreatedAt)
+	ok, err := receipt.CheckSignature()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// the relay of the zap request is not reachable
+	svc.processPendingZaps(ctx)
+	svc.db.First(&zap, zap.ID)
+	assert.Equal(t, ZAP_STATE_FAILED, zap.State)
+	assert.Equal(t, receipt.ID, zap.ReceiptId)
+
+	// ordinary descriptions are no zap requests
+	received = makeInvoice("test_zap_event_3", 1000, "no zap")
+	assert.Nil(t, received.Error)
+	var zapCount int64
+	svc.db.Model(&Zap{}).Count(&zapCount)
+	assert.Equal(t, int64(1), zapCount)
+
+	// zaps of expired invoices are not looked up anymore
+	expiredAt := time.Now().Add(-time.Hour)
+	expiredZap := Zap{PaymentHash: "expired", ZapRequest: zapRequest.String(), State: ZAP_STATE_PENDING, ExpiresAt: &expiredAt}
+	err = svc.db.Create(&expiredZap).Error
+	assert.NoError(t, err)
+	svc.processPendingZaps(ctx)
+	svc.db.First(&expiredZap, expiredZap.ID)
+	assert.Equal(t, ZAP_STATE_EXPIRED, expiredZap.State)
+}
+
+func TestLNURLPay(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.cfg.LNURLBaseUrl = "https://nwc.example.com"
+	svc.cfg.LNURLUsername = "satoshi"
+	assert.Equal(t, "satoshi@nwc.example.com", svc.LightningAddress())
+
+	e := echo.New()
+	svc.RegisterLNURLRoutes(e)
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get("/.well-known/lnurlp/someone")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = get("/.well-known/lnurlp/satoshi")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	payResponse := &LNURLPayResponse{}
+	err := json.Unmarshal(rec.Body.Bytes(), payResponse)
+	assert.NoError(t, err)
+	assert.Equal(t, "payRequest", payResponse.Tag)
+	assert.Equal(t, "https://nwc.example.com/lnurlp/satoshi/callback", payResponse.Callback)
+	assert.Equal(t, svc.cfg.IdentityPubkey, payResponse.NostrPubkey)
+	assert.True(t, payResponse.AllowsNostr)
+
+	rec = get("/lnurlp/satoshi/callback?amount=1")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = get("/lnurlp/satoshi/callback?amount=1000&comment=thanks")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	callbackResponse := &LNURLCallbackResponse{}
+	err = json.Unmarshal(rec.Body.Bytes(), callbackResponse)
+	assert.NoError(t, err)
+	assert.Equal(t, mockTransaction.Invoice, callbackResponse.Pr)
+	comment := LightningAddressComment{}
+	err = svc.db.First(&comment).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "thanks", comment.Comment)
+	assert.Equal(t, mockTransaction.PaymentHash, comment.PaymentHash)
+
+	// the comment length is in characters, not bytes
+	rec = get("/lnurlp/satoshi/callback?amount=1000&comment=" + url.QueryEscape(strings.Repeat("⚡", LNURL_COMMENT_ALLOWED)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = get("/lnurlp/satoshi/callback?amount=1000&comment=" + url.QueryEscape(strings.Repeat("⚡", LNURL_COMMENT_ALLOWED+1)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	zapRequest := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      NIP_57_ZAP_REQUEST_KIND,
+		Tags: nostr.Tags{
+			nostr.Tag{"p", svc.cfg.IdentityPubkey},
+			nostr.Tag{"relays", "wss://relay.example.com"},
+		},
+	}
+	err = zapRequest.Sign(nostr.GeneratePrivateKey())
+	assert.NoError(t, err)
+	rec = get("/lnurlp/satoshi/callback?amount=1000&nostr=" + url.QueryEscape(zapRequest.String()))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	zap := Zap{}
+	err = svc.db.First(&zap).Error
+	assert.NoError(t, err)
+	assert.Nil(t, zap.AppId)
+	assert.Equal(t, ZAP_STATE_PENDING, zap.State)
+	assert.Equal(t, svc.activeIdentity().pubkey, zap.SigningPubkey)
+
+	rec = get("/lnurlp/satoshi/callback?amount=1000&nostr=" + url.QueryEscape(`{"kind": 1}`))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// invoices are rate limited per IP
+	for i := 0; i < LNURL_CALLBACK_RATE_LIMIT; i++ {
+		rec = get("/lnurlp/satoshi/callback?amount=1000")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	req := httptest.NewRequest(http.MethodGet, "/lnurlp/satoshi/callback?amount=1000", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestHandleEventPayLnurl(t *testing.T) {
+	ctx := context.TODO()
+	svc, ln := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	metadata := `[["text/plain","Sats for alice"]]`
+	metadataHash := sha256.Sum256([]byte(metadata))
+	invoiceAmount := int64(21000)
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/lnurlp/alice":
+			json.NewEncoder(w).Encode(LNURLPayResponse{
+				Tag:            "payRequest",
+				Callback:       server.URL + "/callback",
+				MinSendable:    1000,
+				MaxSendable:    1000000,
+				Metadata:       metadata,
+				CommentAllowed: 10,
+			})
+		case "/callback":
+			assert.Equal(t, "thanks", r.URL.Query().Get("comment"))
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"pr":            createMockInvoiceWithDescription(invoiceAmount, time.Hour, &chaincfg.TestNet3Params, zpay32.DescriptionHash(metadataHash)),
+				"routes":        []string{},
+				"successAction": map[string]string{"tag": "message", "message": "Thank you!"},
+			})
+		}
+	}))
+	defer server.Close()
+	defaultLnurlHttpClient := lnurlHttpClient
+	lnurlHttpClient = server.Client()
+	defer func() { lnurlHttpClient = defaultLnurlHttpClient }()
+	lightningAddress := "alice@" + strings.TrimPrefix(server.URL, "https://")
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_INVOICE_METHOD,
+		MaxAmount:     100,
+		BudgetRenewal: "never",
+	}).Error
+	assert.NoError(t, err)
+
+	payLnurl := func(eventId string, lnurl string, amount int64) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "pay_lnurl", "params": {"lnurl": "%s", "amount": %d, "comment": "thanks"}}`, lnurl, amount), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{
+			Result: &Nip47PayLnurlResponse{},
+		}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	// the pay_invoice permission alone doesn't allow paying lightning addresses
+	received := payLnurl("test_pay_lnurl_event_restricted", lightningAddress, invoiceAmount)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+	assert.Equal(t, 0, ln.PaymentCount)
+	err = svc.db.Create(&AppPermission{AppId: app.ID, RequestMethod: NIP_47_PAY_LNURL_METHOD}).Error
+	assert.NoError(t, err)
+
+	received = payLnurl("test_pay_lnurl_event_1", lightningAddress, invoiceAmount)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, NIP_47_PAY_LNURL_METHOD, received.ResultType)
+	assert.Equal(t, "123preimage", received.Result.(*Nip47PayLnurlResponse).Preimage)
+	assert.JSONEq(t, `{"tag": "message", "message": "Thank you!"}`, string(received.Result.(*Nip47PayLnurlResponse).SuccessAction))
+	assert.Equal(t, 1, ln.PaymentCount)
+
+	// the budget of pay_invoice applies
+	received = payLnurl("test_pay_lnurl_event_2", lightningAddress, 90000)
+	assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+
+	// the invoice has to be for the requested amount
+	received = payLnurl("test_pay_lnurl_event_3", lightningAddress, 5000)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+	assert.Equal(t, 1, ln.PaymentCount)
+
+	// only https services are contacted
+	received = payLnurl("test_pay_lnurl_event_4", "http://example.com/lnurlp", invoiceAmount)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+}
+
+func TestLNURLPrivateAddress(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("LNURL service on the host was reached")
+	}))
+	defer server.Close()
+
+	// the default client doesn't connect to services of the host or its private network
+	_, _, err := FetchLNURLInvoice(context.Background(), "alice@"+strings.TrimPrefix(server.URL, "https://"), 1000, "")
+	assert.ErrorContains(t, err, "LNURL service address is not public")
+	_, _, err = FetchLNURLInvoice(context.Background(), "https://127.0.0.1/.well-known/lnurlp/alice", 1000, "")
+	assert.ErrorContains(t, err, "LNURL service address is not public")
+
+	for _, address := range []string{"127.0.0.1:443", "[::1]:443", "10.0.0.1:443", "192.168.1.1:443", "172.16.0.1:443", "169.254.169.254:80", "[fe80::1]:443", "0.0.0.0:443", "[::]:443", "224.0.0.1:443", "[fd00::1]:443"} {
+		assert.Error(t, refusePrivateAddress("tcp", address, nil), address)
+	}
+	for _, address := range []string{"1.1.1.1:443", "[2606:4700:4700::1111]:443"} {
+		assert.NoError(t, refusePrivateAddress("tcp", address, nil), address)
+	}
+}
+
+func TestHandleEventHoldInvoice(t *testing.T) {
+	ctx := context.TODO()
+	svc, ln := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_MAKE_HOLD_INVOICE_METHOD,
+	}).Error
+	assert.NoError(t, err)
+
+	request := func(eventId string, method string, params string) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "%s", "params": %s}`, method, params), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{
+			Result: &Nip47MakeInvoiceResponse{},
+		}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	preimage := make([]byte, 32)
+	rand.Read(preimage)
+	paymentHash := sha256.Sum256(preimage)
+	received := request("test_hold_invoice_event_1", NIP_47_MAKE_HOLD_INVOICE_METHOD, fmt.Sprintf(`{"amount": 1000, "payment_hash": "%x"}`, paymentHash))
+	assert.Nil(t, received.Error)
+	assert.Equal(t, hex.EncodeToString(paymentHash[:]), received.Result.(*Nip47MakeInvoiceResponse).PaymentHash)
+	holdInvoice := HoldInvoice{}
+	err = svc.db.Where("app_id = ?", app.ID).First(&holdInvoice).Error
+	assert.NoError(t, err)
+	assert.Equal(t, HOLD_INVOICE_STATE_OPEN, holdInvoice.State)
+
+	// settling needs its own permission
+	received = request("test_hold_invoice_event_2", NIP_47_SETTLE_HOLD_INVOICE_METHOD, fmt.Sprintf(`{"preimage": "%x"}`, preimage))
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_SETTLE_HOLD_INVOICE_METHOD,
+	}).Error
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_CANCEL_HOLD_INVOICE_METHOD,
+	}).Error
+	assert.NoError(t, err)
+
+	// the app is notified once the payment is accepted, the state is kept until the notification was sent
+	ln.HoldInvoiceState = HOLD_INVOICE_STATE_ACCEPTED
+	svc.processHoldInvoices(ctx)
+	svc.db.First(&holdInvoice, holdInvoice.ID)
+	assert.Equal(t, HOLD_INVOICE_STATE_OPEN, holdInvoice.State)
+	notification, err := svc.createNotification(&app, NIP_47_HOLD_INVOICE_ACCEPTED, mockTransaction)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_NOTIFICATION_KIND, notification.Kind)
+	decrypted, err := nip04.Decrypt(notification.Content, ss)
+	assert.NoError(t, err)
+	receivedNotification := &Nip47Notification{Notification: &Nip47Transaction{}}
+	err = json.Unmarshal([]byte(decrypted), receivedNotification)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_HOLD_INVOICE_ACCEPTED, receivedNotification.NotificationType)
+	assert.Equal(t, mockTransaction.PaymentHash, receivedNotification.Notification.(*Nip47Transaction).PaymentHash)
+
+	// unknown hold invoices can't be canceled
+	received = request("test_hold_invoice_event_3", NIP_47_CANCEL_HOLD_INVOICE_METHOD, `{"payment_hash": "unknown"}`)
+	assert.Equal(t, NIP_47_ERROR_NOT_FOUND, received.Error.Code)
+
+	received = request("test_hold_invoice_event_4", NIP_47_SETTLE_HOLD_INVOICE_METHOD, fmt.Sprintf(`{"preimage": "%x"}`, preimage))
+	assert.Nil(t, received.Error)
+	svc.db.First(&holdInvoice, holdInvoice.ID)
+	assert.Equal(t, HOLD_INVOICE_STATE_SETTLED, holdInvoice.State)
+
+	// backends without hold invoices, e.g. Alby, don't pretend that the hold invoice is missing
+	ln.HoldInvoicesErr = ErrNotImplemented
+	received = request("test_hold_invoice_event_5", NIP_47_CANCEL_HOLD_INVOICE_METHOD, `{"payment_hash": "unknown"}`)
+	assert.Equal(t, NIP_47_ERROR_NOT_IMPLEMENTED, received.Error.Code)
+	received = request("test_hold_invoice_event_6", NIP_47_SETTLE_HOLD_INVOICE_METHOD, fmt.Sprintf(`{"preimage": "%x"}`, paymentHash))
+	assert.Equal(t, NIP_47_ERROR_NOT_IMPLEMENTED, received.Error.Code)
+}
+
+func TestHandleEventOffers(t *testing.T) {
+	ctx := context.TODO()
+	svc, ln := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	appPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_INVOICE_METHOD,
+		MaxAmount:     40,
+		BudgetRenewal: "never",
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+
+	request := func(eventId string, method string, params string) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "%s", "params": %s}`, method, params), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	// the amount of the fetched invoice exceeds the budget
+	received := request("test_offer_event_1", NIP_47_PAY_OFFER_METHOD, `{"offer": "lno1mockoffer"}`)
+	assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+	assert.Equal(t, 0, ln.PaymentCount)
+
+	appPermission.MaxAmount = 100
+	svc.db.Save(appPermission)
+	received = request("test_offer_event_2", NIP_47_PAY_OFFER_METHOD, `{"offer": "lno1mockoffer"}`)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, 1, ln.PaymentCount)
+	assert.Equal(t, int64(50), svc.GetBudgetUsage(appPermission))
+	// offer payments are recorded like invoice payments
+	payment := Payment{}
+	svc.db.Where("app_id = ?", app.ID).First(&payment)
+	assert.Equal(t, PAYMENT_STATE_SETTLED, payment.State)
+	assert.NotNil(t, payment.PaymentHash)
+
+	// the invoice has to match the requested amount
+	received = request("test_offer_event_3", NIP_47_PAY_OFFER_METHOD, `{"offer": "lno1mockoffer", "amount": 10000}`)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+
+	// make_offer needs the make_invoice permission
+	received = request("test_offer_event_4", NIP_47_MAKE_OFFER_METHOD, `{"description": "donations"}`)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_MAKE_INVOICE_METHOD,
+	}).Error
+	assert.NoError(t, err)
+	received = request("test_offer_event_5", NIP_47_MAKE_OFFER_METHOD, `{"description": "donations"}`)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "lno1mockoffer", received.Result.(map[string]interface{})["offer"])
+
+	// backends without offer support
+	ln.OffersErr = ErrNotImplemented
+	received = request("test_offer_event_6", NIP_47_MAKE_OFFER_METHOD, `{"description": "donations"}`)
+	assert.Equal(t, NIP_47_ERROR_NOT_IMPLEMENTED, received.Error.Code)
+	received = request("test_offer_event_7", NIP_47_PAY_OFFER_METHOD, `{"offer": "lno1mockoffer"}`)
+	assert.Equal(t, NIP_47_ERROR_NOT_IMPLEMENTED, received.Error.Code)
+}
+
+func TestHandleEventSignMessage(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_VERIFY_MESSAGE_METHOD,
+	}).Error
+	assert.NoError(t, err)
+
+	request := func(eventId string, method string, params string) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "%s", "params": %s}`, method, params), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	// signing needs its own permission
+	received := request("test_sign_event_1", NIP_47_SIGN_MESSAGE_METHOD, `{"message": "hello"}`)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_SIGN_MESSAGE_METHOD,
+	}).Error
+	assert.NoError(t, err)
+	received = request("test_sign_event_2", NIP_47_SIGN_MESSAGE_METHOD, `{"message": "hello"}`)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "hello", received.Result.(map[string]interface{})["message"])
+	assert.Equal(t, "mocksignature:hello", received.Result.(map[string]interface{})["signature"])
+
+	received = request("test_sign_event_3", NIP_47_VERIFY_MESSAGE_METHOD, `{"message": "hello", "signature": "mocksignature:hello"}`)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, true, received.Result.(map[string]interface{})["valid"])
+	assert.Equal(t, mockNodeInfo.Pubkey, received.Result.(map[string]interface{})["pubkey"])
+
+	received = request("test_sign_event_4", NIP_47_VERIFY_MESSAGE_METHOD, `{"message": "bye", "signature": "mocksignature:hello"}`)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, false, received.Result.(map[string]interface{})["valid"])
+}
+
+func TestHandleEventGetBudget(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	getInfoPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_GET_INFO_METHOD,
+	}
+	err = svc.db.Create(getInfoPermission).Error
+	assert.NoError(t, err)
+
+	request := func(eventId string) *Nip47Response {
+		payload, err := nip04.Encrypt(`{"method": "get_budget"}`, ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	// reading the budget needs its own permission, also for apps that can pay
+	appPermission := &AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_INVOICE_METHOD,
+	}
+	err = svc.db.Create(appPermission).Error
+	assert.NoError(t, err)
+	received := request("test_get_budget_event_1")
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+	err = svc.db.Create(&AppPermission{AppId: app.ID, RequestMethod: NIP_47_GET_BUDGET_METHOD}).Error
+	assert.NoError(t, err)
+
+	// no budget
+	received = request("test_get_budget_event_2")
+	assert.Nil(t, received.Error)
+	assert.Equal(t, map[string]interface{}{}, received.Result)
+
+	appPermission.MaxAmount = 100
+	appPermission.BudgetRenewal = "weekly"
+	svc.db.Save(appPermission)
+	preimage := "123preimage"
+	err = svc.db.Create(&Payment{AppId: app.ID, Amount: 30, Preimage: &preimage, State: PAYMENT_STATE_SETTLED}).Error
+	assert.NoError(t, err)
+
+	received = request("test_get_budget_event_3")
+	assert.Nil(t, received.Error)
+	budget := received.Result.(map[string]interface{})
+	assert.Equal(t, float64(100000), budget["total_budget"])
+	assert.Equal(t, float64(30000), budget["used_budget"])
+	assert.Equal(t, float64(70000), budget["remaining"])
+	assert.Equal(t, "weekly", budget["renewal_period"])
+	assert.Equal(t, float64(GetEndOfBudget("weekly", app.CreatedAt).Unix()), budget["renews_at"])
+
+	// the account-wide budget limits the remaining amount
+	user.MaxAmount = 50
+	user.BudgetRenewal = "never"
+	svc.db.Save(user)
+	received = request("test_get_budget_event_4")
+	assert.Nil(t, received.Error)
+	budget = received.Result.(map[string]interface{})
+	assert.Equal(t, float64(100000), budget["total_budget"])
+	assert.Equal(t, float64(20000), budget["remaining"])
+
+	// exhausted budgets can still be read
+	err = svc.db.Create(&Payment{AppId: app.ID, Amount: 80, Preimage: &preimage, State: PAYMENT_STATE_SETTLED}).Error
+	assert.NoError(t, err)
+	received = request("test_get_budget_event_5")
+	assert.Nil(t, received.Error)
+	budget = received.Result.(map[string]interface{})
+	assert.Equal(t, float64(110000), budget["used_budget"])
+	assert.Equal(t, float64(0), budget["remaining"])
+}
+
+func TestHandleEventOnchain(t *testing.T) {
+	ctx := context.TODO()
+	svc, ln := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+
+	request := func(eventId string, method string, params string) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "%s", "params": %s}`, method, params), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	received := request("test_onchain_event_1", NIP_47_GET_ONCHAIN_BALANCE_METHOD, `{}`)
+	assert.Nil(t, received.Error)
+	balance := received.Result.(map[string]interface{})
+	assert.Equal(t, float64(100000000), balance["confirmed"])
+	assert.Equal(t, float64(2000000), balance["unconfirmed"])
+	assert.Equal(t, float64(10000000), balance["reserved"])
+
+	received = request("test_onchain_event_2", NIP_47_MAKE_ONCHAIN_ADDRESS_METHOD, `{}`)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "bcrt1qmockaddress", received.Result.(map[string]interface{})["address"])
+
+	// on-chain payments are opt-in, even for apps without permissions
+	received = request("test_onchain_event_3", NIP_47_PAY_ONCHAIN_METHOD, `{"address": "bcrt1qmockaddress", "amount": 50000}`)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+	assert.NotContains(t, svc.GetMethods(ctx, &app), NIP_47_PAY_ONCHAIN_METHOD)
+
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_INVOICE_METHOD,
+		MaxAmount:     1000,
+	}).Error
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_PAY_ONCHAIN_METHOD,
+		MaxAmount:     100,
+		BudgetRenewal: "never",
+	}).Error
+	assert.NoError(t, err)
+
+	received = request("test_onchain_event_4", NIP_47_PAY_ONCHAIN_METHOD, `{"address": "bcrt1qmockaddress", "amount": 1500}`)
+	assert.Equal(t, NIP_47_OTHER, received.Error.Code)
+
+	received = request("test_onchain_event_5", NIP_47_PAY_ONCHAIN_METHOD, `{"address": "bcrt1qmockaddress", "amount": 60000}`)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, "mocktxid", received.Result.(map[string]interface{})["txid"])
+	assert.Equal(t, 1, ln.PaymentCount)
+
+	// the on-chain budget is separate from the lightning budget
+	received = request("test_onchain_event_6", NIP_47_PAY_ONCHAIN_METHOD, `{"address": "bcrt1qmockaddress", "amount": 60000}`)
+	assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+	assert.Equal(t, 1, ln.PaymentCount)
+	assert.Equal(t, int64(0), svc.GetBudgetUsage(&AppPermission{AppId: app.ID, App: app}))
+
+	// only rejected transactions don't count against the budget, the ones that timed out might have been broadcast
+	onchainPermission := &AppPermission{AppId: app.ID, App: app, BudgetRenewal: "never"}
+	svc.db.Model(&AppPermission{}).Where("app_id = ? AND request_method = ?", app.ID, NIP_47_PAY_ONCHAIN_METHOD).Update("max_amount", 150)
+	ln.PaymentErr = fmt.Errorf("%w: insufficient funds", ErrPaymentFailed)
+	received = request("test_onchain_event_7", NIP_47_PAY_ONCHAIN_METHOD, `{"address": "bcrt1qmockaddress", "amount": 60000}`)
+	assert.Equal(t, NIP_47_ERROR_INTERNAL, received.Error.Code)
+	assert.Equal(t, int64(60), svc.GetOnchainBudgetUsage(onchainPermission))
+	ln.PaymentErr = context.DeadlineExceeded
+	received = request("test_onchain_event_8", NIP_47_PAY_ONCHAIN_METHOD, `{"address": "bcrt1qmockaddress", "amount": 60000}`)
+	assert.Equal(t, NIP_47_ERROR_INTERNAL, received.Error.Code)
+	assert.Equal(t, int64(120), svc.GetOnchainBudgetUsage(onchainPermission))
+	ln.PaymentErr = nil
+	received = request("test_onchain_event_9", NIP_47_PAY_ONCHAIN_METHOD, `{"address": "bcrt1qmockaddress", "amount": 60000}`)
+	assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+
+	// concurrent payments can't exceed the budget together
+	paymentCount := ln.PaymentCount
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request(fmt.Sprintf("test_onchain_concurrent_%d", i), NIP_47_PAY_ONCHAIN_METHOD, `{"address": "bcrt1qmockaddress", "amount": 20000}`)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, paymentCount+1, ln.PaymentCount)
+	assert.Equal(t, int64(140), svc.GetOnchainBudgetUsage(onchainPermission))
+}
+
+func TestHandleEventChannels(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_GET_LIQUIDITY_METHOD,
+	}).Error
+	assert.NoError(t, err)
+
+	request := func(eventId string, method string) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "%s"}`, method), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+
+	// each method has its own permission
+	received := request("test_channels_event_1", NIP_47_LIST_CHANNELS_METHOD)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+	received = request("test_channels_event_2", NIP_47_LIST_PENDING_CHANNELS_METHOD)
+	assert.Equal(t, NIP_47_ERROR_RESTRICTED, received.Error.Code)
+
+	received = request("test_channels_event_3", NIP_47_GET_LIQUIDITY_METHOD)
+	assert.Nil(t, received.Error)
+	liquidity := received.Result.(map[string]interface{})
+	assert.Equal(t, float64(69000000), liquidity["outbound"])
+	assert.Equal(t, float64(75000000), liquidity["inbound"])
+	assert.Equal(t, float64(69000000), liquidity["largest_outbound"])
+	assert.Equal(t, float64(47000000), liquidity["largest_inbound"])
+	assert.Equal(t, float64(2), liquidity["active_channels"])
+
+	for _, method := range []string{NIP_47_LIST_CHANNELS_METHOD, NIP_47_LIST_PENDING_CHANNELS_METHOD} {
+		err = svc.db.Create(&AppPermission{
+			AppId:         app.ID,
+			App:           app,
+			RequestMethod: method,
+		}).Error
+		assert.NoError(t, err)
+	}
+
+	received = request("test_channels_event_4", NIP_47_LIST_CHANNELS_METHOD)
+	assert.Nil(t, received.Error)
+	channels := received.Result.(map[string]interface{})["channels"].([]interface{})
+	assert.Equal(t, 3, len(channels))
+	channel := channels[0].(map[string]interface{})
+	assert.Equal(t, "1", channel["id"])
+	assert.Equal(t, "peer1", channel["remote_pubkey"])
+	assert.Equal(t, float64(100000000), channel["capacity"])
+	assert.Equal(t, float64(70000000), channel["local_balance"])
+	assert.Equal(t, float64(29000000), channel["remote_balance"])
+	assert.Equal(t, true, channel["active"])
+	assert.Equal(t, false, channels[1].(map[string]interface{})["public"])
+
+	received = request("test_channels_event_5", NIP_47_LIST_PENDING_CHANNELS_METHOD)
+	assert.Nil(t, received.Error)
+	pendingChannels := received.Result.(map[string]interface{})["pending_channels"].([]interface{})
+	assert.Equal(t, 1, len(pendingChannels))
+	assert.Equal(t, PENDING_CHANNEL_STATE_OPENING, pendingChannels[0].(map[string]interface{})["state"])
+	assert.Equal(t, float64(19000000), pendingChannels[0].(map[string]interface{})["local_balance"])
+}
+
+func TestFiatBudget(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+	rateProvider := &StaticRateProvider{rates: map[string]float64{"EUR": 50000}}
+	svc.rateProvider = rateProvider
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:          app.ID,
+		App:            app,
+		RequestMethod:  NIP_47_PAY_INVOICE_METHOD,
+		MaxAmount:      1,
+		BudgetCurrency: "EUR",
+		BudgetRenewal:  "never",
+	}).Error
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_GET_BALANCE_METHOD,
+	}).Error
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{
+		AppId:         app.ID,
+		App:           app,
+		RequestMethod: NIP_47_GET_BUDGET_METHOD,
+	}).Error
+	assert.NoError(t, err)
+
+	request := func(eventId string, method string, params string) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "%s", "params": %s}`, method, params), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+	pay := func(eventId string) *Nip47Response {
+		invoice := createMockInvoice(1000000, time.Hour, &chaincfg.TestNet3Params)
+		return request(eventId, NIP_47_PAY_INVOICE_METHOD, fmt.Sprintf(`{"invoice": "%s"}`, invoice))
+	}
+
+	// 1000 sats are 0.50 EUR
+	received := pay("test_fiat_event_1")
+	assert.Nil(t, received.Error)
+	payment := Payment{}
+	svc.db.Where("app_id = ?", app.ID).First(&payment)
+	assert.Equal(t, int64(50), payment.FiatAmount)
+	assert.Equal(t, "EUR", payment.FiatCurrency)
+	received = pay("test_fiat_event_2")
+	assert.Nil(t, received.Error)
+	received = pay("test_fiat_event_3")
+	assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+
+	// the usage is recorded at the rate applied to each payment
+	rateProvider.rates["EUR"] = 100000
+	received = pay("test_fiat_event_4")
+	assert.Equal(t, NIP_47_ERROR_QUOTA_EXCEEDED, received.Error.Code)
+
+	received = request("test_fiat_event_5", NIP_47_GET_BUDGET_METHOD, `{}`)
+	assert.Nil(t, received.Error)
+	budget := received.Result.(map[string]interface{})
+	assert.Equal(t, "EUR", budget["fiat_currency"])
+	assert.Equal(t, float64(1), budget["fiat_total_budget"])
+	assert.Equal(t, float64(1), budget["fiat_used_budget"])
+	assert.Equal(t, float64(0), budget["fiat_remaining"])
+	assert.Equal(t, float64(1000000), budget["total_budget"])
+	assert.Equal(t, float64(2000000), budget["used_budget"])
+	assert.Equal(t, float64(0), budget["remaining"])
+
+	// 21 sats are 0.02 EUR
+	received = request("test_fiat_event_6", NIP_47_GET_BALANCE_METHOD, `{}`)
+	assert.Nil(t, received.Error)
+	balance := received.Result.(map[string]interface{})
+	assert.Equal(t, float64(21000), balance["balance"])
+	assert.Equal(t, float64(0.02), balance["fiat_balance"])
+	assert.Equal(t, "EUR", balance["fiat_currency"])
+
+	// without a rate the balance is returned without the fiat balance
+	received = request("test_fiat_event_7", NIP_47_GET_BALANCE_METHOD, `{"currency": "usd"}`)
+	assert.Nil(t, received.Error)
+	balance = received.Result.(map[string]interface{})
+	assert.Equal(t, float64(21000), balance["balance"])
+	assert.Nil(t, balance["fiat_balance"])
+
+	// the rate is gone by the time the payment is recorded, so it can't be counted against the budget
+	svc.db.Model(&AppPermission{}).Where("app_id = ? AND request_method = ?", app.ID, NIP_47_PAY_INVOICE_METHOD).Update("max_amount", 100)
+	svc.rateProvider = &onceRateProvider{rate: 50000}
+	received = pay("test_fiat_event_8")
+	assert.Equal(t, NIP_47_ERROR_INTERNAL, received.Error.Code)
+	var payments int64
+	svc.db.Model(&Payment{}).Where("app_id = ?", app.ID).Count(&payments)
+	assert.Equal(t, int64(2), payments)
+}
+
+// onceRateProvider only returns the rate on the first request
+type onceRateProvider struct {
+	rate  float64
+	calls int
+}
+
+func (provider *onceRateProvider) GetRate(ctx context.Context, currency string) (rate float64, err error) {
+	provider.calls++
+	if provider.calls > 1 {
+		return 0, errors.New("rate provider is down")
+	}
+	return provider.rate, nil
+}
+
+func TestRateProviders(t *testing.T) {
+	ctx := context.TODO()
+
+	ratesFile, err := os.CreateTemp("", "rates-*.json")
+	assert.NoError(t, err)
+	defer os.Remove(ratesFile.Name())
+	_, err = ratesFile.WriteString(`{"eur": 50000.5}`)
+	assert.NoError(t, err)
+	ratesFile.Close()
+	staticProvider, err := NewStaticRateProvider(ratesFile.Name())
+	assert.NoError(t, err)
+	rate, err := staticProvider.GetRate(ctx, "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, 50000.5, rate)
+	_, err = staticProvider.GetRate(ctx, "USD")
+	assert.Error(t, err)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/rates/usd.json", r.URL.Path)
+		w.Write([]byte(`{"code": "USD", "rate_float": 65000.25}`))
+	}))
+	defer server.Close()
+	httpProvider := NewHTTPRateProvider(server.URL + "/rates/%s.json")
+	rate, err = httpProvider.GetRate(ctx, "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, 65000.25, rate)
+	// rates are cached
+	rate, err = httpProvider.GetRate(ctx, "usd")
+	assert.NoError(t, err)
+	assert.Equal(t, 65000.25, rate)
+	assert.Equal(t, 1, requests)
+
+	assert.Equal(t, int64(50), msatToFiatCents(1000000, 50000))
+	assert.Equal(t, int64(2000000), fiatCentsToMsat(100, 50000))
+}
+
+func TestSecretBox(t *testing.T) {
+	defer os.Remove(testDB)
+	svc, _ := createTestService(t)
+
+	// existing plaintext secrets
+	err := svc.db.Create(&Identity{Privkey: "privkey"}).Error
+	assert.NoError(t, err)
+	user := &User{AlbyIdentifier: "dummy", AccessToken: "access", RefreshToken: "refresh"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+
+	// without a master key secrets stay in plaintext
+	box, err := NewSecretBox(svc.db, svc.cfg)
+	assert.NoError(t, err)
+	assert.Nil(t, box)
+	value, err := box.Encrypt("secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", value)
+
+	svc.cfg.EncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	box, err = NewSecretBox(svc.db, svc.cfg)
+	assert.NoError(t, err)
+	count, err := box.EncryptStoredSecrets(svc.db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	// already encrypted rows are skipped
+	count, err = box.EncryptStoredSecrets(svc.db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	identity := &Identity{}
+	svc.db.First(identity)
+	assert.True(t, strings.HasPrefix(identity.Privkey, ENCRYPTED_SECRET_PREFIX))
+	svc.db.First(user)
+	assert.True(t, strings.HasPrefix(user.AccessToken, ENCRYPTED_SECRET_PREFIX))
+	assert.NotContains(t, user.RefreshToken, "refresh")
+
+	// the data key is unwrapped again on the next start
+	box, err = NewSecretBox(svc.db, svc.cfg)
+	assert.NoError(t, err)
+	value, err = box.Decrypt(identity.Privkey)
+	assert.NoError(t, err)
+	assert.Equal(t, "privkey", value)
+	value, err = box.Decrypt(user.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "access", value)
+	// plaintext values are passed through
+	value, err = box.Decrypt("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", value)
+
+	// encrypted secrets can't be read without the right master key
+	var nilBox *SecretBox
+	_, err = nilBox.Decrypt(user.RefreshToken)
+	assert.Equal(t, ErrNoMasterKey, err)
+	svc.cfg.EncryptionKey = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+	_, err = NewSecretBox(svc.db, svc.cfg)
+	assert.Error(t, err)
+	svc.cfg.EncryptionKey = ""
+	_, err = NewSecretBox(svc.db, svc.cfg)
+	assert.Error(t, err)
+}
+
+func TestLNDLogin(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	user := &User{AlbyIdentifier: LND_USER_IDENTIFIER}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	ui := newTestWebUI(t, svc, user)
+	assert.NotEmpty(t, svc.lndSetupToken)
+	request := ui.request
+
+	// every app route requires a login
+	rec := request(http.MethodGet, "/apps/new?name=Test", nil)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/lnd/auth?c=Test", rec.Header().Get("Location"))
+	rec = request(http.MethodPost, "/apps", url.Values{"name": {"Test"}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/", rec.Header().Get("Location"))
+	rec = request(http.MethodGet, "/lnd/auth", nil)
+	assert.Equal(t, "/lnd/setup", rec.Header().Get("Location"))
+
+	// the password can only be set with the setup token from the log
+	rec = request(http.MethodPost, "/lnd/setup", url.Values{"token": {"wrong"}, "password": {"password1"}, "password_confirmation": {"password1"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = request(http.MethodPost, "/lnd/setup", url.Values{"token": {svc.lndSetupToken}, "password": {"short"}, "password_confirmation": {"short"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = request(http.MethodPost, "/lnd/setup", url.Values{"token": {svc.lndSetupToken}, "password": {"password1"}, "password_confirmation": {"password1"}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Empty(t, svc.lndSetupToken)
+	rec = request(http.MethodGet, "/", nil)
+	assert.Equal(t, "/apps/new?name=Test", rec.Header().Get("Location"))
+	rec = request(http.MethodGet, "/apps", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// enable two-factor login with a code of the shown secret
+	rec = request(http.MethodGet, "/lnd/totp", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	secret := regexp.MustCompile(`secret=([A-Z2-7]+)`).FindStringSubmatch(rec.Body.String())[1]
+	step := time.Now().Unix() / TOTP_PERIOD
+	code, err := totpCode(secret, uint64(step))
+	assert.NoError(t, err)
+	rec = request(http.MethodPost, "/lnd/totp", url.Values{"totp": {"000000"}})
+	assert.Equal(t, "/lnd/totp?error=1", rec.Header().Get("Location"))
+	rec = request(http.MethodPost, "/lnd/totp", url.Values{"totp": {code}})
+	assert.Equal(t, "/lnd/totp", rec.Header().Get("Location"))
+	svc.db.First(user)
+	assert.NotEmpty(t, user.TotpSecret)
+	assert.Equal(t, step, user.TotpLastStep)
+
+	request(http.MethodGet, "/logout", nil)
+	rec = request(http.MethodGet, "/apps", nil)
+	assert.Equal(t, http.StatusFound, rec.Code)
+
+	// codes are accepted only once, the code confirming the secret can't be used to log in
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"password1"}, "totp": {code}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	code, err = totpCode(secret, uint64(step+1))
+	assert.NoError(t, err)
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"wrong"}, "totp": {code}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"password1"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"password1"}, "totp": {code}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+	rec = request(http.MethodGet, "/apps", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	request(http.MethodGet, "/logout", nil)
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"password1"}, "totp": {code}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	// the following logins reuse the code as if it was the one of a later time step
+	reuseCode := func() {
+		err := svc.db.Model(&User{}).Where("id = ?", user.ID).Update("totp_last_step", step).Error
+		assert.NoError(t, err)
+	}
+
+	// sessions expire
+	svc.cfg.SessionTimeout = 1
+	reuseCode()
+	request(http.MethodPost, "/lnd/auth", url.Values{"password": {"password1"}, "totp": {code}})
+	time.Sleep(2 * time.Second)
+	rec = request(http.MethodGet, "/apps", nil)
+	assert.Equal(t, http.StatusFound, rec.Code)
+
+	// login attempts are rate limited
+	svc.loginLimiter = newLoginLimiter(rate.Every(time.Minute), 1)
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"password1"}, "totp": {code}})
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	// per client, the owner can still log in from another address
+	ui.remoteAddr = "198.51.100.1:1234"
+	reuseCode()
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"password1"}, "totp": {code}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+
+	// disabling two-factor login requires the password and a new code
+	reuseCode()
+	rec = request(http.MethodPost, "/lnd/totp/disable", url.Values{"password": {"password1"}})
+	assert.Equal(t, "/lnd/totp?error=1", rec.Header().Get("Location"))
+	rec = request(http.MethodPost, "/lnd/totp/disable", url.Values{"password": {"wrong"}, "totp": {code}})
+	assert.Equal(t, "/lnd/totp?error=1", rec.Header().Get("Location"))
+	svc.db.First(user)
+	assert.NotEmpty(t, user.TotpSecret)
+	rec = request(http.MethodPost, "/lnd/totp/disable", url.Values{"password": {"password1"}, "totp": {code}})
+	assert.Equal(t, "/lnd/totp", rec.Header().Get("Location"))
+	svc.db.First(user)
+	assert.Empty(t, user.TotpSecret)
+
+	// RFC 6238 test vectors truncated to 6 digits
+	rfcSecret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	code, err = totpCode(rfcSecret, 59/TOTP_PERIOD)
+	assert.NoError(t, err)
+	assert.Equal(t, "287082", code)
+	rfcStep, valid := validateTotp(rfcSecret, "081 804", time.Unix(1111111109, 0), 0)
+	assert.True(t, valid)
+	assert.Equal(t, int64(1111111109/TOTP_PERIOD), rfcStep)
+	_, valid = validateTotp(rfcSecret, "081804", time.Unix(1111111109+2*TOTP_PERIOD, 0), 0)
+	assert.False(t, valid)
+	// a code is not accepted again after it or a later one was used
+	_, valid = validateTotp(rfcSecret, "081804", time.Unix(1111111109, 0), rfcStep)
+	assert.False(t, valid)
+}
+
+func TestAuditLog(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	user := &User{AlbyIdentifier: LND_USER_IDENTIFIER}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	request := newTestWebUI(t, svc, user).request
+
+	request(http.MethodPost, "/lnd/setup", url.Values{"token": {svc.lndSetupToken}, "password": {"password1"}, "password_confirmation": {"password1"}})
+	rec := request(http.MethodPost, "/lnd/auth", url.Values{"password": {"wrong"}})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = request(http.MethodPost, "/lnd/auth", url.Values{"password": {"password1"}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+	pubkey := strings.Repeat("a", 64)
+	rec = request(http.MethodPost, "/apps", url.Values{"name": {"Audited"}, "pubkey": {pubkey}, "RequestMethods": {NIP_47_PAY_INVOICE_METHOD}, "MaxAmount": {"10"}, "BudgetRenewal": {"monthly"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	request(http.MethodPost, "/budget", url.Values{"MaxAmount": {"5000"}, "BudgetRenewal": {"weekly"}})
+
+	// payments above the budget are recorded, other permission checks aren't
+	app := App{}
+	err = svc.db.Where("nostr_pubkey = ?", pubkey).First(&app).Error
+	assert.NoError(t, err)
+	ok, _, _ := svc.hasPermission(&app, &nostr.Event{}, NIP_47_PAY_INVOICE_METHOD, 100000)
+	assert.False(t, ok)
+	ok, _, _ = svc.hasPermission(&app, &nostr.Event{}, NIP_47_GET_BALANCE_METHOD, 0)
+	assert.False(t, ok)
+
+	rec = request(http.MethodPost, "/apps/delete/"+pubkey, url.Values{})
+	assert.Equal(t, http.StatusFound, rec.Code)
+
+	events := []AuditEvent{}
+	svc.db.Order("id").Find(&events)
+	actions := []string{}
+	for _, event := range events {
+		actions = append(actions, event.Action)
+		assert.Equal(t, user.ID, *event.UserId)
+	}
+	assert.Equal(t, []string{AUDIT_PASSWORD_SET, AUDIT_LOGIN_FAILED, AUDIT_LOGIN, AUDIT_APP_CREATED, AUDIT_BUDGET_UPDATED, AUDIT_PAYMENT_DENIED, AUDIT_APP_DELETED}, actions)
+	assert.Equal(t, app.ID, *events[6].AppId)
+	assert.Contains(t, events[6].Details, `"app":"Audited"`)
+	assert.Contains(t, events[5].Details, `"code":"QUOTA_EXCEEDED"`)
+	assert.Equal(t, "192.0.2.1", events[1].IP)
+
+	// the deleted app is still shown with its name
+	rec = request(http.MethodGet, "/audit?action="+AUDIT_APP_DELETED, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Audited")
+
+	rec = request(http.MethodGet, fmt.Sprintf("/audit.json?app=%d&from=%s", app.ID, time.Now().Format("2006-01-02")), nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	exported := []map[string]interface{}{}
+	err = json.Unmarshal(rec.Body.Bytes(), &exported)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(exported))
+	assert.Equal(t, AUDIT_APP_DELETED, exported[0]["action"])
+	assert.Equal(t, "Audited", exported[0]["details"].(map[string]interface{})["app"])
+	rec = request(http.MethodGet, "/audit.json?to=2000-01-01", nil)
+	assert.Equal(t, "[]\n", rec.Body.String())
+
+	// the log is append-only
+	err = svc.db.Model(&events[0]).Update("action", AUDIT_LOGIN).Error
+	assert.ErrorIs(t, err, ErrAuditEventImmutable)
+	err = svc.db.Delete(&events[0]).Error
+	assert.ErrorIs(t, err, ErrAuditEventImmutable)
+}
+
+func TestIPExtractor(t *testing.T) {
+	e := echo.New()
+	realIP := func(remoteAddr string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.5")
+		req.Header.Set(echo.HeaderXRealIP, "203.0.113.6")
+		return e.NewContext(req, httptest.NewRecorder()).RealIP()
+	}
+
+	// without trusted proxies the headers are ignored
+	extractor, err := newIPExtractor("")
+	assert.NoError(t, err)
+	e.IPExtractor = extractor
+	assert.Equal(t, "192.0.2.1", realIP("192.0.2.1:1234"))
+	assert.Equal(t, "10.0.0.2", realIP("10.0.0.2:1234"))
+
+	extractor, err = newIPExtractor("10.0.0.1, 172.16.0.0/12")
+	assert.NoError(t, err)
+	e.IPExtractor = extractor
+	assert.Equal(t, "203.0.113.5", realIP("10.0.0.1:1234"))
+	assert.Equal(t, "203.0.113.5", realIP("172.17.0.3:1234"))
+	// other hosts of the private network are not trusted
+	assert.Equal(t, "10.0.0.2", realIP("10.0.0.2:1234"))
+
+	_, err = newIPExtractor("proxy.example.com")
+	assert.Error(t, err)
+}
+
+func TestHandleEventPerAppServiceKey(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+	svc.cfg.PerAppServiceKeys = true
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	serviceKey, walletPubkey, err := deriveAppServiceKey(svc.cfg.NostrSecretKey, senderPubkey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, svc.cfg.IdentityPubkey, walletPubkey)
+	// the key is derived deterministically
+	_, derivedPubkey, err := deriveAppServiceKey(svc.cfg.NostrSecretKey, senderPubkey)
+	assert.NoError(t, err)
+	assert.Equal(t, walletPubkey, derivedPubkey)
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey, WalletPubkey: walletPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{svc.cfg.IdentityPubkey, walletPubkey}, svc.servicePubkeys())
+
+	ss, err := nip04.ComputeSharedSecret(walletPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(`{"method": "get_balance"}`, ss)
+	assert.NoError(t, err)
+	res, err := svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_service_key_event_1",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Tags:    nostr.Tags{[]string{"p", walletPubkey}},
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	// the reply is signed with the app's key
+	assert.Equal(t, walletPubkey, res.PubKey)
+	ok, err := res.CheckSignature()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	decrypted, err := nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Nil(t, received.Error)
+	assert.Equal(t, float64(21000), received.Result.(map[string]interface{})["balance"])
+
+	// so are notifications
+	notification, err := svc.createNotification(&app, NIP_47_HOLD_INVOICE_ACCEPTED, Nip47Transaction{})
+	assert.NoError(t, err)
+	assert.Equal(t, walletPubkey, notification.PubKey)
+	_, err = nip04.Decrypt(notification.Content, ss)
+	assert.NoError(t, err)
+
+	// unknown senders get an answer from the key they addressed
+	strangerPrivkey := nostr.GeneratePrivateKey()
+	strangerPubkey, err := nostr.GetPublicKey(strangerPrivkey)
+	assert.NoError(t, err)
+	strangerSs, err := nip04.ComputeSharedSecret(walletPubkey, strangerPrivkey)
+	assert.NoError(t, err)
+	payload, err = nip04.Encrypt(`{"method": "get_balance"}`, strangerSs)
+	assert.NoError(t, err)
+	res, err = svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_service_key_event_2",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  strangerPubkey,
+		Tags:    nostr.Tags{[]string{"p", walletPubkey}},
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, walletPubkey, res.PubKey)
+	_, err = nip04.Decrypt(res.Content, strangerSs)
+	assert.NoError(t, err)
+
+	_, appPubkey, err := svc.appServiceKey(&App{NostrPubkey: senderPubkey})
+	assert.NoError(t, err)
+	assert.Equal(t, svc.cfg.IdentityPubkey, appPubkey)
+	assert.NotEmpty(t, serviceKey)
+}
+
+func TestRotateIdentity(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+	svc.cfg.KeyRotationGracePeriod = 3600
+
+	_, err := svc.RotateIdentity(ctx)
+	assert.Error(t, err)
+	svc.identityStored = true
+	err = svc.db.Create(&Identity{Privkey: svc.cfg.NostrSecretKey}).Error
+	assert.NoError(t, err)
+	previousKey, previousPubkey := svc.cfg.NostrSecretKey, svc.cfg.IdentityPubkey
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	app := App{Name: "shared key", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	ownKeyPrivkey := nostr.GeneratePrivateKey()
+	ownKeyPubkey, err := nostr.GetPublicKey(ownKeyPrivkey)
+	assert.NoError(t, err)
+	_, previousWalletPubkey, err := deriveAppServiceKey(previousKey, ownKeyPubkey)
+	assert.NoError(t, err)
+	ownKeyApp := App{Name: "own key", NostrPubkey: ownKeyPubkey, WalletPubkey: previousWalletPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&ownKeyApp)
+	assert.NoError(t, err)
+
+	identity, err := svc.RotateIdentity(ctx)
+	assert.NoError(t, err)
+	assert.NotEqual(t, previousPubkey, svc.activeIdentity().pubkey)
+	retired := Identity{}
+	svc.db.Where("retired_at IS NOT NULL").First(&retired)
+	assert.Equal(t, previousKey, retired.Privkey)
+	assert.True(t, retired.ExpiresAt.After(time.Now()))
+	active := Identity{}
+	svc.db.Where("retired_at IS NULL").First(&active)
+	assert.Equal(t, identity.ID, active.ID)
+	assert.Equal(t, svc.activeIdentity().secretKey, active.Privkey)
+	svc.db.First(&ownKeyApp, ownKeyApp.ID)
+	_, walletPubkey, err := deriveAppServiceKey(svc.activeIdentity().secretKey, ownKeyPubkey)
+	assert.NoError(t, err)
+	assert.Equal(t, walletPubkey, ownKeyApp.WalletPubkey)
+	assert.ElementsMatch(t, []string{svc.activeIdentity().pubkey, previousPubkey, walletPubkey, previousWalletPubkey}, svc.servicePubkeys())
+
+	request := func(eventId string, senderPrivkey string, servicePubkey string) (*nostr.Event, error) {
+		senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+		assert.NoError(t, err)
+		ss, err := nip04.ComputeSharedSecret(servicePubkey, senderPrivkey)
+		assert.NoError(t, err)
+		payload, err := nip04.Encrypt(`{"method": "get_balance"}`, ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Tags:    nostr.Tags{[]string{"p", servicePubkey}},
+			Content: payload,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		return res, nil
+	}
+
+	// both keys are answered during the grace period
+	res, err := request("test_rotation_event_1", senderPrivkey, previousPubkey)
+	assert.NoError(t, err)
+	assert.Equal(t, previousPubkey, res.PubKey)
+	res, err = request("test_rotation_event_2", senderPrivkey, svc.activeIdentity().pubkey)
+	assert.NoError(t, err)
+	assert.Equal(t, svc.activeIdentity().pubkey, res.PubKey)
+	res, err = request("test_rotation_event_3", ownKeyPrivkey, previousWalletPubkey)
+	assert.NoError(t, err)
+	assert.Equal(t, previousWalletPubkey, res.PubKey)
+	res, err = request("test_rotation_event_4", ownKeyPrivkey, walletPubkey)
+	assert.NoError(t, err)
+	assert.Equal(t, walletPubkey, res.PubKey)
+
+	// apps are notified from the key they know
+	notification, err := svc.createRotationNotification(&ownKeyApp, serviceIdentity{secretKey: previousKey, pubkey: previousPubkey}, *retired.ExpiresAt)
+	assert.NoError(t, err)
+	assert.Equal(t, previousWalletPubkey, notification.PubKey)
+	ss, err := nip04.ComputeSharedSecret(previousWalletPubkey, ownKeyPrivkey)
+	assert.NoError(t, err)
+	decrypted, err := nip04.Decrypt(notification.Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Notification{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Equal(t, NIP_47_SERVICE_KEY_ROTATED, received.NotificationType)
+	assert.Equal(t, walletPubkey, received.Notification.(map[string]interface{})["pubkey"])
+
+	// zap receipts are signed with the key advertised when the zap was requested
+	zapRequest := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      NIP_57_ZAP_REQUEST_KIND,
+		Tags:      nostr.Tags{nostr.Tag{"p", previousPubkey}, nostr.Tag{"relays", "ws://127.0.0.1:1"}},
+	}
+	err = zapRequest.Sign(nostr.GeneratePrivateKey())
+	assert.NoError(t, err)
+	zap := Zap{PaymentHash: mockTransaction.PaymentHash, ZapRequest: zapRequest.String(), SigningPubkey: previousPubkey, State: ZAP_STATE_PENDING}
+	receipt, _, err := svc.createZapReceipt(&zap, mockTransaction)
+	assert.NoError(t, err)
+	assert.Equal(t, previousPubkey, receipt.PubKey)
+	ok, err := receipt.CheckSignature()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// the previous key is not answered after the grace period
+	svc.db.Model(&retired).Update("expires_at", time.Now().Add(-time.Second))
+	_, err = request("test_rotation_event_5", senderPrivkey, previousPubkey)
+	assert.Error(t, err)
+	_, _, err = svc.createZapReceipt(&zap, mockTransaction)
+	assert.Error(t, err)
+	assert.ElementsMatch(t, []string{svc.activeIdentity().pubkey, walletPubkey}, svc.servicePubkeys())
+}
+
+func TestAppsRotateSecret(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+	user := &User{AlbyIdentifier: LND_USER_IDENTIFIER}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+	ui := newTestWebUI(t, svc, user)
+	post := func(target string, form url.Values) *httptest.ResponseRecorder {
+		return ui.request(http.MethodPost, target, form)
+	}
+	rec := post("/lnd/setup", url.Values{"token": {svc.lndSetupToken}, "password": {"password1"}, "password_confirmation": {"password1"}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+
+	previousPrivkey := nostr.GeneratePrivateKey()
+	previousPubkey, err := nostr.GetPublicKey(previousPrivkey)
+	assert.NoError(t, err)
+	app := App{Name: "Test", NostrPubkey: previousPubkey}
+	err = svc.db.Model(user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	err = svc.db.Create(&AppPermission{AppId: app.ID, RequestMethod: NIP_47_GET_BALANCE_METHOD, MaxAmount: 1000, BudgetRenewal: "monthly"}).Error
+	assert.NoError(t, err)
+	event := NostrEvent{AppId: app.ID, NostrId: "test_rotate_secret_payment"}
+	err = svc.db.Create(&event).Error
+	assert.NoError(t, err)
+	err = svc.db.Create(&Payment{AppId: app.ID, NostrEventId: event.ID, Amount: 100, State: PAYMENT_STATE_SETTLED}).Error
+	assert.NoError(t, err)
+
+	// apps of other users or unknown pubkeys can't be rotated
+	rec = post("/apps/rotate/"+strings.Repeat("a", 64), url.Values{})
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/apps", rec.Header().Get("Location"))
+
+	rec = post("/apps/rotate/"+previousPubkey, url.Values{})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	match := regexp.MustCompile(`secret=([0-9a-f]{64})`).FindStringSubmatch(rec.Body.String())
+	assert.NotNil(t, match)
+	secret := match[1]
+	pubkey, err := nostr.GetPublicKey(secret)
+	assert.NoError(t, err)
+	assert.NotEqual(t, previousPubkey, pubkey)
+
+	// the app keeps its permissions and payments
+	rotated := App{}
+	err = svc.db.Where("nostr_pubkey = ?", pubkey).First(&rotated).Error
+	assert.NoError(t, err)
+	assert.Equal(t, app.ID, rotated.ID)
+	var count int64
+	svc.db.Model(&AppPermission{}).Where("app_id = ?", app.ID).Count(&count)
+	assert.Equal(t, int64(1), count)
+	svc.db.Model(&Payment{}).Where("app_id = ?", app.ID).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	request := func(eventId string, senderPrivkey string) *Nip47Response {
+		senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+		assert.NoError(t, err)
+		ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+		assert.NoError(t, err)
+		payload, err := nip04.Encrypt(`{"method": "get_balance"}`, ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+	received := request("test_rotate_secret_event_1", previousPrivkey)
+	assert.Equal(t, NIP_47_ERROR_UNAUTHORIZED, received.Error.Code)
+	received = request("test_rotate_secret_event_2", secret)
+	assert.Nil(t, received.Error)
+}
+
+// testBunker stands in for a NIP-46 remote signer holding the service key
+type testBunker struct {
+	secretKey string
+	pubkey    string
+	secret    string
+	signer    *Nip46Signer
+	connected map[string]bool
+	mu        sync.Mutex
+	// if set, sign_event requests have to be approved at this URL first
+	authUrl string
+	// delivers the responses, directly to the signer if not set
+	respond func(event *nostr.Event)
+}
+
+func (bunker *testBunker) publish(ctx context.Context, event nostr.Event) error {
+	go bunker.handleRequest(event)
+	return nil
+}
+
+func (bunker *testBunker) handleRequest(event nostr.Event) {
+	local := NewLocalSigner(bunker.secretKey, bunker.pubkey)
+	payload, err := local.Nip04Decrypt(event.PubKey, event.Content)
+	if err != nil {
+		return
+	}
+	request := Nip46Request{}
+	err = json.Unmarshal([]byte(payload), &request)
+	if err != nil {
+		return
+	}
+	response := Nip46Response{ID: request.ID}
+	bunker.mu.Lock()
+	connected := bunker.connected[event.PubKey]
+	bunker.mu.Unlock()
+	switch {
+	case request.Method == "connect":
+		if len(request.Params) < 2 || request.Params[1] != bunker.secret {
+			response.Error = "invalid secret"
+			break
+		}
+		bunker.mu.Lock()
+		bunker.connected[event.PubKey] = true
+		bunker.mu.Unlock()
+		response.Result = "ack"
+	case !connected:
+		response.Error = "unauthorized"
+	case request.Method == "get_public_key":
+		response.Result = bunker.pubkey
+	case request.Method == "sign_event":
+		unsigned := nostr.Event{}
+		err = json.Unmarshal([]byte(request.Params[0]), &unsigned)
+		if err == nil {
+			err = local.SignEvent(&unsigned)
+		}
+		signed, _ := json.Marshal(unsigned)
+		response.Result = string(signed)
+	case request.Method == "nip04_encrypt":
+		response.Result, err = local.Nip04Encrypt(request.Params[0], request.Params[1])
+	case request.Method == "nip04_decrypt":
+		response.Result, err = local.Nip04Decrypt(request.Params[0], request.Params[1])
+	default:
+		response.Error = "unknown method"
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	if bunker.authUrl != "" && request.Method == "sign_event" {
+		bunker.sendResponse(local, event.PubKey, Nip46Response{ID: request.ID, Result: "auth_url", Error: bunker.authUrl})
+	}
+	bunker.sendResponse(local, event.PubKey, response)
+}
+
+func (bunker *testBunker) sendResponse(local Signer, clientPubkey string, response Nip46Response) {
+	responseBytes, _ := json.Marshal(response)
+	content, _ := local.Nip04Encrypt(clientPubkey, string(responseBytes))
+	responseEvent := &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      NIP_46_KIND,
+		Tags:      nostr.Tags{[]string{"p", clientPubkey}},
+		Content:   content,
+	}
+	local.SignEvent(responseEvent)
+	if bunker.respond != nil {
+		bunker.respond(responseEvent)
+		return
+	}
+	bunker.signer.HandleResponse(responseEvent)
+}
+
+// testRelay is a minimal relay between the signer and the test bunker, it only keeps the latest connection
+type testRelay struct {
+	server      *httptest.Server
+	mu          sync.Mutex
+	conn        net.Conn
+	sub         string
+	connections int
+}
+
+func newTestRelay(bunker *testBunker) *testRelay {
+	relay := &testRelay{}
+	bunker.respond = func(event *nostr.Event) {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		message, _ := json.Marshal([]interface{}{"EVENT", relay.sub, event})
+		wsutil.WriteServerText(relay.conn, message)
+	}
+	relay.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		relay.mu.Lock()
+		relay.conn = conn
+		relay.connections++
+		relay.mu.Unlock()
+		for {
+			data, _, err := wsutil.ReadClientData(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			message := []json.RawMessage{}
+			if json.Unmarshal(data, &message) != nil || len(message) < 2 {
+				continue
+			}
+			label := ""
+			json.Unmarshal(message[0], &label)
+			switch label {
+			case "REQ":
+				relay.mu.Lock()
+				json.Unmarshal(message[1], &relay.sub)
+				relay.mu.Unlock()
+			case "EVENT":
+				event := nostr.Event{}
+				json.Unmarshal(message[1], &event)
+				ok, _ := json.Marshal([]interface{}{"OK", event.ID, true, ""})
+				relay.mu.Lock()
+				wsutil.WriteServerText(conn, ok)
+				relay.mu.Unlock()
+				go bunker.handleRequest(event)
+			}
+		}
+	}))
+	return relay
+}
+
+func (relay *testRelay) url() string {
+	return "ws" + strings.TrimPrefix(relay.server.URL, "http")
+}
+
+// disconnect drops the connection of the signer
+func (relay *testRelay) disconnect() {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	relay.conn.Close()
+}
+
+func TestNip46Signer(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+
+	bunker := &testBunker{secretKey: svc.cfg.NostrSecretKey, pubkey: svc.cfg.IdentityPubkey, secret: "bunkersecret", connected: map[string]bool{}}
+	signer, err := NewNip46Signer(nostr.GeneratePrivateKey(), bunker.pubkey, time.Second, bunker.publish)
+	assert.NoError(t, err)
+	bunker.signer = signer
+	err = signer.Connect("wrong")
+	assert.Error(t, err)
+	err = signer.Connect(bunker.secret)
+	assert.NoError(t, err)
+	assert.Equal(t, bunker.pubkey, signer.GetPublicKey())
+
+	// the service only knows the pubkey
+	svc.setActiveIdentity("", bunker.pubkey)
+	svc.signer = signer
+
+	user := &User{ID: 0, AlbyIdentifier: "dummy"}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(bunker.pubkey, senderPrivkey)
+	assert.NoError(t, err)
+	payload, err := nip04.Encrypt(`{"method": "get_balance"}`, ss)
+	assert.NoError(t, err)
+
+	res, err := svc.HandleEvent(ctx, &nostr.Event{
+		ID:      "test_nip46_event_1",
+		Kind:    NIP_47_REQUEST_KIND,
+		PubKey:  senderPubkey,
+		Content: payload,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, bunker.pubkey, res.PubKey)
+	ok, err := res.CheckSignature()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	decrypted, err := nip04.Decrypt(res.Content, ss)
+	assert.NoError(t, err)
+	received := &Nip47Response{}
+	err = json.Unmarshal([]byte(decrypted), received)
+	assert.NoError(t, err)
+	assert.Nil(t, received.Error)
+
+	notification, err := svc.createNotification(&app, NIP_47_HOLD_INVOICE_ACCEPTED, Nip47Transaction{})
+	assert.NoError(t, err)
+	assert.Equal(t, bunker.pubkey, notification.PubKey)
+	_, err = nip04.Decrypt(notification.Content, ss)
+	assert.NoError(t, err)
+
+	// app keys can't be derived without the private key
+	_, _, err = svc.appServiceKey(&App{NostrPubkey: senderPubkey, WalletPubkey: "derived"})
+	assert.Error(t, err)
+
+	// requests time out if the remote signer doesn't answer
+	silent, err := NewNip46Signer(nostr.GeneratePrivateKey(), bunker.pubkey, 10*time.Millisecond, func(ctx context.Context, event nostr.Event) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	err = silent.Connect(bunker.secret)
+	assert.Error(t, err)
+}
+
+func TestNip46SignerRelay(t *testing.T) {
+	bunkerKey := nostr.GeneratePrivateKey()
+	bunkerPubkey, err := nostr.GetPublicKey(bunkerKey)
+	assert.NoError(t, err)
+	bunker := &testBunker{secretKey: bunkerKey, pubkey: bunkerPubkey, secret: "bunkersecret", connected: map[string]bool{}, authUrl: "https://bunker.example.com/approve"}
+	relay := newTestRelay(bunker)
+	defer relay.server.Close()
+	logs := logtest.NewGlobal()
+	defer logs.Reset()
+
+	signer, err := ConnectNip46Signer(context.TODO(), fmt.Sprintf("bunker://%s?relay=%s&secret=%s", bunkerPubkey, relay.url(), bunker.secret), "", time.Second)
+	assert.NoError(t, err)
+	defer signer.Close()
+	assert.Equal(t, bunkerPubkey, signer.GetPublicKey())
+
+	event := &nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "hello"}
+	err = signer.SignEvent(event)
+	assert.NoError(t, err)
+	// the approval URL is logged for the operator, events are not necessarily delivered in order
+	assert.Eventually(t, func() bool {
+		for _, entry := range logs.AllEntries() {
+			if entry.Data["url"] == bunker.authUrl {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	// the signer reconnects and subscribes to the responses again
+	relay.disconnect()
+	assert.Eventually(t, func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return relay.connections == 2 && relay.sub != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return signer.SignEvent(&nostr.Event{CreatedAt: nostr.Now(), Kind: 1, Content: "again"}) == nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestAlbySupportedMethods(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	albySvc := &AlbyOAuthService{db: svc.db, secrets: svc.secrets, Logger: svc.Logger}
+
+	// the scopes are taken from the token endpoint response
+	user := &User{AlbyIdentifier: "dummy"}
+	token := (&oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}).WithExtra(map[string]interface{}{"scope": "account:read balance:read invoices:read"})
+	err := albySvc.setUserToken(user, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "account:read balance:read invoices:read", user.AlbyScopes)
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+
+	methods, err := albySvc.GetSupportedMethods(ctx, user)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{NIP_47_GET_BALANCE_METHOD, NIP_47_GET_INFO_METHOD, NIP_47_GET_BUDGET_METHOD, NIP_47_LOOKUP_INVOICE_METHOD}, methods)
+
+	// tokens that were not refreshed keep the recorded scopes
+	err = albySvc.setUserToken(user, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"})
+	assert.NoError(t, err)
+	assert.Equal(t, "account:read balance:read invoices:read", user.AlbyScopes)
+
+	// users who logged in before the scopes were recorded
+	svc.db.Model(user).Update("alby_scopes", "")
+	svc.db.First(user, user.ID)
+	methods, err = albySvc.GetSupportedMethods(ctx, user)
+	assert.NoError(t, err)
+	assert.Equal(t, albySupportedMethods, methods)
+}
+
+func TestAlbyLookupPayment(t *testing.T) {
+	ctx := context.TODO()
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	invoices := map[string]string{
+		"settled": `{"settled": true, "preimage": "123preimage"}`,
+		"error":   `{"state": "error"}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invoice, ok := invoices[strings.TrimPrefix(r.URL.Path, "/invoices/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": true, "message": "Not found"}`))
+			return
+		}
+		w.Write([]byte(invoice))
+	}))
+	defer server.Close()
+	albySvc := &AlbyOAuthService{cfg: &Config{AlbyAPIURL: server.URL}, oauthConf: &oauth2.Config{}, db: svc.db, secrets: svc.secrets, Logger: svc.Logger}
+	user := &User{AlbyIdentifier: "dummy"}
+	err := albySvc.setUserToken(user, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: nostr.GeneratePrivateKey()}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+
+	state, preimage, err := albySvc.LookupPayment(ctx, app.NostrPubkey, "settled")
+	assert.NoError(t, err)
+	assert.Equal(t, PAYMENT_STATE_SETTLED, state)
+	assert.Equal(t, "123preimage", preimage)
+	state, _, err = albySvc.LookupPayment(ctx, app.NostrPubkey, "error")
+	assert.NoError(t, err)
+	assert.Equal(t, PAYMENT_STATE_FAILED, state)
+	// a payment that isn't listed yet might still be made, it must not be paid again
+	state, _, err = albySvc.LookupPayment(ctx, app.NostrPubkey, "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, PAYMENT_STATE_PENDING, state)
+}
+
+func TestLNDMacaroonPermissions(t *testing.T) {
+	// a read-only macaroon that may additionally create invoices
+	macaroonId, err := proto.Marshal(&lnrpc.MacaroonId{
+		Nonce:     []byte("nonce"),
+		StorageId: []byte("0"),
+		Ops: []*lnrpc.Op{
+			{Entity: "info", Actions: []string{"read"}},
+			{Entity: "offchain", Actions: []string{"read"}},
+			{Entity: "invoices", Actions: []string{"read"}},
+			{Entity: "uri", Actions: []string{"/lnrpc.Lightning/AddInvoice"}},
+		},
+	})
+	assert.NoError(t, err)
+	mac, err := macaroon.New([]byte("rootkey"), append([]byte{3}, macaroonId...), "lnd", macaroon.LatestVersion)
+	assert.NoError(t, err)
+	permissions, err := lnd.DecodeMacaroonPermissions(mac)
+	assert.NoError(t, err)
+	missingPermissions, disabledMethods := lndDisabledMethods(permissions)
+	assert.Equal(t, []string{"address:write", "invoices:write", "message:read", "message:write", "offchain:write", "onchain:read", "onchain:write"}, missingPermissions)
+	assert.True(t, disabledMethods[NIP_47_PAY_INVOICE_METHOD])
+	assert.True(t, disabledMethods[NIP_47_MAKE_HOLD_INVOICE_METHOD])
+	assert.False(t, disabledMethods[NIP_47_MAKE_INVOICE_METHOD])
+	assert.False(t, disabledMethods[NIP_47_GET_BALANCE_METHOD])
+	assert.False(t, disabledMethods[NIP_47_GET_BUDGET_METHOD])
+
+	// payments can only be made if pending ones can be tracked
+	macaroonId, err = proto.Marshal(&lnrpc.MacaroonId{
+		Nonce:     []byte("nonce"),
+		StorageId: []byte("0"),
+		Ops: []*lnrpc.Op{
+			{Entity: "info", Actions: []string{"read"}},
+			{Entity: "offchain", Actions: []string{"write"}},
+		},
+	})
+	assert.NoError(t, err)
+	sendOnly, err := macaroon.New([]byte("rootkey"), append([]byte{3}, macaroonId...), "lnd", macaroon.LatestVersion)
+	assert.NoError(t, err)
+	permissions, err = lnd.DecodeMacaroonPermissions(sendOnly)
+	assert.NoError(t, err)
+	missingPermissions, disabledMethods = lndDisabledMethods(permissions)
+	assert.Contains(t, missingPermissions, "offchain:read")
+	assert.True(t, disabledMethods[NIP_47_PAY_INVOICE_METHOD])
+	assert.True(t, disabledMethods[NIP_47_PAY_KEYSEND_METHOD])
+	assert.True(t, disabledMethods[NIP_47_PAY_LNURL_METHOD])
+
+	// the connect URI carries the cert as base64url DER
+	macaroonBytes, err := mac.MarshalBinary()
+	assert.NoError(t, err)
+	options, err := lnd.ParseLNDConnectUri("lndconnect://node.example.com:10009?cert=MIIB&macaroon=" + base64.RawURLEncoding.EncodeToString(macaroonBytes))
+	assert.NoError(t, err)
+	assert.Equal(t, "node.example.com:10009", options.Address)
+	assert.Equal(t, hex.EncodeToString(macaroonBytes), options.MacaroonHex)
+	certPem, err := hex.DecodeString(options.CertHex)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(certPem), "-----BEGIN CERTIFICATE-----\nMIIB\n"))
+	_, err = lnd.ParseLNDConnectUri("lndconnect://node.example.com:10009?cert=MIIB")
+	assert.Error(t, err)
+}
+
+func TestCapabilityDiscovery(t *testing.T) {
+	ctx := context.TODO()
+	svc, ln := createTestService(t)
+	defer os.Remove(testDB)
+	svc.ReceivedEOS = true
+	ln.UnsupportedMethods = []string{NIP_47_PAY_INVOICE_METHOD, NIP_47_SIGN_MESSAGE_METHOD, NIP_47_PAY_ONCHAIN_METHOD}
+	ln.UserUnsupportedMethods = []string{NIP_47_LOOKUP_INVOICE_METHOD}
+	svc.supportedMethods, _ = ln.GetSupportedMethods(ctx, nil)
+	assert.NotContains(t, svc.capabilities(), NIP_47_PAY_INVOICE_METHOD)
+	assert.Contains(t, svc.capabilities(), NIP_47_MAKE_INVOICE_METHOD)
+	assert.Contains(t, svc.capabilities(), NIP_47_LOOKUP_INVOICE_METHOD)
+
+	senderPrivkey := nostr.GeneratePrivateKey()
+	senderPubkey, err := nostr.GetPublicKey(senderPrivkey)
+	assert.NoError(t, err)
+	ss, err := nip04.ComputeSharedSecret(svc.cfg.IdentityPubkey, senderPrivkey)
+	assert.NoError(t, err)
+	user := &User{AlbyIdentifier: LND_USER_IDENTIFIER}
+	err = svc.db.Create(user).Error
+	assert.NoError(t, err)
+	app := App{Name: "test", NostrPubkey: senderPubkey}
+	err = svc.db.Model(&user).Association("Apps").Append(&app)
+	assert.NoError(t, err)
+
+	methods := svc.GetMethods(ctx, &app)
+	assert.NotContains(t, methods, NIP_47_PAY_INVOICE_METHOD)
+	assert.NotContains(t, methods, NIP_47_SIGN_MESSAGE_METHOD)
+	assert.Contains(t, methods, NIP_47_MAKE_INVOICE_METHOD)
+	assert.Contains(t, methods, NIP_47_GET_BALANCE_METHOD)
+	assert.NotContains(t, methods, NIP_47_LOOKUP_INVOICE_METHOD)
+
+	request := func(eventId string, method string, params string) *Nip47Response {
+		payload, err := nip04.Encrypt(fmt.Sprintf(`{"method": "%s", "params": %s}`, method, params), ss)
+		assert.NoError(t, err)
+		res, err := svc.HandleEvent(ctx, &nostr.Event{
+			ID:      eventId,
+			Kind:    NIP_47_REQUEST_KIND,
+			PubKey:  senderPubkey,
+			Content: payload,
+		})
+		assert.NoError(t, err)
+		decrypted, err := nip04.Decrypt(res.Content, ss)
+		assert.NoError(t, err)
+		received := &Nip47Response{}
+		err = json.Unmarshal([]byte(decrypted), received)
+		assert.NoError(t, err)
+		return received
+	}
+	received := request("test_capability_event_1", NIP_47_PAY_INVOICE_METHOD, `{"invoice": "lnbc"}`)
+	assert.Equal(t, NIP_47_ERROR_NOT_IMPLEMENTED, received.Error.Code)
+	received = request("test_capability_event_2", NIP_47_SIGN_MESSAGE_METHOD, `{"message": "hello"}`)
+	assert.Equal(t, NIP_47_ERROR_NOT_IMPLEMENTED, received.Error.Code)
+	received = request("test_capability_event_3", NIP_47_GET_BALANCE_METHOD, `{}`)
+	assert.Nil(t, received.Error)
+	received = request("test_capability_event_4", "unknown_method", `{}`)
+	assert.Equal(t, NIP_47_ERROR_NOT_IMPLEMENTED, received.Error.Code)
+	assert.Equal(t, "Unknown method: unknown_method", received.Error.Message)
+	// once at startup and once for the user, not on every request
+	assert.Equal(t, 2, ln.SupportedMethodsQueries)
+
+	// the form for new apps only offers what the wallet can do, also when requested by the app
+	ui := newTestWebUI(t, svc, user)
+	rec := ui.request(http.MethodPost, "/lnd/setup", url.Values{"token": {svc.lndSetupToken}, "password": {"password1"}, "password_confirmation": {"password1"}})
+	assert.Equal(t, http.StatusFound, rec.Code)
+	rec = ui.request(http.MethodGet, "/apps/new?name=Test&request_methods=get_balance%20sign_message%20get_budget%20pay_keysend%20pay_lnurl%20lookup_invoice", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `value="get_balance"`)
+	assert.Contains(t, rec.Body.String(), `value="get_budget"`)
+	assert.Contains(t, rec.Body.String(), `value="pay_keysend"`)
+	assert.Contains(t, rec.Body.String(), `value="pay_lnurl"`)
+	assert.NotContains(t, rec.Body.String(), `value="sign_message"`)
+	assert.NotContains(t, rec.Body.String(), `value="pay_invoice"`)
+	// neither what the wallet can't do for the user
+	assert.NotContains(t, rec.Body.String(), `value="lookup_invoice"`)
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	svc, _ := createTestService(t)
+	defer os.Remove(testDB)
+	svc.cfg.LNBackendType = LNDBackendType
+	svc.cfg.CookieSecret = "previoussecret"
+	svc.cfg.SessionTimeout = 3600
+	user := &User{AlbyIdentifier: LND_USER_IDENTIFIER}
+	err := svc.db.Create(user).Error
+	assert.NoError(t, err)
+
+	echologrus.Logger = svc.Logger
+	newEcho := func() *echo.Echo {
+		e := echo.New()
+		err := svc.RegisterLNDAuthRoutes(e, user)
+		assert.NoError(t, err)
+		svc.RegisterSharedRoutes(e)
+		return e
+	}
+	e := newEcho()
+	request := func(method string, target string, form url.Values, https bool, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		var req *http.Request
+		if form != nil {
+			form.Set("_csrf", "csrftoken")
+			req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		} else {
+			req = httptest.NewRequest(method, target, nil)
+		}
+		if https {
+			req.Header.Set(echo.HeaderXForwardedProto, "https")
+		}
+		req.AddCookie(&http.Cookie{Name: "_csrf", Value: "csrftoken"})
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// inline scripts and styles need the nonce of the request
+	rec := request(http.MethodGet, "/", nil, false, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	nonce := regexp.MustCompile(`script-src 'self' 'nonce-([^']+)'`).FindStringSubmatch(rec.Header().Get(echo.HeaderContentSecurityPolicy))
+	assert.NotNil(t, nonce)
+	assert.Contains(t, rec.Body.String(), fmt.Sprintf(`<script type="text/javascript" nonce="%s">`, nonce[1]))
+	assert.Contains(t, rec.Body.String(), fmt.Sprintf(`<style nonce="%s">`, nonce[1]))
+	assert.NotContains(t, rec.Body.String(), "onclick=")
+	assert.Equal(t, "DENY", rec.Header().Get(echo.HeaderXFrameOptions))
+	assert.Equal(t, "nosniff", rec.Header().Get(echo.HeaderXContentTypeOptions))
+	assert.Empty(t, rec.Header().Get(echo.HeaderStrictTransportSecurity))
+	secondNonce := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(request(http.MethodGet, "/", nil, false, nil).Header().Get(echo.HeaderContentSecurityPolicy))
+	assert.NotEqual(t, nonce[1], secondNonce[1])
+
+	// behind TLS
+	rec = request(http.MethodPost, "/lnd/setup", url.Values{"token": {svc.lndSetupToken}, "password": {"password1"}, "password_confirmation": {"password1"}}, true, nil)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "max-age=31536000", rec.Header().Get(echo.HeaderStrictTransportSecurity))
+	sessionCookies := rec.Result().Cookies()
+	assert.NotEmpty(t, sessionCookies)
+	for _, cookie := range sessionCookies {
+		assert.True(t, cookie.Secure)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	}
+
+	// pages with pairing secrets are not cached
+	rec = request(http.MethodPost, "/apps", url.Values{"name": {"Test"}, "RequestMethods": {NIP_47_GET_BALANCE_METHOD}}, true, sessionCookies)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "secret=")
+	assert.Equal(t, "no-store", rec.Header().Get(echo.HeaderCacheControl))
+	assert.Empty(t, request(http.MethodGet, "/apps", nil, true, sessionCookies).Header().Get(echo.HeaderCacheControl))
+
+	// sessions of the previous cookie secret stay valid after a rotation
+	svc.cfg.CookieSecret = "newsecret"
+	svc.cfg.CookieSecretPrevious = "previoussecret"
+	e = newEcho()
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/apps", nil, true, sessionCookies).Code)
+	svc.cfg.CookieSecretPrevious = ""
+	e = newEcho()
+	assert.Equal(t, http.StatusFound, request(http.MethodGet, "/apps", nil, true, sessionCookies).Code)
+}
+
+func createTestService(t *testing.T) (svc *Service, ln *MockLn) {
+	db, err := gorm.Open(sqlite.Open(testDB), &gorm.Config{})
+	assert.NoError(t, err)
+	err = db.AutoMigrate(&User{}, &App{}, &AppPermission{}, &NostrEvent{}, &Payment{}, &Identity{}, &PaymentApproval{}, &Zap{}, &HoldInvoice{}, &OnchainPayment{}, &EncryptionKey{}, &AuditEvent{}, &LightningAddressComment{})
+	assert.NoError(t, err)
+	ln = &MockLn{}
+	sk := nostr.GeneratePrivateKey()
+	pk, err := nostr.GetPublicKey(sk)
+	assert.NoError(t, err)
+
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetOutput(os.Stdout)
+	logger.SetLevel(logrus.InfoLevel)
+
+	svc = &Service{
+		cfg: &Config{
+			NostrSecretKey: sk,
+			IdentityPubkey: pk,
+		},
+		db:          db,
+		lnClient:    ln,
+		network:     mockNodeInfo.Network,
+		ReceivedEOS: false,
+		Logger:      logger,
+	}
+	svc.setActiveIdentity(sk, pk)
+	return svc, ln
+}
+
+// testWebUI serves the web UI of the LND backend for the user and keeps the cookies between requests like a browser
+type testWebUI struct {
+	e          *echo.Echo
+	cookies    map[string]*http.Cookie
+	remoteAddr string
+}
+
+func newTestWebUI(t *testing.T, svc *Service, user *User) *testWebUI {
+	svc.cfg.LNBackendType = LNDBackendType
+	svc.cfg.CookieSecret = "secret"
+	svc.cfg.SessionTimeout = 3600
+	echologrus.Logger = svc.Logger
+	e := echo.New()
+	err := svc.RegisterLNDAuthRoutes(e, user)
+	assert.NoError(t, err)
+	svc.loginLimiter = newLoginLimiter(rate.Inf, 0)
+	svc.RegisterSharedRoutes(e)
+	return &testWebUI{
+		e:       e,
+		cookies: map[string]*http.Cookie{"_csrf": {Name: "_csrf", Value: "csrftoken"}},
+	}
+}
+
+// request sends a form when given one, with the CSRF token added
+func (ui *testWebUI) request(method string, target string, form url.Values) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		form.Set("_csrf", "csrftoken")
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	if ui.remoteAddr != "" {
+		req.RemoteAddr = ui.remoteAddr
+	}
+	for _, cookie := range ui.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	ui.e.ServeHTTP(rec, req)
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(ui.cookies, cookie.Name)
+			continue
+		}
+		ui.cookies[cookie.Name] = cookie
+	}
+	return rec
+}
+
+type MockLn struct {
+	PaymentErr         error
+	PaymentCount       int
+	PaymentState       string
+	HoldInvoiceState   string
+	HoldInvoicesErr    error
+	OffersErr          error
+	UnsupportedMethods []string
+	// not supported for users in addition, like methods without granted OAuth scopes
+	UserUnsupportedMethods []string
+	// number of GetSupportedMethods calls
+	SupportedMethodsQueries int
+}
+
+func (mln *MockLn) SendPaymentSync(ctx context.Context, senderPubkey string, payReq string, amount int64) (preimage string, err error) {
+	if mln.PaymentErr != nil {
+		return "", mln.PaymentErr
+	}
+	mln.PaymentCount++
+	return "123preimage", nil
+}
+
+func (mln *MockLn) LookupPayment(ctx context.Context, senderPubkey string, paymentHash string) (state string, preimage string, err error) {
+	if mln.PaymentState == PAYMENT_STATE_SETTLED {
+		return PAYMENT_STATE_SETTLED, "123preimage", nil
+	}
+	if mln.PaymentState == "" {
+		return PAYMENT_STATE_PENDING, "", nil
+	}
+	return mln.PaymentState, "", nil
+}
+
+func (mln *MockLn) SendKeysend(ctx context.Context, senderPubkey string, amount int64, destination, preimage string, custom_records []TLVRecord) (preImage string, err error) {
+	return "123preimage", nil
+}
+
+func (mln *MockLn) GetBalance(ctx context.Context, senderPubkey string) (balance int64, err error) {
+	return 21, nil
+}
+
+func (mln *MockLn) GetInfo(ctx context.Context, senderPubkey string) (info *NodeInfo, err error) {
+	return &mockNodeInfo, nil
+}
+
+func (mln *MockLn) MakeInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	// like LND, an invoice has either a description or a description hash
+	if description != "" && descriptionHash != "" {
+		return nil, errors.New("both description and description hash set")
+	}
+	return mockTransaction, nil
+}
+
+func (mln *MockLn) LookupInvoice(ctx context.Context, senderPubkey string, paymentHash string) (transaction *Nip47Transaction, err error) {
+	return mockTransaction, nil
+}
+
+func (mln *MockLn) ListTransactions(ctx context.Context, senderPubkey string, from, until, limit, offset uint64, unpaid bool, invoiceType string) (invoices []Nip47Transaction, err error) {
+	return mockTransactions, nil
+}
+
+func (mln *MockLn) MakeHoldInvoice(ctx context.Context, senderPubkey string, amount int64, description string, descriptionHash string, paymentHash string, expiry int64) (transaction *Nip47Transaction, err error) {
+	return &Nip47Transaction{
+		Type:        "incoming",
+		Invoice:     mockInvoice,
+		PaymentHash: paymentHash,
+		Amount:      amount,
+	}, nil
+}
+
+func (mln *MockLn) SettleHoldInvoice(ctx context.Context, senderPubkey string, preimage string) (err error) {
+	return nil
+}
+
+func (mln *MockLn) CancelHoldInvoice(ctx context.Context, senderPubkey string, paymentHash string) (err error) {
+	return nil
+}
+
+func (mln *MockLn) GetHoldInvoiceState(ctx context.Context, senderPubkey string, paymentHash string) (state string, err error) {
+	if mln.HoldInvoicesErr != nil {
+		return "", mln.HoldInvoicesErr
+	}
+	return mln.HoldInvoiceState, nil
+}
+
+func (mln *MockLn) FetchOfferInvoice(ctx context.Context, senderPubkey string, offer string, amount int64, payerNote string) (invoice string, paymentHash string, invoiceAmount int64, err error) {
+	if mln.OffersErr != nil {
+		return "", "", 0, mln.OffersErr
+	}
+	// each fetched invoice has a payment hash of its own
+	hash := make([]byte, 32)
+	rand.Read(hash)
+	return "lni1mockinvoice", hex.EncodeToString(hash), 50000, nil
+}
+
+func (mln *MockLn) PayOfferInvoice(ctx context.Context, senderPubkey string, invoice string) (preimage string, err error) {
+	mln.PaymentCount++
+	return "123preimage", nil
+}
+
+func (mln *MockLn) MakeOffer(ctx context.Context, senderPubkey string, amount int64, description string) (offer string, err error) {
+	if mln.OffersErr != nil {
+		return "", mln.OffersErr
+	}
+	return "lno1mockoffer", nil
+}
+
+func (mln *MockLn) SignMessage(ctx context.Context, senderPubkey string, message string) (signature string, err error) {
+	return "mocksignature:" + message, nil
+}
+
+func (mln *MockLn) VerifyMessage(ctx context.Context, senderPubkey string, message string, signature string) (valid bool, pubkey string, err error) {
+	return signature == "mocksignature:"+message, mockNodeInfo.Pubkey, nil
+}
+
+func (mln *MockLn) GetOnchainBalance(ctx context.Context, senderPubkey string) (balance *OnchainBalance, err error) {
+	return &OnchainBalance{Confirmed: 100000, Unconfirmed: 2000, Reserved: 10000}, nil
+}
+
+func (mln *MockLn) MakeOnchainAddress(ctx context.Context, senderPubkey string) (address string, err error) {
+	return "bcrt1qmockaddress", nil
+}
+
+func (mln *MockLn) SendOnchain(ctx context.Context, senderPubkey string, address string, amount int64, satPerVbyte uint64) (txId string, err error) {
+	mln.PaymentCount++
+	if mln.PaymentErr != nil {
+		return "", mln.PaymentErr
+	}
+	return "mocktxid", nil
+}
+
+func (mln *MockLn) ListChannels(ctx context.Context, senderPubkey string) (channels []Channel, err error) {
+	return []Channel{
+		{Id: "1", ChannelPoint: "txid:0", RemotePubkey: "peer1", Capacity: 100000, LocalBalance: 70000, RemoteBalance: 29000, LocalReserve: 1000, RemoteReserve: 1000, Active: true, Public: true},
+		{Id: "2", ChannelPoint: "txid:1", RemotePubkey: "peer2", Capacity: 50000, LocalBalance: 500, RemoteBalance: 48000, LocalReserve: 1000, RemoteReserve: 1000, Active: true},
+		{Id: "3", ChannelPoint: "txid:2", RemotePubkey: "peer3", Capacity: 50000, LocalBalance: 49000, RemoteBalance: 0, Active: false},
+	}, nil
+}
+
+func (mln *MockLn) ListPendingChannels(ctx context.Context, senderPubkey string) (channels []PendingChannel, err error) {
+	return []PendingChannel{
+		{ChannelPoint: "txid:3", RemotePubkey: "peer4", Capacity: 20000, LocalBalance: 19000, State: PENDING_CHANNEL_STATE_OPENING},
+	}, nil
+}
+
+// createMockInvoice creates a bolt11 invoice signed by a random node key
+func createMockInvoice(amount int64, expiry time.Duration, net *chaincfg.Params) string {
+	return createMockInvoiceWithDescription(amount, expiry, net, zpay32.Description("mock invoice"))
+}
+
+func createMockInvoiceWithDescription(amount int64, expiry time.Duration, net *chaincfg.Params, description func(*zpay32.Invoice)) string {
+	nodeKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	var paymentHash [32]byte
+	var paymentAddr [32]byte
+	rand.Read(paymentHash[:])
+	rand.Read(paymentAddr[:])
+	// expired invoices are created in the past
+	createdAt := time.Now()
+	if expiry < 0 {
+		createdAt = createdAt.Add(2 * expiry)
+		expiry = -expiry
+	}
+	options := []func(*zpay32.Invoice){
+		description,
+		zpay32.Expiry(expiry),
+		zpay32.PaymentAddr(paymentAddr),
+	}
+	if amount > 0 {
+		options = append(options, zpay32.Amount(lnwire.MilliSatoshi(amount)))
+	}
+	invoice, err := zpay32.NewInvoice(net, paymentHash, createdAt, options...)
+	if err != nil {
+		panic(err)
+	}
+	bolt11, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return ecdsa.SignCompact(nodeKey, chainhash.HashB(msg), true)
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return bolt11
+}
+
+func (mln *MockLn) GetSupportedMethods(ctx context.Context, user *User) (methods []string, err error) {
+	mln.SupportedMethodsQueries++
+	for _, method := range strings.Split(NIP_47_CAPABILITIES, " ") {
+		if !containsMethod(mln.UnsupportedMethods, method) && (user == nil || !containsMethod(mln.UserUnsupportedMethods, method)) {
+			methods = append(methods, method)
+		}
+	}
+	return methods, nil
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// Signer holds a service key and does all operations that need the private key,
+// so the key can live outside of this process (see Nip46Signer)
+type Signer interface {
+	GetPublicKey() string
+	SignEvent(event *nostr.Event) error
+	Nip04Encrypt(pubkey string, plaintext string) (string, error)
+	Nip04Decrypt(pubkey string, ciphertext string) (string, error)
+}
+
+// LocalSigner signs with a private key held in memory
+type LocalSigner struct {
+	secretKey string
+	pubkey    string
+}
+
+func NewLocalSigner(secretKey string, pubkey string) *LocalSigner {
+	return &LocalSigner{secretKey: secretKey, pubkey: pubkey}
+}
+
+func (signer *LocalSigner) GetPublicKey() string {
+	return signer.pubkey
+}
+
+func (signer *LocalSigner) SignEvent(event *nostr.Event) error {
+	event.PubKey = signer.pubkey
+	return event.Sign(signer.secretKey)
+}
+
+func (signer *LocalSigner) Nip04Encrypt(pubkey string, plaintext string) (string, error) {
+	ss, err := nip04.ComputeSharedSecret(pubkey, signer.secretKey)
+	if err != nil {
+		return "", err
+	}
+	return nip04.Encrypt(plaintext, ss)
+}
+
+func (signer *LocalSigner) Nip04Decrypt(pubkey string, ciphertext string) (string, error) {
+	ss, err := nip04.ComputeSharedSecret(pubkey, signer.secretKey)
+	if err != nil {
+		return "", err
+	}
+	return nip04.Decrypt(ciphertext, ss)
+}
+
+// signerFor returns the signer of a service key,
+// the identity key is held by the remote signer if one is configured
+func (svc *Service) signerFor(secretKey string, pubkey string) Signer {
+	if svc.signer != nil && pubkey == svc.activeIdentity().pubkey {
+		return svc.signer
+	}
+	return NewLocalSigner(secretKey, pubkey)
+}
+
+// eventSigner returns the signer of the service key a request was addressed to
+func (svc *Service) eventSigner(event *nostr.Event) (Signer, error) {
+	secretKey, pubkey, err := svc.eventServiceKey(event)
+	if err != nil {
+		return nil, err
+	}
+	return svc.signerFor(secretKey, pubkey), nil
+}
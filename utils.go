@@ -41,3 +41,12 @@ func GetEndOfBudget(budget_type string, createdAt time.Time) time.Time {
 		return time.Time{}
 	}
 }
+
+func containsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
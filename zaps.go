@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// how often pending zap invoices are checked for settlement
+	zapPollInterval = 10 * time.Second
+	// zap receipts are published to at most this many of the relays listed in the zap request
+	maxZapReceiptRelays      = 10
+	zapReceiptPublishTimeout = 10 * time.Second
+)
+
+// parseZapRequest returns the zap request if the invoice description is a NIP-57 zap request (kind 9734).
+// Descriptions that are not a zap request return nil without an error.
+func parseZapRequest(description string, amount int64) (*nostr.Event, error) {
+	zapRequest := &nostr.Event{}
+	err := json.Unmarshal([]byte(description), zapRequest)
+	if err != nil || zapRequest.Kind != NIP_57_ZAP_REQUEST_KIND {
+		return nil, nil
+	}
+
+	if zapRequest.GetID() != zapRequest.ID {
+		return nil, errors.New("Zap request has an invalid id")
+	}
+	ok, err := zapRequest.CheckSignature()
+	if err != nil || !ok {
+		return nil, errors.New("Zap request has an invalid signature")
+	}
+	if len(zapRequest.Tags.GetAll([]string{"p"})) != 1 {
+		return nil, errors.New("Zap request must have exactly one p tag")
+	}
+	if len(zapRequest.Tags.GetAll([]string{"e"})) > 1 {
+		return nil, errors.New("Zap request must not have more than one e tag")
+	}
+	relays := zapRequest.Tags.GetFirst([]string{"relays"})
+	if relays == nil || len(*relays) < 2 {
+		return nil, errors.New("Zap request must have a relays tag")
+	}
+	amountTag := zapRequest.Tags.GetFirst([]string{"amount"})
+	if amountTag != nil && amountTag.Value() != strconv.FormatInt(amount, 10) {
+		return nil, errors.New("Zap request amount does not match the invoice amount")
+	}
+	return zapRequest, nil
+}
+
+// watchZap stores the invoice of a zap request so the zap receipt is published once it is settled.
+// app is nil for invoices of the lightning address. The receipt is signed with the key
+// advertised as nostrPubkey of the LNURL service, which can be rotated until the invoice is settled.
+func (svc *Service) watchZap(app *App, transaction *Nip47Transaction, zapRequest string, signingPubkey string) error {
+	zap := Zap{
+		App:           app,
+		PaymentHash:   transaction.PaymentHash,
+		Invoice:       transaction.Invoice,
+		ZapRequest:    zapRequest,
+		SigningPubkey: signingPubkey,
+		State:         ZAP_STATE_PENDING,
+	}
+	if transaction.ExpiresAt != nil {
+		expiresAt := time.Unix(*transaction.ExpiresAt, 0)
+		zap.ExpiresAt = &expiresAt
+	}
+	return svc.db.Create(&zap).Error
+}
+
+// WatchZaps periodically checks the pending zap invoices and publishes the zap receipts of the settled ones
+func (svc *Service) WatchZaps(ctx context.Context) {
+	ticker := time.NewTicker(zapPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			svc.processPendingZaps(ctx)
+		}
+	}
+}
+
+func (svc *Service) processPendingZaps(ctx context.Context) {
+	// zaps whose invoice expired before the last check can't be settled anymore and are not looked up again
+	err := svc.db.Model(&Zap{}).
+		Where("state = ? AND expires_at < ?", ZAP_STATE_PENDING, time.Now().Add(-zapPollInterval)).
+		Update("state", ZAP_STATE_EXPIRED).Error
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to expire pending zaps")
+		return
+	}
+
+	zaps := []Zap{}
+	err = svc.db.Preload("App").Where("state = ?", ZAP_STATE_PENDING).Find(&zaps).Error
+	if err != nil {
+		svc.Logger.WithError(err).Error("Failed to load pending zaps")
+		return
+	}
+
+	for _, zap := range zaps {
+		senderPubkey := ""
+		if zap.App != nil {
+			senderPubkey = zap.App.NostrPubkey
+		}
+		transaction, err := svc.lnClient.LookupInvoice(ctx, senderPubkey, zap.PaymentHash)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"zapId":       zap.ID,
+				"appId":       zap.AppId,
+				"paymentHash": zap.PaymentHash,
+			}).Errorf("Failed to look up zap invoice: %v", err)
+			continue
+		}
+		if transaction.SettledAt == nil {
+			if zap.ExpiresAt != nil && time.Now().After(*zap.ExpiresAt) {
+				svc.db.Model(&zap).Update("state", ZAP_STATE_EXPIRED)
+			}
+			continue
+		}
+		svc.publishZapReceipt(ctx, &zap, transaction)
+	}
+}
+
+// createZapReceipt builds and signs the kind 9735 zap receipt of a settled zap invoice
+func (svc *Service) createZapReceipt(zap *Zap, transaction *Nip47Transaction) (receipt *nostr.Event, zapRequest *nostr.Event, err error) {
+	zapRequest = &nostr.Event{}
+	err = json.Unmarshal([]byte(zap.ZapRequest), zapRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tags := nostr.Tags{}
+	for _, key := range []string{"p", "e", "a"} {
+		tag := zapRequest.Tags.GetFirst([]string{key})
+		if tag != nil && len(*tag) > 1 {
+			tags = append(tags, nostr.Tag{key, tag.Value()})
+		}
+	}
+	tags = append(tags,
+		nostr.Tag{"P", zapRequest.PubKey},
+		nostr.Tag{"bolt11", zap.Invoice},
+		nostr.Tag{"description", zap.ZapRequest},
+	)
+	if transaction.Preimage != "" {
+		tags = append(tags, nostr.Tag{"preimage", transaction.Preimage})
+	}
+
+	createdAt := nostr.Now()
+	if transaction.SettledAt != nil {
+		createdAt = nostr.Timestamp(*transaction.SettledAt)
+	}
+	receipt = &nostr.Event{
+		CreatedAt: createdAt,
+		Kind:      NIP_57_ZAP_RECEIPT_KIND,
+		Tags:      tags,
+		Content:   "",
+	}
+	identity, err := svc.zapSigningIdentity(zap)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = svc.signerFor(identity.secretKey, identity.pubkey).SignEvent(receipt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return receipt, zapRequest, nil
+}
+
+// zapSigningIdentity returns the service key the zap receipt has to be signed with,
+// rotated keys are only available during their grace period
+func (svc *Service) zapSigningIdentity(zap *Zap) (serviceIdentity, error) {
+	// zaps stored before the signing key was recorded
+	if zap.SigningPubkey == "" {
+		return svc.activeIdentity(), nil
+	}
+	for _, identity := range svc.serviceIdentities() {
+		if identity.pubkey == zap.SigningPubkey {
+			return identity, nil
+		}
+	}
+	return serviceIdentity{}, fmt.Errorf("Signing key %s of the zap is not available anymore", zap.SigningPubkey)
+}
+
+func (svc *Service) publishZapReceipt(ctx context.Context, zap *Zap, transaction *Nip47Transaction) {
+	receipt, zapRequest, err := svc.createZapReceipt(zap, transaction)
+	if err != nil {
+		svc.Logger.WithFields(logrus.Fields{
+			"zapId": zap.ID,
+			"appId": zap.AppId,
+		}).Errorf("Failed to create zap receipt: %v", err)
+		svc.db.Model(zap).Update("state", ZAP_STATE_FAILED)
+		return
+	}
+
+	relays := (*zapRequest.Tags.GetFirst([]string{"relays"}))[1:]
+	if len(relays) > maxZapReceiptRelays {
+		relays = relays[:maxZapReceiptRelays]
+	}
+	published := 0
+	for _, url := range relays {
+		err = svc.publishToRelay(ctx, url, receipt)
+		if err != nil {
+			svc.Logger.WithFields(logrus.Fields{
+				"zapId":     zap.ID,
+				"receiptId": receipt.ID,
+				"relay":     url,
+			}).Infof("Failed to publish zap receipt: %v", err)
+			continue
+		}
+		published++
+	}
+
+	state := ZAP_STATE_PUBLISHED
+	if published == 0 {
+		state = ZAP_STATE_FAILED
+	}
+	svc.db.Model(zap).Updates(map[string]interface{}{"state": state, "receipt_id": receipt.ID})
+	svc.Logger.WithFields(logrus.Fields{
+		"zapId":     zap.ID,
+		"appId":     zap.AppId,
+		"receiptId": receipt.ID,
+		"relays":    published,
+		"state":     state,
+	}).Info("Processed zap receipt")
+}
+
+func (svc *Service) publishToRelay(ctx context.Context, url string, event *nostr.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, zapReceiptPublishTimeout)
+	defer cancel()
+	relay, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+	status, err := relay.Publish(ctx, *event)
+	if err != nil {
+		return err
+	}
+	if status != nostr.PublishStatusSucceeded {
+		return fmt.Errorf("relay did not confirm the event: %s", status)
+	}
+	return nil
+}